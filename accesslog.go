@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// accessLog 把访问记录按类似 nginx combined 的格式写入单独的文件,与运行日志分开。
+// 多个 Server 共享同一个 accessLog,每条记录一行,写入时加锁保证行不交错
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openAccessLog 以追加方式打开访问日志文件
+func openAccessLog(path string) (*accessLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLog{w: f}, nil
+}
+
+// log 在连接结束时写一条记录,尚未读到 HTTP 请求或 ClientHello 的连接不记录。格式为
+//
+//	HTTP: client_ip - - [time] "GET /path HTTP/1.1" status bytes_out "referer" "user_agent" "host"
+//	TLS:  client_ip - - [time] "TLS" - bytes_out "-" "-" "sni"
+//
+// 转发的请求拿不到后端的响应状态码,status 记为 -;被拒绝的 HTTP 请求记为 403
+func (a *accessLog) log(sess *session) {
+	if sess.req == nil && !sess.tls {
+		return
+	}
+
+	clientIP, _ := remoteIP(sess.clientAddr)
+	request, status, referer, userAgent := "TLS", "-", "-", "-"
+	if sess.req != nil {
+		request = sess.req.Method + " " + sess.req.RequestURI + " " + sess.req.Proto
+		referer = orDash(sess.req.Referer())
+		userAgent = orDash(sess.req.UserAgent())
+	}
+	if sess.status != 0 {
+		status = strconv.Itoa(sess.status)
+	}
+
+	line := fmt.Sprintf("%s - - [%s] %s %s %d %s %s %s\n",
+		clientIP, sess.start.Format("02/Jan/2006:15:04:05 -0700"), quoteLogField(request),
+		status, sess.bytesOut.Load(), quoteLogField(referer), quoteLogField(userAgent), quoteLogField(orDash(sess.host)))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	io.WriteString(a.w, line)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quoteLogField 用双引号包住字段,并转义其中的引号、反斜杠和控制字符,防止请求内容伪造日志行
+func quoteLogField(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HealthzHandler 只要进程能处理 HTTP 请求就返回 200,用作存活探针;维护模式下正文为 maintenance,
+// 状态码仍为 200,避免编排系统因维护而重启进程
+func HealthzHandler(m *maintenanceMode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if m.enabled() {
+			fmt.Fprintln(w, "maintenance")
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadyzHandler 在所有 Server 都已就绪时返回 200,否则返回 503 并逐行列出未就绪的 listener 和原因,
+// 用作就绪探针:收到 SIGTERM 开始排空后立即变为 503,让负载均衡停止分配新流量
+func ReadyzHandler(servers ...*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var notReady []string
+		for _, srv := range servers {
+			if ok, reason := srv.Ready(); !ok {
+				notReady = append(notReady, srv.cfg.ListenAddr+": "+reason)
+			}
+		}
+		if len(notReady) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(notReady, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// Ready 判断 Server 是否可以接收流量:已开始 Accept、没有在排空、不在维护模式,且开启健康检查时至少有一个后端健康
+func (s *Server) Ready() (bool, string) {
+	switch {
+	case s.draining.Load():
+		return false, "draining"
+	case s.cfg.Maintenance.enabled():
+		return false, "maintenance"
+	case !s.serving.Load():
+		return false, "not serving"
+	case s.health != nil && !s.health.anyUp():
+		return false, "no healthy backend"
+	}
+	return true, ""
+}
+
+// requireToken 要求请求带 Authorization: Bearer <token>。token 为空时不校验,
+// 此时 readOnly 为 true 则只放行 GET 和 HEAD,修改状态的请求(改白名单、断开连接、切换维护模式)返回 403
+func requireToken(token string, readOnly bool, h http.Handler) http.Handler {
+	if token == "" {
+		if !readOnly {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "forbidden: set -admin-token or listen on loopback", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackAddr 判断 host:port 形式的监听地址是否只监听本机回环地址,主机部分为空(监听所有地址)时返回 false
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// loadBackendTLSConfig 构造连接后端时使用的 TLS 配置:certFile/keyFile 是出示给后端的客户端证书(mTLS),
+// caFile 是校验后端证书的 CA,为空时使用系统根证书。serverName 为空时按后端地址中的主机名校验
+func loadBackendTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, NextProtos: []string{"http/1.1"}}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("-backend-cert 和 -backend-key 需要同时指定")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("无法加载后端客户端证书: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取后端 CA 文件: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("后端 CA 文件 %s 中没有 PEM 证书", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// backendTLSHandshake 在已连上的后端连接上以客户端身份完成 TLS 握手,握手受 DialTimeout 限制。
+// 返回的错误区分后端证书校验失败和后端拒绝客户端证书,便于排查 mTLS 配置
+func (s *Server) backendTLSHandshake(sess *session, conn net.Conn, addr string) (net.Conn, error) {
+	cfg := s.cfg.BackendTLSConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || strings.HasPrefix(addr, "unix:") {
+			return nil, fmt.Errorf("无法从后端地址 %q 得到校验证书用的主机名,请指定 -backend-server-name", addr)
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	ctx := sess.ctx
+	if s.cfg.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.DialTimeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, cfg)
+	start := time.Now()
+	err := tlsConn.HandshakeContext(ctx)
+	s.traceSpan(sess, "backend_tls_handshake", otelKindClient, start, err, "dst", addr, "server_name", cfg.ServerName)
+	if err == nil {
+		return &backendTLSConn{Conn: tlsConn, sess: sess, addr: addr}, nil
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &verifyErr):
+		return nil, fmt.Errorf("后端证书校验失败: %w", verifyErr.Err)
+	case isCertificateAlert(err):
+		return nil, fmt.Errorf("后端拒绝了客户端证书: %w", err)
+	case os.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded):
+		return nil, fmt.Errorf("与后端的 TLS 握手超时 (超过 %v): %w", s.cfg.DialTimeout, err)
+	}
+	return nil, fmt.Errorf("与后端的 TLS 握手失败: %w", err)
+}
+
+// isCertificateAlert 判断 err 是否为对端发来的证书类 TLS 告警(bad_certificate、unknown_ca、certificate_required 等)。
+// crypto/tls 不导出收到的告警类型,只能按告警文本判断
+func isCertificateAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error" && strings.Contains(opErr.Err.Error(), "certificate")
+}
+
+// backendTLSConn 是与后端的 TLS 连接。TLS 1.3 中后端在客户端发完握手消息后才校验客户端证书,
+// 拒绝时的告警要到第一次读取才会收到,所以在读写时识别并明确记录
+type backendTLSConn struct {
+	*tls.Conn
+	sess     *session
+	addr     string
+	received atomic.Bool // 已从后端读到过数据
+	logged   atomic.Bool
+}
+
+func (c *backendTLSConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.received.Store(true)
+	}
+	if err != nil && isCertificateAlert(err) && c.logged.CompareAndSwap(false, true) {
+		c.sess.logger.Error("无法与目标服务器建立 TLS 连接", "event", "backend_tls_error", "dst", c.addr, "error", fmt.Errorf("后端拒绝了客户端证书: %w", err))
+		c.sess.closeReason = "backend_tls_error"
+	}
+	return n, err
+}
+
+// Write 在 TLS 1.3 下还没收到后端任何数据就写失败时,后端多半是校验客户端证书失败后直接断开了连接,
+// 告警可能随连接重置一起丢失,在错误中加上提示
+func (c *backendTLSConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil && !c.received.Load() && c.ConnectionState().Version == tls.VersionTLS13 && !errors.Is(err, net.ErrClosed) {
+		err = fmt.Errorf("%w (后端在 TLS 握手后断开，可能拒绝了客户端证书)", err)
+	}
+	return n, err
+}
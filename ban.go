@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// banList 记录每个源 IP 在滑动窗口内被拒绝的次数,超过阈值后临时封禁。
+// 多个 Server 共享同一个 banList,封禁期间该 IP 的连接在 Accept 后直接关闭
+type banList struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	file      string // 持久化文件,为空时只保存在内存中
+	logger    *slog.Logger
+	saveMu    sync.Mutex // 串行化 save,保证最后写入的是最新的列表
+
+	failures map[string][]time.Time // 窗口内每次被拒绝的时间,按时间先后排列
+	bans     map[string]time.Time   // 封禁到期时间
+}
+
+// newBanList 创建封禁列表;file 不为空时从中恢复尚未到期的封禁
+func newBanList(threshold int, window, duration time.Duration, file string, logger *slog.Logger) (*banList, error) {
+	if window <= 0 || duration <= 0 {
+		return nil, fmt.Errorf("ban-window 和 ban-duration 必须大于 0")
+	}
+	b := &banList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		file:      file,
+		logger:    logger,
+		failures:  make(map[string][]time.Time),
+		bans:      make(map[string]time.Time),
+	}
+	if file == "" {
+		return b, nil
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// banned 判断 ip 是否处于封禁期,到期的封禁在这里顺便解除,失败计数同时清零
+func (b *banList) banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.bans[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(b.bans, ip)
+	delete(b.failures, ip)
+	return false
+}
+
+// fail 记录 ip 被拒绝一次,窗口内的次数达到阈值时开始封禁
+func (b *banList) fail(ip string) {
+	now := time.Now()
+
+	b.mu.Lock()
+	if _, ok := b.bans[ip]; ok {
+		b.mu.Unlock()
+		return
+	}
+	times := append(pruneBefore(b.failures[ip], now.Add(-b.window)), now)
+	if len(times) < b.threshold {
+		b.failures[ip] = times
+		b.mu.Unlock()
+		return
+	}
+	delete(b.failures, ip)
+	b.bans[ip] = now.Add(b.duration)
+	b.mu.Unlock()
+
+	b.logger.Warn("源 IP 被拒绝次数过多，临时封禁", "event", "ban", "client_ip", ip, "failures", len(times), "ban_window", b.window, "ban_duration", b.duration)
+	b.save()
+}
+
+// run 每隔 window 清理过期的封禁和计数,直到进程退出
+func (b *banList) run() {
+	ticker := time.NewTicker(b.window)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		expired := 0
+
+		b.mu.Lock()
+		for ip, until := range b.bans {
+			if !now.Before(until) {
+				delete(b.bans, ip)
+				delete(b.failures, ip)
+				expired++
+			}
+		}
+		for ip, times := range b.failures {
+			if times = pruneBefore(times, now.Add(-b.window)); len(times) == 0 {
+				delete(b.failures, ip)
+			} else {
+				b.failures[ip] = times
+			}
+		}
+		b.mu.Unlock()
+
+		if expired > 0 {
+			b.logger.Info("封禁到期，已解封", "event", "unban", "count", expired)
+			b.save()
+		}
+	}
+}
+
+// pruneBefore 去掉早于 cutoff 的时间
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(cutoff) })
+	return times[i:]
+}
+
+// load 读取持久化文件,每行 "IP 到期时间(RFC 3339)",文件不存在时视为空
+func (b *banList) load() error {
+	data, err := os.ReadFile(b.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip, expires, ok := strings.Cut(line, " ")
+		until, err := time.Parse(time.RFC3339, strings.TrimSpace(expires))
+		if !ok || err != nil {
+			return fmt.Errorf("%s 第 %d 行: 应为 \"IP 到期时间\" 格式", b.file, i+1)
+		}
+		if now.Before(until) {
+			b.bans[ip] = until
+		}
+	}
+	return nil
+}
+
+// save 把当前的封禁列表写入持久化文件,先写临时文件再改名,避免进程中途退出时留下半个文件
+func (b *banList) save() {
+	if b.file == "" {
+		return
+	}
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+
+	b.mu.Lock()
+	var sb strings.Builder
+	for ip, until := range b.bans {
+		fmt.Fprintf(&sb, "%s %s\n", ip, until.UTC().Format(time.RFC3339))
+	}
+	b.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.file), ".ban-*")
+	if err == nil {
+		_, err = tmp.WriteString(sb.String())
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), b.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		b.logger.Error("无法保存封禁列表", "event", "ban_error", "file", b.file, "error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// certStore 按 SNI 选择终止 TLS 使用的证书。证书从目录加载,每套证书是同名的 .crt 与 .key 文件
+// (如 example.com.crt、example.com.key),按证书中的 DNS SAN(没有时为 CN)建立索引,支持通配符证书。
+// 没有匹配的证书时使用 fallback(-cert/-key),fallback 也没有时不返回证书
+type certStore struct {
+	dir      string
+	fallback *tls.Certificate
+	logger   *slog.Logger
+	certs    atomic.Pointer[map[string]*tls.Certificate]
+}
+
+func newCertStore(dir string, fallback *tls.Certificate, logger *slog.Logger) (*certStore, error) {
+	store := &certStore{dir: dir, fallback: fallback, logger: logger}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reload 重新读取证书目录,任一证书加载失败时保留旧的证书
+func (c *certStore) reload() error {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.crt"))
+	if err != nil {
+		return err
+	}
+
+	certs := make(map[string]*tls.Certificate)
+	for _, certFile := range files {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("无法加载证书 %s: %w", certFile, err)
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("无法解析证书 %s: %w", certFile, err)
+			}
+		}
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if prev, ok := certs[name]; ok && prev != &cert {
+				c.logger.Warn("多个证书包含同一个域名，使用后加载的证书", "event", "cert_load", "name", name, "cert", certFile)
+			}
+			certs[name] = &cert
+		}
+		c.logger.Info("加载证书", "event", "cert_load", "cert", certFile, "names", names, "not_after", leaf.NotAfter)
+	}
+	if len(certs) == 0 {
+		if _, err := os.Stat(c.dir); err != nil {
+			return err
+		}
+		c.logger.Warn("证书目录中没有证书", "event", "cert_load", "dir", c.dir)
+	}
+	c.certs.Store(&certs)
+	return nil
+}
+
+// lookup 按 SNI 查找证书:先精确匹配,再匹配上一级的通配符证书(*.example.com 匹配 a.example.com),
+// 都没有时返回 fallback
+func (c *certStore) lookup(serverName string) *tls.Certificate {
+	certs := *c.certs.Load()
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := certs[name]; ok {
+		return cert
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := certs["*."+parent]; ok {
+			return cert
+		}
+	}
+	return c.fallback
+}
+
+// getCertificate 用作 tls.Config.GetCertificate
+func (c *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := c.lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("没有 %q 的证书", hello.ServerName)
+}
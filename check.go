@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkConfigs 静态校验合并后的配置,返回发现的全部问题,不监听端口也不连接后端。
+// admin 是指标、管理、pprof 等附属服务的监听地址,键为参数名
+func checkConfigs(cfgs []Config, admin map[string]string) []string {
+	var problems []string
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for name, addr := range admin {
+		if addr != "" {
+			if err := checkAddr(addr, true); err != nil {
+				report("-%s: %v", name, err)
+			}
+		}
+	}
+
+	for _, cfg := range cfgs {
+		src := cfg.ListenAddr
+		if err := checkAddr(src, true); err != nil {
+			report("[%s] -src: %v", src, err)
+		}
+		if cfg.TLSTerminate && cfg.TLSConfig == nil {
+			report("[%s] -tls-terminate: 需要同时指定 -cert 和 -key,或指定 -cert-dir", src)
+		}
+		switch cfg.Protocol {
+		case "", protocolAuto, protocolSMTP, protocolSOCKS5, protocolConnect:
+		default:
+			report("[%s] -protocol: 未知的协议 %q", src, cfg.Protocol)
+		}
+		switch cfg.LoadBalance {
+		case "", lbFailover, lbIPHash:
+		default:
+			report("[%s] -lb: 未知的负载均衡策略 %q", src, cfg.LoadBalance)
+		}
+
+		for _, ref := range backendRefs(cfg) {
+			if err := checkAddr(ref.addr, false); err != nil {
+				report("[%s] %s: %v", src, ref, err)
+			}
+		}
+
+		for name, routes := range map[string][]Route{"route": cfg.SNIRoutes, "route-file": cfg.FileRoutes, "bind-route": cfg.BindRoutes} {
+			for _, route := range routes {
+				if err := checkDomainPattern(route.Pattern); err != nil {
+					report("[%s] -%s: %v", src, name, err)
+				}
+			}
+		}
+		for name, patterns := range map[string][]string{"domain": cfg.AllowedDomains, "deny-domain": cfg.DeniedDomains} {
+			for _, pattern := range patterns {
+				if err := checkDomainPattern(pattern); err != nil {
+					report("[%s] -%s: %v", src, name, err)
+				}
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// checkBackends 在启动前校验所有后端地址的格式,并解析其中的主机名,返回发现的全部问题。
+// 经上游 SOCKS5 转发的 listener 由上游解析主机名,只校验格式。同一主机名只解析一次,每次解析限时 timeout
+func checkBackends(cfgs []Config, timeout time.Duration) []string {
+	var problems []string
+	resolved := make(map[string]error)
+	for _, cfg := range cfgs {
+		for _, ref := range backendRefs(cfg) {
+			if err := checkAddr(ref.addr, false); err != nil {
+				problems = append(problems, fmt.Sprintf("[%s] %s: %v", cfg.ListenAddr, ref, err))
+				continue
+			}
+			if strings.HasPrefix(ref.addr, "unix:") || cfg.UpstreamSOCKS != nil {
+				continue
+			}
+			host, _, _ := net.SplitHostPort(ref.addr)
+			if net.ParseIP(strings.SplitN(host, "%", 2)[0]) != nil {
+				continue
+			}
+			err, ok := resolved[host]
+			if !ok {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				_, err = net.DefaultResolver.LookupHost(ctx, host)
+				cancel()
+				resolved[host] = err
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("[%s] %s: 无法解析后端主机名 %q: %v", cfg.ListenAddr, ref, host, err))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// backendRef 是配置中的一个后端地址及其来源参数,路由类参数还带有匹配模式,用于在报错时指出具体是哪一项
+type backendRef struct {
+	param   string
+	pattern string
+	addr    string
+}
+
+func (r backendRef) String() string {
+	if r.pattern != "" {
+		return "-" + r.param + " " + r.pattern
+	}
+	return "-" + r.param
+}
+
+// backendRefs 列出 cfg 中的全部后端地址,包括各类路由的目标
+func backendRefs(cfg Config) []backendRef {
+	var refs []backendRef
+	for param, addrs := range map[string][]string{"dst": cfg.DestAddrs, "dst-http": cfg.PlainBackends, "dst-tls": cfg.TLSBackends} {
+		for _, addr := range addrs {
+			refs = append(refs, backendRef{param: param, addr: addr})
+		}
+	}
+	if cfg.DefaultDst != "" {
+		refs = append(refs, backendRef{param: "default-dst", addr: cfg.DefaultDst})
+	}
+	if cfg.UDPBackend != "" {
+		refs = append(refs, backendRef{param: "udp-dst", addr: cfg.UDPBackend})
+	}
+	for _, route := range cfg.SignatureRoutes {
+		refs = append(refs, backendRef{param: "sig-route", pattern: route.Spec, addr: route.Addr})
+	}
+	for param, routes := range map[string][]Route{"route": cfg.SNIRoutes, "route-file": cfg.FileRoutes, "alpn-route": cfg.ALPNRoutes} {
+		for _, route := range routes {
+			refs = append(refs, backendRef{param: param, pattern: route.Pattern, addr: route.Addr})
+		}
+	}
+	return refs
+}
+
+// checkAddr 校验 host:port 或 unix:/path 形式的地址。listen 为 true 时允许省略主机和使用端口 0
+func checkAddr(addr string, listen bool) error {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return fmt.Errorf("地址 %q 缺少 unix socket 路径", addr)
+		}
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("地址 %q 格式错误: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 || (port == 0 && !listen) {
+		return fmt.Errorf("地址 %q 的端口 %q 不在 1-65535 范围内", addr, portStr)
+	}
+	if host == "" {
+		if !listen {
+			return fmt.Errorf("地址 %q 缺少主机", addr)
+		}
+		return nil
+	}
+	if net.ParseIP(strings.SplitN(host, "%", 2)[0]) != nil {
+		return nil
+	}
+	if err := checkHostname(host, false); err != nil {
+		return fmt.Errorf("地址 %q: %w", addr, err)
+	}
+	return nil
+}
+
+// checkDomainPattern 校验域名模式:* 或合法的域名,标签中可以含有通配符 *,并确认能编译为正则
+func checkDomainPattern(pattern string) error {
+	if pattern == "*" || net.ParseIP(pattern) != nil {
+		return nil
+	}
+	normalized := normalizeDomain(pattern)
+	if err := checkHostname(normalized, true); err != nil {
+		return fmt.Errorf("域名模式 %q: %w", pattern, err)
+	}
+	if strings.Contains(normalized, "*") {
+		if _, err := compileDomainPattern(normalized); err != nil {
+			return fmt.Errorf("域名模式 %q 无法编译: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkHostname 检查主机名每个标签非空、不超过 63 字节且只含字母、数字、- 和 _,wildcard 为 true 时允许 *
+func checkHostname(host string, wildcard bool) error {
+	if len(host) > 253 {
+		return fmt.Errorf("主机名超过 253 字节")
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" {
+			return fmt.Errorf("主机名 %q 含有空标签", host)
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("主机名 %q 的标签 %q 超过 63 字节", host, label)
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			case c == '*' && wildcard:
+			default:
+				return fmt.Errorf("主机名 %q 含有非法字符 %q", host, c)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,441 @@
+// Package clienthello 解析 TLS ClientHello,取出 SNI、ALPN、支持的版本和计算 JA3 指纹所需的字段。
+// 解析只依赖字节,Read 在此之上负责从连接补读分片到达的记录
+package clienthello
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MaxSize 是累计读取的 ClientHello 记录字节数上限。正常的 ClientHello 即使带上
+// 后量子密钥交换也只有几 KB,限制总量避免恶意客户端用多条记录诱导大量内存分配
+const MaxSize = 64 * 1024
+
+var (
+	// ErrMalformed 表示收到了完整数据但格式非法,与读取失败、超时等 I/O 错误区分开
+	ErrMalformed = errors.New("ClientHello 畸形")
+
+	// ErrTruncated 表示数据还不够一条完整的 ClientHello
+	ErrTruncated = errors.New("ClientHello 数据被截断")
+	// ErrTooLarge 表示记录头或握手头声明的长度超过 MaxSize
+	ErrTooLarge = fmt.Errorf("%w: 超过 %d 字节上限", ErrMalformed, MaxSize)
+
+	// ErrBadExtensions 由 ExtensionError 包装,表示扩展列表的长度字段不自洽
+	ErrBadExtensions = errors.New("ClientHello 扩展结构非法")
+)
+
+// ExtensionError 描述扩展列表中长度字段不自洽的位置,Offset 是相对扩展列表开头的字节偏移。
+// 调用方可以用 errors.As 取出这些字段打印到日志,定位具体是哪个客户端的哪个扩展出了问题
+type ExtensionError struct {
+	Index     int    // 出错扩展的序号,从 0 开始
+	Type      uint16 // 扩展类型,扩展头本身不完整时为 0
+	Offset    int    // 扩展头的起始偏移
+	Length    int    // 扩展头声明的数据长度,扩展头不完整时为 -1
+	Remaining int    // 从 Offset 起扩展列表剩余的字节数
+	Detail    string // 扩展内部字段出错时的说明
+}
+
+func (e *ExtensionError) Error() string {
+	switch {
+	case e.Detail != "":
+		return fmt.Sprintf("%v: 偏移 %d 处的第 %d 个扩展(类型 %d): %s", ErrBadExtensions, e.Offset, e.Index, e.Type, e.Detail)
+	case e.Length < 0:
+		return fmt.Sprintf("%v: 偏移 %d 处只剩 %d 字节,不足一个扩展头", ErrBadExtensions, e.Offset, e.Remaining)
+	}
+	return fmt.Sprintf("%v: 偏移 %d 处的第 %d 个扩展(类型 %d)声明长度 %d,超出剩余的 %d 字节",
+		ErrBadExtensions, e.Offset, e.Index, e.Type, e.Length, e.Remaining-4)
+}
+
+func (e *ExtensionError) Unwrap() error { return ErrBadExtensions }
+
+// Info 在 tls.ClientHelloInfo 之外保留计算 JA3 指纹所需的字段
+type Info struct {
+	tls.ClientHelloInfo
+
+	Version    uint16   // ClientHello 中的 legacy_version
+	Extensions []uint16 // 按出现顺序排列的扩展类型,包含 GREASE
+}
+
+// MaxVersion 返回客户端声明支持的最高 TLS 版本。TLS 1.3 客户端的 legacy_version 固定为 TLS 1.2,
+// 真正的版本列表在 supported_versions 扩展里;没有该扩展的老客户端以 legacy_version 为准
+func (h *Info) MaxVersion() uint16 {
+	if len(h.SupportedVersions) == 0 {
+		return h.Version
+	}
+	var max uint16
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		return h.Version
+	}
+	return max
+}
+
+// JA3 按 JA3 规范拼接指纹字符串:版本,密码套件,扩展,supported_groups,ec_point_formats,
+// 各列表内用 - 分隔,GREASE 值剔除
+func (h *Info) JA3() string {
+	curves := make([]uint16, len(h.SupportedCurves))
+	for i, c := range h.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(h.SupportedPoints))
+	for i, p := range h.SupportedPoints {
+		points[i] = uint16(p)
+	}
+
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	for _, list := range [][]uint16{h.CipherSuites, h.Extensions, curves, points} {
+		b.WriteByte(',')
+		first := true
+		for _, v := range list {
+			if isGREASE(v) {
+				continue
+			}
+			if !first {
+				b.WriteByte('-')
+			}
+			first = false
+			b.WriteString(strconv.Itoa(int(v)))
+		}
+	}
+	return b.String()
+}
+
+// JA3Hash 返回 JA3 字符串的 MD5,即通常所说的 JA3 指纹
+func (h *Info) JA3Hash() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Read 从 conn 读取完整的 ClientHello 握手消息并解析。
+// initialData 是已经读到的首包(至少包含 5 字节记录头),返回值 fullHello 是读到的全部原始字节,需原样转发给后端。
+// 分片到达的 ClientHello 会一直读到记录完整为止,读超时由调用方通过 conn 的 deadline 控制。
+// 这里只负责按 recordScanner 给出的长度补读数据,解析交给 Parse
+func Read(conn net.Conn, initialData []byte) (*Info, []byte, error) {
+	fullHello := initialData
+	var scanner recordScanner
+	for {
+		need, err := scanner.scan(fullHello)
+		if err != nil {
+			return nil, nil, err
+		}
+		if need == 0 {
+			break
+		}
+		data, err := ReadAtLeast(conn, fullHello, need)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, nil, fmt.Errorf("未收到完整的 ClientHello (已收到 %d 字节): %w", len(fullHello), err)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		fullHello = data
+	}
+
+	hello, err := Parse(fullHello)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hello, fullHello, nil
+}
+
+// ReadAtLeast 从 conn 补读,直到 data 至少有 n 字节,data 已经足够时不再读取
+func ReadAtLeast(conn net.Conn, data []byte, n int) ([]byte, error) {
+	if len(data) >= n {
+		return data, nil
+	}
+	more := make([]byte, n-len(data))
+	if _, err := io.ReadFull(conn, more); err != nil {
+		return nil, err
+	}
+	return append(data, more...), nil
+}
+
+// ParseClientHello 从客户端发来的原始字节(以 TLS 记录头开头,可以跨多条记录)中解析出 SNI 和 ALPN,
+// 不依赖网络连接,数据不完整时返回 ErrTruncated
+func ParseClientHello(data []byte) (sni string, alpn []string, err error) {
+	hello, err := Parse(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return hello.ServerName, hello.SupportedProtos, nil
+}
+
+// Parse 拼接 data 中的握手记录并解析 ClientHello,格式错误都包装为 ErrMalformed
+func Parse(data []byte) (*Info, error) {
+	handshake, need, err := records(data)
+	if err != nil {
+		return nil, err
+	}
+	if need > 0 {
+		return nil, fmt.Errorf("%w: 需要 %d 字节,只有 %d 字节", ErrTruncated, need, len(data))
+	}
+	hello, err := parseClientHello(handshake)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return hello, nil
+}
+
+// records 逐条拆开 data 中的 TLS 握手记录并拼接握手数据,直到 ClientHello 消息完整。
+// ClientHello 可能跨多条记录,数据还不够时返回 need,即继续解析至少需要的总字节数
+func records(data []byte) (handshake []byte, need int, err error) {
+	var s recordScanner
+	if need, err = s.scan(data); err != nil || need > 0 {
+		return nil, need, err
+	}
+	return s.handshake(data), 0, nil
+}
+
+// recordScanner 记录已经核对过的记录边界,补读数据后从上次停下的位置继续,
+// 避免客户端用大量小记录让每次补读都从头扫描、复制已有数据
+type recordScanner struct {
+	pos    int     // 已核对的完整记录的总字节数
+	size   int     // 这些记录中握手数据的字节数
+	msgLen int     // 握手头声明的消息长度(含握手头),未知时为 0
+	header [4]byte // 握手头本身也可能跨记录
+}
+
+// scan 从上次的位置继续核对 data 中的记录,返回继续解析至少需要的总字节数,消息已完整时返回 0
+func (s *recordScanner) scan(data []byte) (need int, err error) {
+	for s.msgLen == 0 || s.size < s.msgLen {
+		if len(data) < s.pos+5 {
+			return s.pos + 5, nil
+		}
+		if data[s.pos] != 0x16 {
+			return 0, fmt.Errorf("%w: 不是 TLS 握手记录: 0x%02x", ErrMalformed, data[s.pos])
+		}
+		recordLen := int(binary.BigEndian.Uint16(data[s.pos+3 : s.pos+5]))
+		if s.pos+5+recordLen > MaxSize {
+			return 0, ErrTooLarge
+		}
+		if len(data) < s.pos+5+recordLen {
+			return s.pos + 5 + recordLen, nil
+		}
+		if s.size < 4 {
+			copy(s.header[s.size:], data[s.pos+5:s.pos+5+recordLen])
+		}
+		s.size += recordLen
+		s.pos += 5 + recordLen
+
+		if s.msgLen == 0 && s.size >= 4 {
+			s.msgLen = 4 + (int(s.header[1])<<16 | int(s.header[2])<<8 | int(s.header[3]))
+			// 握手头声明的长度超限时立即拒绝,不必等到读够数据
+			if s.msgLen > MaxSize {
+				return 0, ErrTooLarge
+			}
+		}
+	}
+	return 0, nil
+}
+
+// handshake 在 scan 返回 0 之后拼接各条记录中的握手数据,返回完整的握手消息
+func (s *recordScanner) handshake(data []byte) []byte {
+	msg := make([]byte, 0, s.size)
+	for p := 0; p < s.pos; {
+		recordLen := int(binary.BigEndian.Uint16(data[p+3 : p+5]))
+		msg = append(msg, data[p+5:p+5+recordLen]...)
+		p += 5 + recordLen
+	}
+	return msg[:s.msgLen]
+}
+
+// parseClientHello 解析完整的 ClientHello 握手消息(含 4 字节握手头)
+func parseClientHello(msg []byte) (*Info, error) {
+	hello := &Info{}
+
+	// 确保是 ClientHello 消息
+	if len(msg) < 4 || msg[0] != 1 {
+		return nil, fmt.Errorf("不是 ClientHello 消息")
+	}
+	body := msg[4:]
+
+	// 读取协议版本,跳过随机数
+	if len(body) < 34 {
+		return nil, ErrTruncated
+	}
+	hello.Version = binary.BigEndian.Uint16(body)
+	pos := 34
+
+	// 跳过 Session ID
+	if pos+1 > len(body) {
+		return nil, ErrTruncated
+	}
+	pos += 1 + int(body[pos])
+
+	// 读取密码套件
+	if pos+2 > len(body) {
+		return nil, ErrTruncated
+	}
+	suitesLen := int(binary.BigEndian.Uint16(body[pos:]))
+	pos += 2
+	if pos+suitesLen > len(body) {
+		return nil, ErrTruncated
+	}
+	hello.CipherSuites = parseUint16List(body[pos : pos+suitesLen])
+	pos += suitesLen
+
+	// 跳过压缩方法
+	if pos+1 > len(body) {
+		return nil, ErrTruncated
+	}
+	pos += 1 + int(body[pos])
+
+	// 没有扩展部分
+	if pos == len(body) {
+		return hello, nil
+	}
+
+	// 读取扩展部分
+	if pos+2 > len(body) {
+		return nil, ErrTruncated
+	}
+	extLen := int(binary.BigEndian.Uint16(body[pos:]))
+	pos += 2
+	if pos+extLen > len(body) {
+		return nil, ErrTruncated
+	}
+	extData := body[pos : pos+extLen]
+
+	// 解析扩展以查找 SNI、ALPN、supported_versions 以及 JA3 需要的 supported_groups 和 ec_point_formats。
+	// 扩展的顺序不固定(Chrome 每次握手都会打乱),其中还夹着 GREASE 和未知类型的扩展,
+	// 所以必须走完整个列表,每个扩展严格按自己的长度前缀跳过,不能假设 SNI 在前面
+	for rest := extData; len(rest) > 0; {
+		offset := len(extData) - len(rest)
+		et, data, next, ok := nextExtension(rest)
+		if !ok {
+			extErr := &ExtensionError{Index: len(hello.Extensions), Offset: offset, Length: -1, Remaining: len(rest)}
+			if len(rest) >= 4 {
+				extErr.Type, extErr.Length = et, int(binary.BigEndian.Uint16(rest[2:]))
+			}
+			return nil, extErr
+		}
+		rest = next
+		hello.Extensions = append(hello.Extensions, et)
+
+		switch et {
+		case 0: // Server Name Indication
+			name, err := parseServerName(data)
+			if err != nil {
+				return nil, &ExtensionError{Index: len(hello.Extensions) - 1, Type: et, Offset: offset, Length: len(data), Remaining: len(extData) - offset, Detail: err.Error()}
+			}
+			hello.ServerName = name
+		case 10: // supported_groups
+			if len(data) >= 2 {
+				for _, g := range parseUint16List(data[2:min(len(data), 2+int(binary.BigEndian.Uint16(data)))]) {
+					hello.SupportedCurves = append(hello.SupportedCurves, tls.CurveID(g))
+				}
+			}
+		case 11: // ec_point_formats
+			if len(data) >= 1 {
+				hello.SupportedPoints = append([]uint8(nil), data[1:min(len(data), 1+int(data[0]))]...)
+			}
+		case 16: // Application-Layer Protocol Negotiation
+			hello.SupportedProtos = parseALPN(data)
+		case 43: // supported_versions
+			if len(data) >= 1 {
+				hello.SupportedVersions = parseUint16List(data[1:min(len(data), 1+int(data[0]))])
+			}
+		}
+	}
+
+	return hello, nil
+}
+
+// nextExtension 从扩展列表开头取出一个扩展:2 字节类型、2 字节长度和长度指定的数据,
+// rest 是其后剩余的扩展。剩余字节不够一个扩展头或数据超出列表时返回 ok=false,
+// 此时 typ 仍是扩展头中的类型(扩展头完整时)
+func nextExtension(list []byte) (typ uint16, data, rest []byte, ok bool) {
+	if len(list) < 4 {
+		return 0, nil, nil, false
+	}
+	typ = binary.BigEndian.Uint16(list)
+	n := int(binary.BigEndian.Uint16(list[2:]))
+	if 4+n > len(list) {
+		return typ, nil, nil, false
+	}
+	return typ, list[4 : 4+n], list[4+n:], true
+}
+
+// parseUint16List 把大端序的 uint16 数组解析成切片,末尾不足 2 字节的部分忽略
+func parseUint16List(data []byte) []uint16 {
+	list := make([]uint16, 0, len(data)/2)
+	for i := 0; i+2 <= len(data); i += 2 {
+		list = append(list, binary.BigEndian.Uint16(data[i:]))
+	}
+	return list
+}
+
+// parseServerName 从 SNI 扩展数据中取出第一个 host_name。server_name_list 的长度必须正好填满扩展,
+// 列表中每一项的长度也不能越界,否则说明长度字段不自洽,返回错误而不是当作没有 SNI
+func parseServerName(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", fmt.Errorf("SNI 扩展只有 %d 字节,不足列表长度字段", len(data))
+	}
+	listLen := int(binary.BigEndian.Uint16(data))
+	if 2+listLen != len(data) {
+		return "", fmt.Errorf("server_name_list 声明长度 %d,与扩展剩余的 %d 字节不符", listLen, len(data)-2)
+	}
+	nameList := data[2:]
+
+	name := ""
+	for len(nameList) > 0 {
+		if len(nameList) < 3 {
+			return "", fmt.Errorf("server_name_list 末尾多出 %d 字节", len(nameList))
+		}
+		nameType := nameList[0]
+		nameLen := int(binary.BigEndian.Uint16(nameList[1:3]))
+		if 3+nameLen > len(nameList) {
+			return "", fmt.Errorf("server_name 声明长度 %d,超出剩余的 %d 字节", nameLen, len(nameList)-3)
+		}
+		if nameType == 0 && name == "" { // host_name
+			name = string(nameList[3 : 3+nameLen])
+		}
+		nameList = nameList[3+nameLen:]
+	}
+	return name, nil
+}
+
+// parseALPN 解析 ALPN 扩展中的协议列表,忽略 GREASE 占位协议
+func parseALPN(data []byte) []string {
+	if len(data) < 2 {
+		return nil
+	}
+	listLen := int(binary.BigEndian.Uint16(data))
+	if 2+listLen > len(data) {
+		return nil
+	}
+	list := data[2 : 2+listLen]
+
+	var protos []string
+	for len(list) >= 1 {
+		protoLen := int(list[0])
+		if protoLen == 0 || 1+protoLen > len(list) {
+			return protos
+		}
+		proto := list[1 : 1+protoLen]
+		if !(protoLen == 2 && isGREASE(binary.BigEndian.Uint16(proto))) {
+			protos = append(protos, string(proto))
+		}
+		list = list[1+protoLen:]
+	}
+	return protos
+}
+
+// isGREASE 判断是否为 RFC 8701 定义的 GREASE 值(0x0a0a、0x1a1a ... 0xfafa)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
@@ -0,0 +1,525 @@
+package clienthello
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// captureHello 让 crypto/tls 的客户端对着 net.Pipe 发起握手,返回它发出的第一条 TLS 记录,即完整的 ClientHello
+func captureHello(t *testing.T, cfg *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("读取记录头失败: %v", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("读取记录失败: %v", err)
+	}
+	return append(header, body...)
+}
+
+// extension 按 2 字节类型、2 字节长度加数据的格式编码一个扩展
+func extension(typ uint16, data []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func sniExtension(name string) []byte {
+	entry := append([]byte{0}, binary.BigEndian.AppendUint16(nil, uint16(len(name)))...)
+	entry = append(entry, name...)
+	return extension(0, append(binary.BigEndian.AppendUint16(nil, uint16(len(entry))), entry...))
+}
+
+func alpnExtension(protos ...string) []byte {
+	var list []byte
+	for _, p := range protos {
+		list = append(list, byte(len(p)))
+		list = append(list, p...)
+	}
+	return extension(16, append(binary.BigEndian.AppendUint16(nil, uint16(len(list))), list...))
+}
+
+// buildHello 手工拼出一条 TLS 1.2 格式的 ClientHello 记录。exts 为 nil 时连扩展列表的长度字段都不写,
+// 对应没有扩展的老客户端
+func buildHello(suites []uint16, exts [][]byte) []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session id
+	body = binary.BigEndian.AppendUint16(body, uint16(2*len(suites)))
+	for _, s := range suites {
+		body = binary.BigEndian.AppendUint16(body, s)
+	}
+	body = append(body, 1, 0) // compression: null
+	if exts != nil {
+		all := slices.Concat(exts...)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(all)))
+		body = append(body, all...)
+	}
+	return record(handshakeMessage(body))
+}
+
+// handshakeMessage 给 ClientHello 正文加上 4 字节握手头
+func handshakeMessage(body []byte) []byte {
+	n := len(body)
+	return append([]byte{1, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+// record 把握手数据装进一条 TLS 握手记录
+func record(fragment []byte) []byte {
+	b := []byte{0x16, 0x03, 0x01}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(fragment)))
+	return append(b, fragment...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	withSNI := captureHello(t, &tls.Config{ServerName: "example.com"})
+	withALPN := captureHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+	// ServerName 为空时 crypto/tls 不发送 SNI 扩展
+	noSNI := captureHello(t, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+
+	tests := []struct {
+		name    string
+		data    []byte
+		sni     string
+		alpn    []string
+		wantErr error
+	}{
+		{name: "正常 SNI", data: withSNI, sni: "example.com"},
+		{name: "ALPN", data: withALPN, sni: "example.com", alpn: []string{"h2", "http/1.1"}},
+		{name: "无 SNI", data: noSNI, alpn: []string{"http/1.1"}},
+		{name: "无扩展", data: buildHello([]uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}, nil)},
+		{
+			// GREASE 扩展排在 SNI 前面,ALPN 里也夹着 GREASE 占位协议
+			name: "GREASE",
+			data: buildHello([]uint16{0x3a3a, tls.TLS_AES_128_GCM_SHA256}, [][]byte{
+				extension(0x2a2a, nil),
+				extension(0xfafa, []byte{0}),
+				sniExtension("grease.example.com"),
+				alpnExtension("\x4a\x4a", "h2"),
+			}),
+			sni:  "grease.example.com",
+			alpn: []string{"h2"},
+		},
+		{name: "截断的记录", data: withSNI[:len(withSNI)-1], wantErr: ErrTruncated},
+		{name: "只有记录头", data: withSNI[:5], wantErr: ErrTruncated},
+		{name: "不是握手记录", data: append([]byte{0x17}, withSNI[1:]...), wantErr: ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sni, alpn, err := ParseClientHello(tt.data)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, 期望 %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if sni != tt.sni {
+				t.Errorf("sni = %q, 期望 %q", sni, tt.sni)
+			}
+			if !slices.Equal(alpn, tt.alpn) {
+				t.Errorf("alpn = %q, 期望 %q", alpn, tt.alpn)
+			}
+		})
+	}
+}
+
+func TestParseBadExtensions(t *testing.T) {
+	// 第二个扩展声明 100 字节数据,实际只剩 3 字节
+	bad := append(sniExtension("example.com"), 0x00, 0x10, 0x00, 0x64, 1, 2, 3)
+	_, err := Parse(buildHello([]uint16{tls.TLS_AES_128_GCM_SHA256}, [][]byte{bad}))
+	if !errors.Is(err, ErrMalformed) || !errors.Is(err, ErrBadExtensions) {
+		t.Fatalf("err = %v, 期望 ErrMalformed 与 ErrBadExtensions", err)
+	}
+	var extErr *ExtensionError
+	if !errors.As(err, &extErr) {
+		t.Fatalf("err = %v, 期望 *ExtensionError", err)
+	}
+	if extErr.Index != 1 || extErr.Type != 16 || extErr.Length != 100 {
+		t.Errorf("ExtensionError = %+v, 期望第 1 个扩展、类型 16、长度 100", extErr)
+	}
+}
+
+func TestInfoJA3(t *testing.T) {
+	data := buildHello([]uint16{0x0a0a, tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384}, [][]byte{
+		extension(0x1a1a, nil),
+		sniExtension("example.com"),
+		extension(10, []byte{0, 6, 0x2a, 0x2a, 0, 29, 0, 23}), // supported_groups: GREASE, x25519, secp256r1
+		extension(11, []byte{1, 0}),                           // ec_point_formats: uncompressed
+		extension(43, []byte{4, 0x03, 0x04, 0x03, 0x03}),      // supported_versions: 1.3, 1.2
+	})
+	hello, err := Parse(data)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if want := "771,4865-4866,0-10-11-43,29-23,0"; hello.JA3() != want {
+		t.Errorf("JA3 = %q, 期望 %q", hello.JA3(), want)
+	}
+	if hello.MaxVersion() != tls.VersionTLS13 {
+		t.Errorf("MaxVersion = %x, 期望 TLS 1.3", hello.MaxVersion())
+	}
+}
+
+// loadFixture 读取 testdata 下的真实 ClientHello,只有握手消息的样本(来自 QUIC)补上 TLS 记录头
+func loadFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] == 1 {
+		data = record(data)
+	}
+	return data
+}
+
+func TestParseBrowserHellos(t *testing.T) {
+	tests := []struct {
+		file    string
+		sni     string
+		alpn    []string
+		ja3     string
+		ja3Hash string
+	}{
+		{
+			// 扩展顺序被打乱,SNI 排在第 9 个
+			file:    "chrome124_quic.bin",
+			sni:     "encrypted-tbn0.gstatic.com",
+			alpn:    []string{"h3"},
+			ja3:     "771,4865-4866-4867,45-43-27-13-17513-51-57-16-0-10-65037,25497-29-23-24,",
+			ja3Hash: "1f368401cfe2cb7a2130453cfc7af494",
+		},
+		{
+			file:    "firefox126.bin",
+			sni:     "client.tlsfingerprint.io",
+			alpn:    []string{"h2", "http/1.1"},
+			ja3:     "771,4865-4867-4866-49195-49199-52393-52392-49196-49200-49162-49161-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-34-51-43-13-45-28-65037,29-23-24-25-256-257,0",
+			ja3Hash: "b5001237acdf006056b409cc433726b0",
+		},
+		{
+			// 第一个扩展就是 GREASE,JA3 中的 GREASE 值都被剔除
+			file:    "chromium_grease.bin",
+			sni:     "edgeapi.slack.com",
+			alpn:    []string{"h2", "http/1.1"},
+			ja3:     "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-41,29-23-24,0",
+			ja3Hash: "44d502d471cfdb99c59bdfb0f220e5a8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			hello, err := Parse(loadFixture(t, tt.file))
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if hello.ServerName != tt.sni {
+				t.Errorf("sni = %q, 期望 %q", hello.ServerName, tt.sni)
+			}
+			if !slices.Equal(hello.SupportedProtos, tt.alpn) {
+				t.Errorf("alpn = %q, 期望 %q", hello.SupportedProtos, tt.alpn)
+			}
+			if hello.JA3() != tt.ja3 {
+				t.Errorf("JA3 = %q, 期望 %q", hello.JA3(), tt.ja3)
+			}
+			if hello.JA3Hash() != tt.ja3Hash {
+				t.Errorf("JA3Hash = %s, 期望 %s", hello.JA3Hash(), tt.ja3Hash)
+			}
+			if hello.MaxVersion() != tls.VersionTLS13 {
+				t.Errorf("MaxVersion = %x, 期望 TLS 1.3", hello.MaxVersion())
+			}
+		})
+	}
+}
+
+// shuffleExtensions 像 Chrome 那样随机打乱 ClientHello 记录中扩展的顺序,返回新的记录
+func shuffleExtensions(t *testing.T, data []byte, rng *rand.Rand) []byte {
+	t.Helper()
+	msg := data[5:]
+	body := msg[4:]
+	pos := 34
+	pos += 1 + int(body[pos])
+	pos += 2 + int(binary.BigEndian.Uint16(body[pos:]))
+	pos += 1 + int(body[pos])
+	extData := body[pos+2:]
+
+	var exts [][]byte
+	for rest := extData; len(rest) > 0; {
+		typ, ext, next, ok := nextExtension(rest)
+		if !ok {
+			t.Fatalf("样本的扩展列表非法")
+		}
+		exts = append(exts, extension(typ, ext))
+		rest = next
+	}
+	rng.Shuffle(len(exts), func(i, j int) { exts[i], exts[j] = exts[j], exts[i] })
+
+	out := append([]byte(nil), body[:pos+2]...)
+	return record(handshakeMessage(append(out, slices.Concat(exts...)...)))
+}
+
+func TestParseShuffledExtensions(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, file := range []string{"chrome124_quic.bin", "firefox126.bin", "chromium_grease.bin"} {
+		data := loadFixture(t, file)
+		want, err := Parse(data)
+		if err != nil {
+			t.Fatalf("%s: 解析失败: %v", file, err)
+		}
+		for i := range 20 {
+			hello, err := Parse(shuffleExtensions(t, data, rng))
+			if err != nil {
+				t.Fatalf("%s 第 %d 次打乱后解析失败: %v", file, i, err)
+			}
+			if hello.ServerName != want.ServerName || !slices.Equal(hello.SupportedProtos, want.SupportedProtos) {
+				t.Fatalf("%s 第 %d 次打乱后 sni = %q, alpn = %q, 期望 %q, %q", file, i,
+					hello.ServerName, hello.SupportedProtos, want.ServerName, want.SupportedProtos)
+			}
+			if !slices.Equal(slices.Sorted(slices.Values(hello.Extensions)), slices.Sorted(slices.Values(want.Extensions))) {
+				t.Fatalf("%s 第 %d 次打乱后扩展集合变了: %v", file, i, hello.Extensions)
+			}
+		}
+	}
+}
+
+// splitRecords 把 ClientHello 记录里的握手消息重新拆成每条最多 size 字节的多条记录
+func splitRecords(data []byte, size int) []byte {
+	var out []byte
+	for msg := data[5:]; len(msg) > 0; {
+		n := min(size, len(msg))
+		out = append(out, record(msg[:n])...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+// padHello 在单条记录的 ClientHello 末尾加上 padding 扩展,让握手消息正好是 size 字节
+func padHello(t *testing.T, data []byte, size int) []byte {
+	t.Helper()
+	msg := data[5:]
+	pad := size - len(msg) - 4
+	if pad < 0 {
+		t.Fatalf("ClientHello 已有 %d 字节,无法填充到 %d 字节", len(msg), size)
+	}
+	body := append([]byte(nil), msg[4:]...)
+	pos := 34
+	pos += 1 + int(body[pos])
+	pos += 2 + int(binary.BigEndian.Uint16(body[pos:]))
+	pos += 1 + int(body[pos])
+	binary.BigEndian.PutUint16(body[pos:], binary.BigEndian.Uint16(body[pos:])+uint16(4+pad))
+	body = append(body, extension(21, make([]byte, pad))...)
+	return record(handshakeMessage(body))
+}
+
+func TestParseSplitRecords(t *testing.T) {
+	chrome := loadFixture(t, "chrome124_quic.bin")
+	// crypto/tls 默认带 X25519MLKEM768 密钥交换,填充到 4096 字节模拟携带多个后量子密钥的 ClientHello
+	pq := padHello(t, captureHello(t, &tls.Config{ServerName: "pq.example.com", CurvePreferences: []tls.CurveID{tls.X25519MLKEM768}}), 4096)
+	if len(pq) != 5+4096 {
+		t.Fatalf("填充后的 ClientHello 有 %d 字节", len(pq)-5)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		size int
+		sni  string
+	}{
+		{name: "Chrome 按 MSS 拆成两条记录", data: chrome, size: 1460, sni: "encrypted-tbn0.gstatic.com"},
+		{name: "Chrome 拆成 512 字节的记录", data: chrome, size: 512, sni: "encrypted-tbn0.gstatic.com"},
+		{name: "Chrome 每条记录 1 字节", data: chrome, size: 1, sni: "encrypted-tbn0.gstatic.com"},
+		{name: "4096 字节的后量子 ClientHello", data: pq, size: 1460, sni: "pq.example.com"},
+		{name: "4096 字节的后量子 ClientHello 整条记录", data: pq, size: 16384, sni: "pq.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := splitRecords(tt.data, tt.size)
+			sni, _, err := ParseClientHello(data)
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if sni != tt.sni {
+				t.Errorf("sni = %q, 期望 %q", sni, tt.sni)
+			}
+
+			// 缺最后一个字节时还不完整,不能当作畸形
+			if _, _, err := ParseClientHello(data[:len(data)-1]); !errors.Is(err, ErrTruncated) {
+				t.Errorf("缺一个字节时 err = %v, 期望 ErrTruncated", err)
+			}
+
+			// 经由连接读取时 Read 要按记录头补读所有记录,返回的原始字节与客户端发送的完全一致
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				for rest := data; len(rest) > 0; {
+					n := min(1460, len(rest))
+					if _, err := client.Write(rest[:n]); err != nil {
+						return
+					}
+					rest = rest[n:]
+				}
+			}()
+			server.SetDeadline(time.Now().Add(5 * time.Second))
+			initial := make([]byte, 5)
+			if _, err := io.ReadFull(server, initial); err != nil {
+				t.Fatal(err)
+			}
+			hello, full, err := Read(server, initial)
+			if err != nil {
+				t.Fatalf("Read 失败: %v", err)
+			}
+			if hello.ServerName != tt.sni || !slices.Equal(full, data) {
+				t.Errorf("Read 返回 sni = %q, %d 字节, 期望 %q, %d 字节", hello.ServerName, len(full), tt.sni, len(data))
+			}
+		})
+	}
+}
+
+func TestReadSlowFragments(t *testing.T) {
+	data := splitRecords(loadFixture(t, "firefox126.bin"), 200)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+
+	type result struct {
+		hello *Info
+		full  []byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		initial := make([]byte, 5)
+		if _, err := io.ReadFull(server, initial); err != nil {
+			done <- result{err: err}
+			return
+		}
+		hello, full, err := Read(server, initial)
+		done <- result{hello, full, err}
+	}()
+
+	// 除最后一个字节外每次只写 7 字节,每段之间停顿,模拟慢速客户端
+	for rest := data[:len(data)-1]; len(rest) > 0; {
+		n := min(7, len(rest))
+		if _, err := client.Write(rest[:n]); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		rest = rest[n:]
+		time.Sleep(time.Millisecond)
+	}
+
+	// 记录还差一个字节,Read 必须继续等待,不能因为读到的数据不完整就返回
+	select {
+	case r := <-done:
+		t.Fatalf("数据不完整时 Read 提前返回: err = %v", r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := client.Write(data[len(data)-1:]); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("Read 失败: %v", r.err)
+	}
+	if r.hello.ServerName != "client.tlsfingerprint.io" || !slices.Equal(r.full, data) {
+		t.Errorf("Read 返回 sni = %q, %d 字节, 期望 client.tlsfingerprint.io, %d 字节", r.hello.ServerName, len(r.full), len(data))
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	data := loadFixture(t, "firefox126.bin")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 客户端只发一半就停下,超时后返回的错误要能和畸形 ClientHello 区分开
+	go client.Write(data[:len(data)/2])
+	initial := make([]byte, 5)
+	if _, err := io.ReadFull(server, initial); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := Read(server, initial)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, 期望 os.ErrDeadlineExceeded", err)
+	}
+	if errors.Is(err, ErrMalformed) {
+		t.Errorf("超时被当成了畸形 ClientHello: %v", err)
+	}
+}
+
+func TestOversizedLengths(t *testing.T) {
+	// 20000 字节的握手消息拆成每条 1 字节的记录,累计 12 万字节,超过 MaxSize
+	manyRecords := splitRecords(record(handshakeMessage(make([]byte, 20000-4))), 1)
+
+	// 握手头声明的长度为 MaxSize-3,加上 4 字节握手头比上限多 1 字节
+	n := MaxSize - 3
+	justOver := record([]byte{1, byte(n >> 16), byte(n >> 8), byte(n)})
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "记录头声明 65535 字节", data: []byte{0x16, 0x03, 0x01, 0xff, 0xff}},
+		{name: "握手头声明 16 MB", data: record([]byte{1, 0xff, 0xff, 0xff})},
+		{name: "握手头声明刚好超过上限", data: justOver},
+		{name: "大量小记录累计超过上限", data: manyRecords},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.data); !errors.Is(err, ErrTooLarge) || !errors.Is(err, ErrMalformed) {
+				t.Fatalf("err = %v, 期望 ErrTooLarge", err)
+			}
+
+			// 只发出这些字节后客户端停住不动,Read 必须立即拒绝,而不是按声明的长度继续等待数据
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go client.Write(tt.data)
+			server.SetReadDeadline(time.Now().Add(2 * time.Second))
+			initial := make([]byte, 5)
+			if _, err := io.ReadFull(server, initial); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := Read(server, initial); !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("Read err = %v, 期望 ErrTooLarge", err)
+			}
+		})
+	}
+
+	// 只看长度字段就拒绝,不按声明的长度分配内存
+	for _, tt := range tests[:3] {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		const runs = 100
+		for range runs {
+			Parse(tt.data)
+		}
+		runtime.ReadMemStats(&after)
+		if perRun := (after.TotalAlloc - before.TotalAlloc) / runs; perRun > 1024 {
+			t.Errorf("%s: 每次解析分配 %d 字节", tt.name, perRun)
+		}
+	}
+}
@@ -0,0 +1,783 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileConfig 是 -config 指定的配置文件(YAML、TOML 或 JSON)的结构,键名与同名命令行参数一致,
+// 列表类配置项写成列表,等价于命令行里用逗号分隔
+type fileConfig struct {
+	Src      []string `yaml:"src"`
+	Dst      []string `yaml:"dst"`
+	DstHTTP  []string `yaml:"dst-http"`
+	DstTLS   []string `yaml:"dst-tls"`
+	CIDR     []string `yaml:"cidr"`
+	DenyCIDR []string `yaml:"deny-cidr"`
+	Domain   []string `yaml:"domain"`
+
+	DomainFile string   `yaml:"domain-file"`
+	DenyDomain []string `yaml:"deny-domain"`
+
+	DrainTimeout time.Duration `yaml:"drain-timeout"`
+	IdleTimeout  time.Duration `yaml:"idle-timeout"`
+	DialTimeout  time.Duration `yaml:"dial-timeout"`
+
+	HalfCloseTimeout time.Duration `yaml:"half-close-timeout"`
+
+	MaxConnLifetime time.Duration `yaml:"max-conn-lifetime"`
+	AllowHours      string        `yaml:"allow-hours"`
+	AllowHoursClose bool          `yaml:"allow-hours-close"`
+	TZ              string        `yaml:"tz"`
+
+	HandshakeTimeout time.Duration `yaml:"handshake-timeout"`
+	MaxHeaderBytes   int           `yaml:"max-header-bytes"`
+	KeepAlive        time.Duration `yaml:"keepalive"`
+	NoDelay          bool          `yaml:"nodelay"`
+	ReusePort        bool          `yaml:"reuseport"`
+
+	MaxConns      int     `yaml:"max-conns"`
+	MaxConnsPerIP int     `yaml:"max-conns-per-ip"`
+	Workers       int     `yaml:"workers"`
+	WorkerQueue   int     `yaml:"worker-queue"`
+	RatePerIP     float64 `yaml:"rate-per-ip"`
+	RateLimit     string  `yaml:"rate-limit"`
+	BufferSize    int     `yaml:"buffer-size"`
+
+	DNSTTL time.Duration `yaml:"dns-ttl"`
+
+	HealthInterval time.Duration `yaml:"health-interval"`
+	HealthFails    int           `yaml:"health-fails"`
+	HealthTLS      bool          `yaml:"health-tls"`
+	LB             string        `yaml:"lb"`
+	LBHashSNI      bool          `yaml:"lb-hash-sni"`
+
+	AllowNoSNI          bool     `yaml:"allow-no-sni"`
+	RequireSNI          bool     `yaml:"require-sni"`
+	MinTLSVersion       string   `yaml:"min-tls-version"`
+	Transparent         bool     `yaml:"transparent"`
+	Protocol            string   `yaml:"protocol"`
+	SendProxy           bool     `yaml:"send-proxy"`
+	AcceptProxy         bool     `yaml:"accept-proxy"`
+	ProxyFrom           []string `yaml:"proxy-from"`
+	Route               []string `yaml:"route"`
+	RouteFile           string   `yaml:"route-file"`
+	ALPNRoute           []string `yaml:"alpn-route"`
+	SigRoute            []string `yaml:"sig-route"`
+	DefaultDst          string   `yaml:"default-dst"`
+	DefaultDstAnyDomain bool     `yaml:"default-dst-any-domain"`
+	JA3Allow            string   `yaml:"ja3-allow"`
+	JA3Deny             string   `yaml:"ja3-deny"`
+	DenyBody            string   `yaml:"deny-body"`
+	RewriteHost         string   `yaml:"rewrite-host"`
+	XFF                 bool     `yaml:"xff"`
+	StrictHTTP          bool     `yaml:"strict-http"`
+	AllowPath           []string `yaml:"allow-path"`
+	AllowMethod         []string `yaml:"allow-method"`
+	TLSTerminate        bool     `yaml:"tls-terminate"`
+	Cert                string   `yaml:"cert"`
+	Key                 string   `yaml:"key"`
+	CertDir             string   `yaml:"cert-dir"`
+	BackendTLS          bool     `yaml:"backend-tls"`
+	BackendCert         string   `yaml:"backend-cert"`
+	BackendKey          string   `yaml:"backend-key"`
+	BackendCA           string   `yaml:"backend-ca"`
+	BackendServerName   string   `yaml:"backend-server-name"`
+
+	SOCKSAuth     []string `yaml:"socks-auth"`
+	UpstreamSOCKS string   `yaml:"upstream-socks"`
+	BindIP        string   `yaml:"bind-ip"`
+	BindRoute     []string `yaml:"bind-route"`
+
+	UDP            bool          `yaml:"udp"`
+	UDPDst         string        `yaml:"udp-dst"`
+	UDPIdleTimeout time.Duration `yaml:"udp-idle-timeout"`
+
+	BanThreshold int           `yaml:"ban-threshold"`
+	BanWindow    time.Duration `yaml:"ban-window"`
+	BanDuration  time.Duration `yaml:"ban-duration"`
+	BanFile      string        `yaml:"ban-file"`
+
+	MetricsAddr    string        `yaml:"metrics-addr"`
+	StatsdAddr     string        `yaml:"statsd-addr"`
+	StatsdPrefix   string        `yaml:"statsd-prefix"`
+	StatsdInterval time.Duration `yaml:"statsd-interval"`
+	PprofAddr      string        `yaml:"pprof-addr"`
+	Systemd        bool          `yaml:"systemd"`
+	RDNS           bool          `yaml:"rdns"`
+	AdminAddr      string        `yaml:"admin-addr"`
+	AdminToken     string        `yaml:"admin-token"`
+	WebhookURL     string        `yaml:"webhook-url"`
+	OtelEndpoint   string        `yaml:"otel-endpoint"`
+	AccessLog      string        `yaml:"access-log"`
+	LogFormat      string        `yaml:"log-format"`
+	LogLevel       string        `yaml:"log-level"`
+
+	LogFile       string `yaml:"log-file"`
+	LogMaxSize    int    `yaml:"log-max-size"`
+	LogMaxBackups int    `yaml:"log-max-backups"`
+
+	// Listeners 定义多个独立的监听端口,每个都可以覆盖 listenerKeys 中的配置项,
+	// 未覆盖的沿用顶层配置;设置后顶层的 src 不再使用
+	Listeners []*fileConfig `yaml:"listeners"`
+
+	present map[string]bool // 文件中实际出现的配置项
+}
+
+// listenerKeys 是 listeners 中每一项允许出现的配置项
+var listenerKeys = map[string]bool{
+	"src": true, "dst": true, "dst-http": true, "dst-tls": true,
+	"cidr": true, "deny-cidr": true, "domain": true, "domain-file": true, "deny-domain": true,
+	"route": true, "route-file": true, "alpn-route": true, "sig-route": true, "default-dst": true, "default-dst-any-domain": true,
+	"protocol": true, "mode": true, "send-proxy": true, "accept-proxy": true, "proxy-from": true, "udp": true, "udp-dst": true, "rewrite-host": true, "xff": true, "strict-http": true, "allow-path": true, "allow-method": true, "tls-terminate": true,
+	"backend-tls": true, "lb": true, "lb-hash-sni": true,
+}
+
+// loadConfigFile 读取并校验配置文件,按后缀选择格式:.toml 为 TOML,.json 为 JSON,其余按 YAML 解析。
+// 三种格式解析成同样的结构后走同一套映射与校验
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	parse := parseYAML
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		parse = parseTOML
+	case ".json":
+		parse = parseJSONConfig
+	}
+	tree, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	m, ok := tree.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: 顶层必须是映射", path)
+	}
+
+	cfg := &fileConfig{present: make(map[string]bool)}
+	if err := cfg.decode(m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// parseJSONConfig 解析 JSON 配置文件,并把数字、布尔值和 null 转成字符串,与 parseYAML 的结果形状一致
+func parseJSONConfig(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tree any
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("JSON 之后有多余的内容")
+	}
+	return jsonScalarsToStrings(tree), nil
+}
+
+func jsonScalarsToStrings(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = jsonScalarsToStrings(item)
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = jsonScalarsToStrings(item)
+		}
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	return v
+}
+
+// decode 按 yaml 标签把解析结果填入结构体,未知的键视为错误
+func (c *fileConfig) decode(m map[string]any) error {
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if tag := v.Type().Field(i).Tag.Get("yaml"); tag != "" {
+			fields[tag] = v.Field(i)
+		}
+	}
+
+	// mode 是 protocol 的别名,与 -mode 一样,两者同时出现时取值必须相同
+	if mode, ok := m["mode"]; ok {
+		if protocol, ok := m["protocol"]; ok && fmt.Sprint(protocol) != fmt.Sprint(mode) {
+			return fmt.Errorf("配置项 mode %v 与 protocol %v 不一致", mode, protocol)
+		}
+		delete(m, "mode")
+		m["protocol"] = mode
+	}
+
+	for key, raw := range m {
+		if key == "listeners" {
+			if err := c.decodeListeners(raw); err != nil {
+				return err
+			}
+			c.present[key] = true
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("未知的配置项: %s", key)
+		}
+		if err := setConfigField(field, raw); err != nil {
+			return fmt.Errorf("配置项 %s: %w", key, err)
+		}
+		c.present[key] = true
+	}
+	return nil
+}
+
+func (c *fileConfig) decodeListeners(raw any) error {
+	list, ok := raw.([]any)
+	if !ok {
+		return fmt.Errorf("配置项 listeners: 应为列表")
+	}
+	for i, item := range list {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return fmt.Errorf("listeners[%d]: 应为映射", i)
+		}
+		for key := range m {
+			if !listenerKeys[key] {
+				return fmt.Errorf("listeners[%d]: 不支持的配置项 %s", i, key)
+			}
+		}
+		if _, ok := m["src"]; !ok {
+			return fmt.Errorf("listeners[%d]: 缺少 src", i)
+		}
+
+		l := &fileConfig{present: make(map[string]bool)}
+		if err := l.decode(m); err != nil {
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		if len(l.Src) != 1 {
+			return fmt.Errorf("listeners[%d]: src 只能是一个地址", i)
+		}
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		c.Listeners = append(c.Listeners, l)
+	}
+	return nil
+}
+
+func setConfigField(field reflect.Value, raw any) error {
+	if field.Kind() == reflect.Slice {
+		switch raw := raw.(type) {
+		case []any:
+			list := make([]string, 0, len(raw))
+			for _, item := range raw {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("列表元素必须是字符串")
+				}
+				list = append(list, s)
+			}
+			field.Set(reflect.ValueOf(list))
+		case string:
+			// 也允许写成逗号分隔的单个字符串
+			field.Set(reflect.ValueOf(splitList(raw)))
+		default:
+			return fmt.Errorf("应为列表")
+		}
+		return nil
+	}
+
+	s, ok := raw.(string)
+	if !ok {
+		return fmt.Errorf("应为单个值")
+	}
+	switch field.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("无效的时长 %q", s)
+		}
+		field.SetInt(int64(d))
+	case string:
+		field.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("无效的整数 %q", s)
+		}
+		field.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("无效的数字 %q", s)
+		}
+		field.SetFloat(f)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("无效的布尔值 %q", s)
+		}
+		field.SetBool(b)
+	}
+	return nil
+}
+
+// validate 检查地址、端口、CIDR 与数值范围
+func (c *fileConfig) validate() error {
+	for _, src := range c.Src {
+		if strings.HasPrefix(src, "unix:") {
+			continue
+		}
+		if err := validateHostPort(src); err != nil {
+			return fmt.Errorf("配置项 src: %w", err)
+		}
+	}
+	for key, addrs := range map[string][]string{"dst": c.Dst, "dst-http": c.DstHTTP, "dst-tls": c.DstTLS} {
+		for _, addr := range addrs {
+			if err := validateBackendAddr(addr); err != nil {
+				return fmt.Errorf("配置项 %s: %w", key, err)
+			}
+		}
+	}
+	if c.DefaultDst != "" {
+		if err := validateBackendAddr(c.DefaultDst); err != nil {
+			return fmt.Errorf("配置项 default-dst: %w", err)
+		}
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("配置项 webhook-url: 无效的 URL %q", c.WebhookURL)
+		}
+	}
+	if c.OtelEndpoint != "" {
+		if u, err := url.Parse(c.OtelEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("配置项 otel-endpoint: 无效的 URL %q", c.OtelEndpoint)
+		}
+	}
+	for key, addr := range map[string]string{"metrics-addr": c.MetricsAddr, "pprof-addr": c.PprofAddr, "statsd-addr": c.StatsdAddr} {
+		if addr == "" {
+			continue
+		}
+		if err := validateHostPort(addr); err != nil {
+			return fmt.Errorf("配置项 %s: %w", key, err)
+		}
+	}
+
+	for key, cidrs := range map[string][]string{"cidr": c.CIDR, "deny-cidr": c.DenyCIDR, "proxy-from": c.ProxyFrom} {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("配置项 %s: 无效的 CIDR %q", key, cidr)
+			}
+		}
+	}
+	for key, routes := range map[string][]string{"route": c.Route, "alpn-route": c.ALPNRoute} {
+		parsed, err := parseRoutes(strings.Join(routes, ","))
+		if err != nil {
+			return fmt.Errorf("配置项 %s: %w", key, err)
+		}
+		for _, route := range parsed {
+			if err := validateBackendAddr(route.Addr); err != nil {
+				return fmt.Errorf("配置项 %s: %w", key, err)
+			}
+		}
+	}
+	sigRoutes, err := parseSignatureRoutes(strings.Join(c.SigRoute, ","))
+	if err != nil {
+		return fmt.Errorf("配置项 sig-route: %w", err)
+	}
+	for _, route := range sigRoutes {
+		if err := validateBackendAddr(route.Addr); err != nil {
+			return fmt.Errorf("配置项 sig-route: %w", err)
+		}
+	}
+
+	for key, d := range map[string]time.Duration{
+		"drain-timeout":      c.DrainTimeout,
+		"idle-timeout":       c.IdleTimeout,
+		"half-close-timeout": c.HalfCloseTimeout,
+		"max-conn-lifetime":  c.MaxConnLifetime,
+		"dial-timeout":       c.DialTimeout,
+		"handshake-timeout":  c.HandshakeTimeout,
+		"health-interval":    c.HealthInterval,
+		"dns-ttl":            c.DNSTTL,
+		"keepalive":          c.KeepAlive,
+		"ban-window":         c.BanWindow,
+		"ban-duration":       c.BanDuration,
+		"udp-idle-timeout":   c.UDPIdleTimeout,
+		"statsd-interval":    c.StatsdInterval,
+	} {
+		if d < 0 {
+			return fmt.Errorf("配置项 %s: 不能为负数", key)
+		}
+	}
+	if c.MaxConns < 0 {
+		return fmt.Errorf("配置项 max-conns: 不能为负数")
+	}
+	if c.MaxConnsPerIP < 0 {
+		return fmt.Errorf("配置项 max-conns-per-ip: 不能为负数")
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("配置项 workers: 不能为负数")
+	}
+	if c.WorkerQueue < 0 {
+		return fmt.Errorf("配置项 worker-queue: 不能为负数")
+	}
+	if c.LogMaxSize < 0 || c.LogMaxBackups < 0 {
+		return fmt.Errorf("配置项 log-max-size、log-max-backups: 不能为负数")
+	}
+	if c.BanThreshold < 0 {
+		return fmt.Errorf("配置项 ban-threshold: 不能为负数")
+	}
+	if c.MaxHeaderBytes < 0 {
+		return fmt.Errorf("配置项 max-header-bytes: 不能为负数")
+	}
+	if c.RatePerIP < 0 {
+		return fmt.Errorf("配置项 rate-per-ip: 不能为负数")
+	}
+	if c.present["buffer-size"] && c.BufferSize <= 0 {
+		return fmt.Errorf("配置项 buffer-size: 必须大于 0")
+	}
+	if c.present["health-fails"] && c.HealthFails < 1 {
+		return fmt.Errorf("配置项 health-fails: 至少为 1")
+	}
+	if c.RateLimit != "" {
+		if _, err := parseByteSize(c.RateLimit); err != nil {
+			return fmt.Errorf("配置项 rate-limit: %w", err)
+		}
+	}
+	if c.present["lb"] && c.LB != lbFailover && c.LB != lbIPHash {
+		return fmt.Errorf("配置项 lb: 未知的负载均衡策略 %q", c.LB)
+	}
+	if c.present["protocol"] && c.Protocol != protocolAuto && c.Protocol != protocolSMTP && c.Protocol != protocolSOCKS5 && c.Protocol != protocolConnect {
+		return fmt.Errorf("配置项 protocol: 未知的协议 %q", c.Protocol)
+	}
+	if _, err := parseSOCKSUsers(strings.Join(c.SOCKSAuth, ",")); err != nil {
+		return fmt.Errorf("配置项 socks-auth: %w", err)
+	}
+	if c.BindIP != "" && net.ParseIP(c.BindIP) == nil {
+		return fmt.Errorf("配置项 bind-ip: 无效的 IP %q", c.BindIP)
+	}
+	bindRoutes, err := parseRoutes(strings.Join(c.BindRoute, ","))
+	if err != nil {
+		return fmt.Errorf("配置项 bind-route: %w", err)
+	}
+	for _, route := range bindRoutes {
+		if net.ParseIP(route.Addr) == nil {
+			return fmt.Errorf("配置项 bind-route: %s 的出口 IP %q 无效", route.Pattern, route.Addr)
+		}
+	}
+	if c.MinTLSVersion != "" {
+		if _, err := parseTLSVersion(c.MinTLSVersion); err != nil {
+			return fmt.Errorf("配置项 min-tls-version: %w", err)
+		}
+	}
+	if c.AllowHours != "" {
+		if _, err := parseTimeWindows(c.AllowHours, c.TZ); err != nil {
+			return fmt.Errorf("配置项 allow-hours: %w", err)
+		}
+	}
+	if c.UpstreamSOCKS != "" {
+		if _, err := parseSOCKSUpstream(c.UpstreamSOCKS); err != nil {
+			return fmt.Errorf("配置项 upstream-socks: %w", err)
+		}
+	}
+	if c.AllowNoSNI && c.RequireSNI {
+		return fmt.Errorf("配置项 allow-no-sni 和 require-sni 不能同时开启")
+	}
+	if c.present["log-format"] && c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("配置项 log-format: 未知的日志格式 %q", c.LogFormat)
+	}
+	if c.present["log-level"] {
+		var lvl slog.Level
+		if err := lvl.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			return fmt.Errorf("配置项 log-level: 未知的日志级别 %q", c.LogLevel)
+		}
+	}
+	return nil
+}
+
+// envPrefix 是与命令行参数对应的环境变量前缀,如 -log-level 对应 STR_LOG_LEVEL
+const envPrefix = "STR_"
+
+// envName 返回参数 name 对应的环境变量名
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv 把设置了对应环境变量、但没有在命令行显式指定的参数写入 flag,返回写入的参数名。
+// 在加载配置文件之前调用,于是优先级为命令行 > 环境变量 > 配置文件 > 默认值
+func applyEnv(fs *flag.FlagSet) ([]string, error) {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var names []string
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s: %w", envName(f.Name), e)
+			return
+		}
+		names = append(names, f.Name)
+	})
+	return names, err
+}
+
+// applyTo 把文件中出现、但没有在命令行显式指定的配置项写入 flag,命令行优先
+func (c *fileConfig) applyTo(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for name, value := range c.flagValues() {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("配置项 %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// flagValues 把文件中出现的配置项格式化为命令行参数的取值
+func (c *fileConfig) flagValues() map[string]string {
+	values := make(map[string]string)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("yaml")
+		if name == "" || name == "listeners" || !c.present[name] {
+			continue
+		}
+
+		switch field := v.Field(i).Interface().(type) {
+		case []string:
+			values[name] = strings.Join(field, ",")
+		case time.Duration:
+			values[name] = field.String()
+		default:
+			values[name] = fmt.Sprint(field)
+		}
+	}
+	return values
+}
+
+// listenerConfig 在 base 的基础上应用 listener 自己的配置项
+func (c *fileConfig) listenerConfig(base Config) (Config, error) {
+	cfg := base
+	if c.present["src"] {
+		cfg.ListenAddr = c.Src[0]
+	}
+	// 后端只要覆盖了任意一项,就不再继承顶层的 dst/dst-http/dst-tls
+	if c.present["dst"] || c.present["dst-http"] || c.present["dst-tls"] {
+		cfg.DestAddrs, cfg.PlainBackends, cfg.TLSBackends = c.Dst, c.DstHTTP, c.DstTLS
+	}
+	if c.present["cidr"] {
+		nets, err := parseCIDRs(c.CIDR)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.AllowedNets = nets
+	}
+	if c.present["deny-cidr"] {
+		nets, err := parseCIDRs(c.DenyCIDR)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.DeniedNets = nets
+	}
+	if c.present["domain"] || c.present["domain-file"] {
+		domains, err := allowedDomains(strings.Join(c.Domain, ","), c.present["domain"], c.DomainFile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.AllowedDomains = domains
+	}
+	if c.present["deny-domain"] {
+		cfg.DeniedDomains = c.DenyDomain
+	}
+	if c.present["route"] {
+		routes, err := parseRoutes(strings.Join(c.Route, ","))
+		if err != nil {
+			return cfg, err
+		}
+		cfg.SNIRoutes = routes
+	}
+	if c.present["route-file"] {
+		routes, err := loadRouteFile(c.RouteFile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.FileRoutes = routes
+	}
+	if c.present["alpn-route"] {
+		routes, err := parseRoutes(strings.Join(c.ALPNRoute, ","))
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ALPNRoutes = routes
+	}
+	if c.present["sig-route"] {
+		routes, err := parseSignatureRoutes(strings.Join(c.SigRoute, ","))
+		if err != nil {
+			return cfg, err
+		}
+		cfg.SignatureRoutes = routes
+	}
+	if c.present["default-dst"] {
+		cfg.DefaultDst = c.DefaultDst
+	}
+	if c.present["default-dst-any-domain"] {
+		cfg.DefaultDstAnyDomain = c.DefaultDstAnyDomain
+	}
+	if c.present["protocol"] {
+		cfg.Protocol = c.Protocol
+	}
+	if c.present["lb"] {
+		cfg.LoadBalance = c.LB
+	}
+	if c.present["lb-hash-sni"] {
+		cfg.LBHashSNI = c.LBHashSNI
+	}
+	if c.present["send-proxy"] {
+		cfg.SendProxy = c.SendProxy
+	}
+	if c.present["accept-proxy"] {
+		cfg.AcceptProxy = c.AcceptProxy
+	}
+	if c.present["proxy-from"] {
+		nets, err := parseCIDRs(c.ProxyFrom)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ProxyFrom = nets
+	}
+	if c.present["rewrite-host"] {
+		cfg.RewriteHost = c.RewriteHost
+	}
+	if c.present["tls-terminate"] {
+		cfg.TLSTerminate = c.TLSTerminate
+	}
+	if c.present["xff"] {
+		cfg.XFF = c.XFF
+	}
+	if c.present["strict-http"] {
+		cfg.StrictHTTP = c.StrictHTTP
+	}
+	if c.present["allow-path"] {
+		cfg.AllowPaths = c.AllowPath
+	}
+	if c.present["allow-method"] {
+		cfg.AllowMethods = c.AllowMethod
+	}
+	if c.present["backend-tls"] {
+		cfg.BackendTLS = c.BackendTLS
+	}
+	if c.present["udp"] {
+		cfg.UDP = c.UDP
+	}
+	if c.present["udp-dst"] {
+		cfg.UDPBackend = c.UDPDst
+	}
+	return cfg, nil
+}
+
+// loadListFile 读取列表文件(域名文件、JA3 文件):每行一项,忽略空行和 # 开头的注释
+func loadListFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items, nil
+}
+
+// loadJA3File 读取 JA3 指纹文件,每行一个 32 位十六进制的 JA3 MD5,path 为空时返回 nil
+func loadJA3File(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	hashes, err := loadListFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hashes {
+		if _, err := hex.DecodeString(h); err != nil || len(h) != 32 {
+			return nil, fmt.Errorf("%s: 无效的 JA3 指纹 %q,应为 32 位十六进制 MD5", path, h)
+		}
+	}
+	return hashes, nil
+}
+
+// validateBackendAddr 检查后端地址,除 host:port 外还允许 unix:/path
+func validateBackendAddr(addr string) error {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return fmt.Errorf("无效的地址 %q: 缺少 socket 路径", addr)
+		}
+		return nil
+	}
+	return validateHostPort(addr)
+}
+
+// validateHostPort 检查 host:port 格式及端口范围
+func validateHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("无效的地址 %q: %w", addr, err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("地址 %q 的端口必须在 1-65535 之间", addr)
+	}
+	return nil
+}
+
+// parseTLSVersion 解析 "1.0"~"1.3" 形式的 TLS 版本号
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("未知的 TLS 版本 %q,可选 1.0、1.1、1.2、1.3", s)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadConfigString 把 data 写入后缀为 ext 的临时文件后交给 loadConfigFile,错误信息去掉文件路径前缀
+func loadConfigString(t *testing.T, ext, data string) (*fileConfig, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config"+ext)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return nil, errors.New(strings.TrimPrefix(err.Error(), path+": "))
+	}
+	return cfg, nil
+}
+
+const sameConfigYAML = `
+# 注释
+src: [":8443"]
+dst:
+  - "127.0.0.1:443"
+  - backend.internal:8443
+cidr: 10.0.0.0/8,192.168.0.0/16
+max-conns: 100
+rate-per-ip: 2.5
+idle-timeout: 90s
+nodelay: true
+deny-body: |
+  denied
+  bye
+listeners:
+  - src: ":8080"
+    dst-http: ["127.0.0.1:80"]
+    xff: true
+  - src: "unix:/run/relay.sock"
+    protocol: socks5
+`
+
+const sameConfigTOML = `
+# 注释
+src = [":8443"]
+dst = [
+  "127.0.0.1:443",
+  'backend.internal:8443',
+]
+cidr = "10.0.0.0/8,192.168.0.0/16"
+max-conns = 1_00
+rate-per-ip = 2.5
+idle-timeout = "90s"
+nodelay = true
+deny-body = """
+denied
+bye
+"""
+
+[[listeners]]
+src = ":8080"
+dst-http = ["127.0.0.1:80"]
+xff = true
+
+[[listeners]]
+src = "unix:/run/relay.sock"
+protocol = "socks5"
+`
+
+const sameConfigJSON = `{
+  "src": [":8443"],
+  "dst": ["127.0.0.1:443", "backend.internal:8443"],
+  "cidr": "10.0.0.0/8,192.168.0.0/16",
+  "max-conns": 100,
+  "rate-per-ip": 2.5,
+  "idle-timeout": "90s",
+  "nodelay": true,
+  "deny-body": "denied\nbye\n",
+  "listeners": [
+    {"src": ":8080", "dst-http": ["127.0.0.1:80"], "xff": true},
+    {"src": "unix:/run/relay.sock", "protocol": "socks5"}
+  ]
+}`
+
+func TestConfigFormatsEquivalent(t *testing.T) {
+	want := &fileConfig{
+		Src:         []string{":8443"},
+		Dst:         []string{"127.0.0.1:443", "backend.internal:8443"},
+		CIDR:        []string{"10.0.0.0/8", "192.168.0.0/16"},
+		MaxConns:    100,
+		RatePerIP:   2.5,
+		IdleTimeout: 90 * time.Second,
+		NoDelay:     true,
+		DenyBody:    "denied\nbye\n",
+		Listeners: []*fileConfig{
+			{
+				Src:     []string{":8080"},
+				DstHTTP: []string{"127.0.0.1:80"},
+				XFF:     true,
+				present: map[string]bool{"src": true, "dst-http": true, "xff": true},
+			},
+			{
+				Src:      []string{"unix:/run/relay.sock"},
+				Protocol: protocolSOCKS5,
+				present:  map[string]bool{"src": true, "protocol": true},
+			},
+		},
+		present: map[string]bool{
+			"src": true, "dst": true, "cidr": true, "max-conns": true, "rate-per-ip": true,
+			"idle-timeout": true, "nodelay": true, "deny-body": true, "listeners": true,
+		},
+	}
+
+	for ext, data := range map[string]string{".yaml": sameConfigYAML, ".toml": sameConfigTOML, ".json": sameConfigJSON} {
+		got, err := loadConfigString(t, ext, data)
+		if err != nil {
+			t.Errorf("%s: %v", ext, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s 解析结果\n%+v\n期望\n%+v", ext, got, want)
+		}
+	}
+}
+
+func TestConfigFormatsSameValidation(t *testing.T) {
+	tests := []struct {
+		yaml, toml, json string
+		want             string
+	}{
+		{
+			`dst: ["127.0.0.1:70000"]`,
+			`dst = ["127.0.0.1:70000"]`,
+			`{"dst": ["127.0.0.1:70000"]}`,
+			`配置项 dst: 地址 "127.0.0.1:70000" 的端口必须在 1-65535 之间`,
+		},
+		{
+			`cidr: [10.0.0.0/33]`,
+			`cidr = ["10.0.0.0/33"]`,
+			`{"cidr": ["10.0.0.0/33"]}`,
+			`配置项 cidr: 无效的 CIDR "10.0.0.0/33"`,
+		},
+		{
+			`max-con: 10`,
+			`max-con = 10`,
+			`{"max-con": 10}`,
+			`未知的配置项: max-con`,
+		},
+		{
+			`max-conns: -1`,
+			`max-conns = -1`,
+			`{"max-conns": -1}`,
+			`配置项 max-conns: 不能为负数`,
+		},
+		{
+			`max-conns: ten`,
+			`max-conns = "ten"`,
+			`{"max-conns": "ten"}`,
+			`配置项 max-conns: 无效的整数 "ten"`,
+		},
+		{
+			`lb: random`,
+			`lb = "random"`,
+			`{"lb": "random"}`,
+			`配置项 lb: 未知的负载均衡策略 "random"`,
+		},
+		{
+			"listeners:\n  - src: \":8080\"\n    max-conns: 5\n",
+			"[[listeners]]\nsrc = \":8080\"\nmax-conns = 5\n",
+			`{"listeners": [{"src": ":8080", "max-conns": 5}]}`,
+			`listeners[0]: 不支持的配置项 max-conns`,
+		},
+		{
+			"listeners:\n  - dst: [\"127.0.0.1:80\"]\n",
+			"[[listeners]]\ndst = [\"127.0.0.1:80\"]\n",
+			`{"listeners": [{"dst": ["127.0.0.1:80"]}]}`,
+			`listeners[0]: 缺少 src`,
+		},
+		{
+			"listeners:\n  - src: \":0\"\n",
+			"[[listeners]]\nsrc = \":0\"\n",
+			`{"listeners": [{"src": ":0"}]}`,
+			`listeners[0]: 配置项 src: 地址 ":0" 的端口必须在 1-65535 之间`,
+		},
+	}
+	for _, tt := range tests {
+		for ext, data := range map[string]string{".yaml": tt.yaml, ".toml": tt.toml, ".json": tt.json} {
+			_, err := loadConfigString(t, ext, data)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("%s %q: 错误 %v, 期望 %q", ext, data, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestConfigModeAlias(t *testing.T) {
+	for _, data := range []string{"mode: socks5\n", "mode: socks5\nprotocol: socks5\n", "listeners:\n  - src: \":1080\"\n    mode: socks5\n"} {
+		cfg, err := loadConfigString(t, ".yaml", data)
+		if err != nil {
+			t.Errorf("%q: %v", data, err)
+			continue
+		}
+		if len(cfg.Listeners) > 0 {
+			cfg = cfg.Listeners[0]
+		}
+		if cfg.Protocol != protocolSOCKS5 || !cfg.present["protocol"] {
+			t.Errorf("%q: protocol = %q, 期望 %q", data, cfg.Protocol, protocolSOCKS5)
+		}
+		if got := cfg.flagValues()["protocol"]; got != protocolSOCKS5 {
+			t.Errorf("%q: -protocol 取值 %q, 期望 %q", data, got, protocolSOCKS5)
+		}
+	}
+}
+
+func TestParseTOMLInteger(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // 为空表示应当报错
+	}{
+		{"0", "0"},
+		{"+12", "12"},
+		{"-0", "0"},
+		{"1_000", "1000"},
+		{"0x1F", "31"},
+		{"0o17", "15"},
+		{"0b101", "5"},
+		{"010", ""},
+		{"0_1", ""},
+		{"01.5", ""},
+		{"-0x1", ""},
+		{"1__0", ""},
+		{"_1", ""},
+		{"1_", ""},
+		{"0x", ""},
+		{"0b102", ""},
+	}
+	for _, tt := range tests {
+		tree, err := parseTOML([]byte("n = " + tt.value))
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("n = %s: 解析为 %v, 期望报错", tt.value, tree)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("n = %s: %v", tt.value, err)
+			continue
+		}
+		if got := tree.(map[string]any)["n"]; got != tt.want {
+			t.Errorf("n = %s: 解析为 %v, 期望 %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	data := `
+# 整行注释
+a: "x # y" # 行尾注释
+b: 'it''s'
+c: x#y
+d: ~
+e: "tab\there"
+listeners:
+- src: ":80"
+  dst: [b, "c,d"]
+- src: ":81"
+  route:
+    - "*.example.com=127.0.0.1:443"
+`
+	got, err := parseYAML([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"a": "x # y",
+		"b": "it's",
+		"c": "x#y",
+		"d": "",
+		"e": "tab\there",
+		"listeners": []any{
+			map[string]any{"src": ":80", "dst": []any{"b", "c,d"}},
+			map[string]any{"src": ":81", "route": []any{"*.example.com=127.0.0.1:443"}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseYAML 结果\n%v\n期望\n%v", got, want)
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"a: 1\na: 2\n", "第 2 行: 重复的键 a"},
+		{"listeners:\n  - src: a\n    src: b\n", "第 3 行: 重复的键 src"},
+		{"a:\n  - x\n   - y\n", "第 3 行: 缩进不正确"},
+		{"\ta: 1\n", "第 1 行: 缩进不能使用 tab"},
+		{"a: \"bad\\q\"\n", `第 1 行: 无效的双引号字符串: "bad\q"`},
+		{"a: [x, y\n", "第 1 行: 行内列表缺少 ]: [x, y"},
+		{"just text\n", "第 1 行: 应为 key: value 格式"},
+	}
+	for _, tt := range tests {
+		_, err := parseYAML([]byte(tt.data))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parseYAML(%q) 错误 %v, 期望 %q", tt.data, err, tt.want)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`src: [":65536"]`, `配置项 src: 地址 ":65536" 的端口必须在 1-65535 之间`},
+		{`src: ["127.0.0.1:0"]`, `配置项 src: 地址 "127.0.0.1:0" 的端口必须在 1-65535 之间`},
+		{`src: [localhost]`, `配置项 src: 无效的地址 "localhost": address localhost: missing port in address`},
+		{`dst-tls: ["[::1]:99999"]`, `配置项 dst-tls: 地址 "[::1]:99999" 的端口必须在 1-65535 之间`},
+		{`dst: ["unix:"]`, `配置项 dst: 无效的地址 "unix:": 缺少 socket 路径`},
+		{`metrics-addr: ":http"`, `配置项 metrics-addr: 地址 ":http" 的端口必须在 1-65535 之间`},
+		{`cidr: [10.0.0.1]`, `配置项 cidr: 无效的 CIDR "10.0.0.1"`},
+		{`deny-cidr: ["2001:db8::/129"]`, `配置项 deny-cidr: 无效的 CIDR "2001:db8::/129"`},
+		{`srcs: [":80"]`, `未知的配置项: srcs`},
+		{"listeners:\n  - src: \":80\"\n    bogus: 1\n", `listeners[0]: 不支持的配置项 bogus`},
+		{"listeners:\n  - src: [\":80\", \":81\"]\n", `listeners[0]: src 只能是一个地址`},
+		{"listeners:\n  - src: \":80\"\n    cidr: [1.2.3.4/40]\n", `listeners[0]: 配置项 cidr: 无效的 CIDR "1.2.3.4/40"`},
+		{`idle-timeout: 5`, `配置项 idle-timeout: 无效的时长 "5"`},
+		{`nodelay: yes`, `配置项 nodelay: 无效的布尔值 "yes"`},
+		{"src:\n  a: b\n", `配置项 src: 应为列表`},
+		{`max-conns: [1]`, `配置项 max-conns: 应为单个值`},
+		{`buffer-size: 0`, `配置项 buffer-size: 必须大于 0`},
+		{"mode: socks5\nprotocol: connect\n", `配置项 mode socks5 与 protocol connect 不一致`},
+		{`mode: ftp`, `配置项 protocol: 未知的协议 "ftp"`},
+	}
+	for _, tt := range tests {
+		_, err := loadConfigString(t, ".yaml", tt.data)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%q: 错误 %v, 期望 %q", tt.data, err, tt.want)
+		}
+	}
+}
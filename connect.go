@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// handleConnect 处理已通过域名白名单和黑名单的 HTTP CONNECT 请求:连接请求中的 host:port,
+// 回复 200 Connection Established 后做裸 TCP 转发。reader 中缓存的、请求头之后的数据先发给目标
+func (s *Server) handleConnect(sess *session, req *http.Request, reader *bufio.Reader) {
+	conn := sess.conn
+
+	// CONNECT 的目标必须带端口,Go 把请求行中的 authority 放在 req.Host
+	target := req.Host
+	if _, port, err := net.SplitHostPort(target); err != nil || port == "" {
+		sess.logger.Warn("CONNECT 请求的目标缺少端口", "event", "connect_error", "target", target)
+		sess.closeReason = "connect_error"
+		sess.status = http.StatusBadRequest
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	forwardConn, err := s.dialTarget(sess, target)
+	if err != nil {
+		sess.status = http.StatusBadGateway
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	sess.logger.Info("转发 CONNECT 数据", "event", "forward", "dst", target)
+
+	// 客户端可能紧跟着请求头发送了数据(如 TLS ClientHello),已被 reader 缓存的部分先发给目标
+	buffered, _ := reader.Peek(reader.Buffered())
+	s.relayTo(sess, forwardConn, target, false, func(forwardConn net.Conn) (net.Conn, bool) {
+		sess.status = http.StatusOK
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			sess.logger.Warn("向客户端发送 CONNECT 应答时出错", "event", "write_error", "error", err)
+			sess.closeReason = "write_error"
+			return nil, false
+		}
+		return forwardConn, true
+	}, buffered)
+}
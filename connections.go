@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectionInfo 是 GET /connections 返回的单个连接
+type connectionInfo struct {
+	ConnID     uint64    `json:"conn_id"`
+	Listener   string    `json:"listener"`
+	ClientIP   string    `json:"client_ip"`
+	Host       string    `json:"host,omitempty"` // TLS 连接为 SNI,非TLS 连接为 Host 头
+	Dst        string    `json:"dst,omitempty"`
+	State      string    `json:"state"` // handshake 或 forwarding
+	Start      time.Time `json:"start"`
+	DurationMS int64     `json:"duration_ms"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+}
+
+// connections 返回当前所有连接的快照。握手阶段的连接只有 Accept 时的来源地址,
+// 开启 AcceptProxy 时是负载均衡的地址
+func (s *Server) connections() []connectionInfo {
+	var list []connectionInfo
+	s.sessions.Range(func(_, value any) bool {
+		sess := value.(*session)
+		info := connectionInfo{
+			ConnID:     sess.id,
+			Listener:   s.cfg.ListenAddr,
+			State:      "handshake",
+			Start:      sess.start,
+			DurationMS: time.Since(sess.start).Milliseconds(),
+			BytesIn:    sess.bytesIn.Load(),
+			BytesOut:   sess.bytesOut.Load(),
+		}
+		if route := sess.route.Load(); route != nil {
+			info.State = "forwarding"
+			info.ClientIP, info.Host, info.Dst = route.clientIP, route.host, route.dst
+		} else {
+			info.ClientIP, _ = remoteIP(sess.raw.RemoteAddr())
+		}
+		list = append(list, info)
+		return true
+	})
+	return list
+}
+
+// kill 断开编号为 id 的连接,连接不存在时返回 false
+func (s *Server) kill(id uint64) bool {
+	value, ok := s.sessions.Load(id)
+	if !ok {
+		return false
+	}
+	sess := value.(*session)
+	s.logger.Info("通过管理接口断开连接", "event", "kill", "conn_id", id)
+	sess.cancel(causeKilled)
+	return true
+}
+
+// ConnectionsHandler 提供连接查询:GET /connections 返回所有 listener 的连接列表(JSON,按 conn_id 排序),
+// DELETE /connections/{id} 断开指定连接
+func ConnectionsHandler(servers ...*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idText, hasID := strings.CutPrefix(r.URL.Path, "/connections/")
+		switch {
+		case !hasID && r.Method == http.MethodGet:
+			list := []connectionInfo{}
+			for _, srv := range servers {
+				list = append(list, srv.connections()...)
+			}
+			slices.SortFunc(list, func(a, b connectionInfo) int { return cmp.Compare(a.ConnID, b.ConnID) })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		case hasID && r.Method == http.MethodDelete:
+			id, err := strconv.ParseUint(idText, 10, 64)
+			if err != nil {
+				http.Error(w, "无效的连接编号", http.StatusBadRequest)
+				return
+			}
+			for _, srv := range servers {
+				if srv.kill(id) {
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+					fmt.Fprintln(w, "ok")
+					return
+				}
+			}
+			http.Error(w, "连接不存在", http.StatusNotFound)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// happyEyeballsDelay 是 RFC 8305 的 Connection Attempt Delay:上一个 IP 在这段时间内既没连上也没失败时,
+// 不再等它,并发开始尝试下一个
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// dialAddr 连接 ip:port、hostname:port 或 unix:/path 形式的后端地址,每次连接都有 timeout 的限制。
+// 主机名解析出多个 A/AAAA 记录时由 dialHappyEyeballs 按 RFC 8305 并发竞速,单个 IP 失败时调用 onFail(可以为 nil)。
+// cache 为 nil 时每次都重新解析;local 不为空时 TCP 连接绑定该出口 IP。ctx 被取消时放弃正在进行的连接
+func dialAddr(ctx context.Context, addr string, timeout time.Duration, local net.IP, cache *dnsCache, onFail func(ip string, err error)) (net.Conn, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		dialer := net.Dialer{Timeout: timeout}
+		return dialer.DialContext(ctx, "unix", path)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialTCP(ctx, addr, timeout, local)
+	}
+
+	ips, cached, err := cache.lookup(ctx, host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	dialIPs := func(ips []string) (net.Conn, error) {
+		return dialHappyEyeballs(ctx, ips, port, timeout, local, onFail)
+	}
+
+	conn, err := dialIPs(ips)
+	if err == nil || !cached {
+		return conn, err
+	}
+
+	// 缓存的 IP 全部失败,记录可能已经过期,强制重新解析一次并尝试新出现的 IP
+	fresh, ferr := cache.refresh(ctx, host, timeout)
+	if ferr != nil {
+		return nil, err
+	}
+	fresh = slices.DeleteFunc(fresh, func(ip string) bool { return slices.Contains(ips, ip) })
+	if len(fresh) == 0 {
+		return nil, err
+	}
+	return dialIPs(fresh)
+}
+
+// dialHappyEyeballs 按 RFC 8305 连接同一主机名解析出的多个 IP:先按地址族交替排列(IPv6 与 IPv4 轮流),
+// 依次发起连接,上一个失败时立即开始下一个,超过 happyEyeballsDelay 仍未完成时也并发开始下一个;
+// 第一个连上的胜出,其余尝试被取消,之后才连上的连接直接关闭。
+// 自己解析主机名是为了 DNS 缓存和多地址故障转移,因此不能依赖 net.Dialer 内置的竞速,在这里实现同样的行为。
+// local 不为空时只尝试与它同一地址族的 IP
+func dialHappyEyeballs(ctx context.Context, ips []string, port string, timeout time.Duration, local net.IP, onFail func(ip string, err error)) (net.Conn, error) {
+	ips = interleaveFamilies(ips, local)
+	if len(ips) == 1 {
+		conn, err := dialTCP(ctx, net.JoinHostPort(ips[0], port), timeout, local)
+		if err != nil && onFail != nil {
+			onFail(ips[0], err)
+		}
+		return conn, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ip   string
+		conn net.Conn
+		err  error
+	}
+	// 缓冲足够大,胜出后仍在进行的尝试结束时不会阻塞
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	startNext := func() {
+		if next >= len(ips) {
+			return
+		}
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialTCP(ctx, net.JoinHostPort(ip, port), timeout, local)
+			results <- result{ip, conn, err}
+		}()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(happyEyeballsDelay)
+	}
+
+	startNext()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if onFail != nil {
+				onFail(r.ip, r.err)
+			}
+			startNext()
+		case <-timer.C:
+			startNext()
+		}
+	}
+	return nil, lastErr
+}
+
+// interleaveFamilies 保持解析结果(已按 RFC 6724 排序)中各地址族内部的顺序,从第一个 IP 的地址族开始交替排列。
+// local 不为空时去掉与它地址族不同的 IP,全部不同时原样返回,让拨号给出明确的错误
+func interleaveFamilies(ips []string, local net.IP) []string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if local != nil {
+		same := v6
+		if local.To4() != nil {
+			same = v4
+		}
+		if len(same) == 0 {
+			return ips
+		}
+		return same
+	}
+
+	first, second := v6, v4
+	if len(ips) > 0 && slices.Contains(v4, ips[0]) {
+		first, second = v4, v6
+	}
+	ordered := make([]string, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// dialTCP 在 timeout 内连接 addr,local 不为空时绑定该出口 IP,ctx 被取消时放弃正在进行的连接。
+// 出口 IP 已不在本机网卡上时返回明确指出绑定地址的错误
+func dialTCP(ctx context.Context, addr string, timeout time.Duration, local net.IP) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if local != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: local}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil && local != nil && errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return nil, fmt.Errorf("无法绑定出口 IP %s: %w", local, err)
+	}
+	return conn, err
+}
+
+// parseBindIP 解析出口 IP 并确认它在本机网卡上可以绑定,避免启动后每次转发才失败
+func parseBindIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("无效的出口 IP %q", s)
+	}
+	l, err := net.ListenPacket("udp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("出口 IP %s 不可用: %w", ip, err)
+	}
+	l.Close()
+	return ip, nil
+}
+
+// lookupHost 解析后端主机名的全部 IP,ctx 被取消时放弃解析
+func lookupHost(ctx context.Context, host string, timeout time.Duration) ([]string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析后端主机名 %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("后端主机名 %s 没有解析到任何地址", host)
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.String())
+	}
+	return ips, nil
+}
+
+// dnsCache 缓存后端主机名的解析结果,并在后台每隔 ttl 刷新一次
+type dnsCache struct {
+	ttl    time.Duration
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	ips     []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration, logger *slog.Logger) *dnsCache {
+	return &dnsCache{ttl: ttl, logger: logger, entries: make(map[string]*dnsEntry)}
+}
+
+// lookup 返回 host 的全部 IP,cached 表示结果来自缓存。
+// 记录过期后重新解析,解析失败时继续使用过期的记录
+func (c *dnsCache) lookup(ctx context.Context, host string, timeout time.Duration) (ips []string, cached bool, err error) {
+	if c == nil {
+		ips, err := lookupHost(ctx, host, timeout)
+		return ips, false, err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, true, nil
+	}
+
+	ips, err = c.refresh(ctx, host, timeout)
+	if err != nil && ok && ctx.Err() == nil {
+		c.logger.Warn("重新解析后端主机名失败，继续使用过期的缓存", "event", "dns_error", "host", host, "ips", entry.ips, "error", err)
+		return entry.ips, true, nil
+	}
+	return ips, false, err
+}
+
+// refresh 立即重新解析 host 并更新缓存
+func (c *dnsCache) refresh(ctx context.Context, host string, timeout time.Duration) ([]string, error) {
+	ips, err := lookupHost(ctx, host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	old, ok := c.entries[host]
+	c.entries[host] = &dnsEntry{ips: ips, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	if ok && !slices.Equal(old.ips, ips) {
+		c.logger.Info("后端主机名解析结果变化", "event", "dns_update", "host", host, "old", old.ips, "new", ips)
+	}
+	return ips, nil
+}
+
+// run 每隔 ttl 在后台刷新所有用到过的主机名,直到 stop 被关闭
+func (c *dnsCache) run(stop <-chan struct{}, timeout time.Duration) {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		hosts := make([]string, 0, len(c.entries))
+		for host := range c.entries {
+			hosts = append(hosts, host)
+		}
+		c.mu.Unlock()
+
+		for _, host := range hosts {
+			if _, err := c.refresh(context.Background(), host, timeout); err != nil {
+				c.logger.Warn("后台刷新后端主机名失败，保留旧的解析结果", "event", "dns_error", "host", host, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// maxDomainsBody 是 PUT/POST 域名列表请求体的上限
+const maxDomainsBody = 4 << 20
+
+// listenerDomains 是 GET /domains 返回的单个 listener 的白名单
+type listenerDomains struct {
+	Listener string   `json:"listener"`
+	Domains  []string `json:"domains"`
+}
+
+// DomainsHandler 提供运行时修改域名白名单的接口,请求体和响应都是 JSON:
+// GET /domains 返回每个 listener 的白名单;PUT /domains 用请求体中的域名数组整体替换;
+// POST /domains/add 把请求体中的域名追加到白名单,已有的跳过。带 ?listener=<src> 时只作用于该 listener,
+// 否则作用于所有 listener。改动在 SIGHUP 重载时会被配置文件中的白名单覆盖
+func DomainsHandler(logger *slog.Logger, servers ...*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets := servers
+		if src := r.URL.Query().Get("listener"); src != "" {
+			targets = nil
+			for _, srv := range servers {
+				if srv.cfg.ListenAddr == src {
+					targets = append(targets, srv)
+				}
+			}
+			if len(targets) == 0 {
+				http.Error(w, fmt.Sprintf("listener %q 不存在", src), http.StatusNotFound)
+				return
+			}
+		}
+
+		var update func(domains []string) []string
+		switch {
+		case r.URL.Path == "/domains" && r.Method == http.MethodGet:
+		case r.URL.Path == "/domains" && r.Method == http.MethodPut,
+			r.URL.Path == "/domains/add" && r.Method == http.MethodPost:
+			patterns, err := readDomainsBody(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if r.Method == http.MethodPut {
+				update = func([]string) []string { return patterns }
+			} else {
+				update = func(domains []string) []string {
+					for _, p := range patterns {
+						if !slices.Contains(domains, p) {
+							domains = append(domains, p)
+						}
+					}
+					return domains
+				}
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result := []listenerDomains{}
+		for _, srv := range targets {
+			var domains []string
+			if update != nil {
+				domains = srv.UpdateAllowedDomains(update)
+				logger.Info("通过管理接口更新允许的域名", "event", "domains_update", "src", srv.cfg.ListenAddr, "method", r.Method, "domains", len(domains))
+			} else {
+				domains = srv.AllowedDomains()
+			}
+			result = append(result, listenerDomains{Listener: srv.cfg.ListenAddr, Domains: domains})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// readDomainsBody 解析请求体中的 JSON 域名数组,逐个校验模式,任一非法时整个请求不生效
+func readDomainsBody(r *http.Request) ([]string, error) {
+	var patterns []string
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxDomainsBody)).Decode(&patterns); err != nil {
+		return nil, fmt.Errorf("请求体应为 JSON 字符串数组: %v", err)
+	}
+	for _, p := range patterns {
+		if err := checkDomainPattern(p); err != nil {
+			return nil, err
+		}
+	}
+	return patterns, nil
+}
@@ -0,0 +1,3 @@
+module github.com/badafans/SecureTCPRelay
+
+go 1.24
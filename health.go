@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backendHealth 记录单个后端的健康状态
+type backendHealth struct {
+	up    bool
+	fails int // 连续失败次数
+}
+
+// healthChecker 周期性探测后端,连续失败达到阈值时标记为 down,探测成功后恢复
+type healthChecker struct {
+	server    *Server
+	interval  time.Duration
+	threshold int
+	tlsAddrs  map[string]bool // 使用 TLS ClientHello 探测的后端
+
+	mu    sync.RWMutex
+	state map[string]*backendHealth
+}
+
+func newHealthChecker(s *Server) *healthChecker {
+	hc := &healthChecker{
+		server:    s,
+		interval:  s.cfg.HealthInterval,
+		threshold: max(s.cfg.HealthFailThreshold, 1),
+		tlsAddrs:  make(map[string]bool),
+		state:     make(map[string]*backendHealth),
+	}
+
+	add := func(addr string, useTLS bool) {
+		if _, ok := hc.state[addr]; !ok {
+			hc.state[addr] = &backendHealth{up: true}
+		}
+		if useTLS && s.cfg.HealthTLS {
+			hc.tlsAddrs[addr] = true
+		}
+	}
+	for _, addr := range s.cfg.PlainBackends {
+		add(addr, false)
+	}
+	for _, addr := range s.cfg.TLSBackends {
+		add(addr, true)
+	}
+	for _, route := range slices.Concat(s.cfg.SNIRoutes, s.cfg.FileRoutes, s.cfg.ALPNRoutes) {
+		add(route.Addr, true)
+	}
+	return hc
+}
+
+// run 立即探测一轮,之后每隔 interval 探测一次,直到 stop 被关闭
+func (hc *healthChecker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		hc.checkAll()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, addr := range hc.addrs() {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			hc.record(addr, hc.probe(addr))
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// probe 对后端做一次 TCP 拨号,开启 TLS 探测时还会发送 ClientHello 并等待服务器回应
+func (hc *healthChecker) probe(addr string) error {
+	timeout := hc.server.cfg.DialTimeout
+	if timeout <= 0 || timeout > hc.interval {
+		timeout = hc.interval
+	}
+
+	conn, err := hc.server.dialOutbound(hc.server.ctx, addr, timeout, hc.server.cfg.BindIP, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !hc.tlsAddrs[addr] {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	// 收到 alert 说明对端是正常工作的 TLS 服务,只是不接受这次探测的参数
+	var alert tls.AlertError
+	if err == nil || errors.As(err, &alert) {
+		return nil
+	}
+	return err
+}
+
+func (hc *healthChecker) record(addr string, err error) {
+	hc.mu.Lock()
+	h := hc.state[addr]
+	wasUp := h.up
+	if err == nil {
+		h.fails = 0
+		h.up = true
+	} else {
+		h.fails++
+		if h.fails >= hc.threshold {
+			h.up = false
+		}
+	}
+	fails, up := h.fails, h.up
+	hc.mu.Unlock()
+
+	logger := hc.server.logger
+	switch {
+	case wasUp && !up:
+		logger.Warn("后端健康检查连续失败，标记为 down", "event", "backend_down", "dst", addr, "fails", fails, "error", err)
+	case !wasUp && up:
+		logger.Info("后端恢复，重新加入可选列表", "event", "backend_up", "dst", addr)
+	case err != nil:
+		logger.Debug("后端健康检查失败", "event", "health_check", "dst", addr, "fails", fails, "error", err)
+	}
+}
+
+// isUp 返回后端是否健康,未被跟踪的地址视为健康
+func (hc *healthChecker) isUp(addr string) bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	h, ok := hc.state[addr]
+	return !ok || h.up
+}
+
+// anyUp 返回是否至少有一个被探测的后端健康
+func (hc *healthChecker) anyUp() bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	for _, h := range hc.state {
+		if h.up {
+			return true
+		}
+	}
+	return false
+}
+
+// addrs 返回按字母排序的全部被探测后端
+func (hc *healthChecker) addrs() []string {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	addrs := make([]string, 0, len(hc.state))
+	for addr := range hc.state {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// healthyBackends 过滤掉 down 的后端;全部 down 时返回原列表,仍然尽力尝试
+func (s *Server) healthyBackends(sess *session, backends []string) []string {
+	if s.health == nil {
+		return backends
+	}
+	healthy := make([]string, 0, len(backends))
+	for _, addr := range backends {
+		if s.health.isUp(addr) {
+			healthy = append(healthy, addr)
+		}
+	}
+	if len(healthy) == 0 {
+		sess.logger.Warn("所有候选后端都处于 down 状态，仍然依次尝试", "event", "no_healthy_backend", "dst", backends)
+		return backends
+	}
+	return healthy
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeWindows 是一天内允许访问的时间段,按 loc 时区的时钟判断。每段为 [start, end),单位为当天的分钟数;
+// start 大于 end 时表示跨过午夜,如 22:00-06:00
+type timeWindows struct {
+	spec    string
+	loc     *time.Location
+	windows [][2]int
+}
+
+// parseTimeWindows 解析 "09:00-18:00" 形式的时间段,多个用逗号分隔。tz 为 IANA 时区名,为空时使用本地时区
+func parseTimeWindows(spec, tz string) (*timeWindows, error) {
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("无效的时区 %q: %w", tz, err)
+		}
+	}
+
+	w := &timeWindows{spec: spec, loc: loc}
+	for _, item := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(item), "-")
+		if !ok {
+			return nil, fmt.Errorf("时间段格式错误: %q", item)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, fmt.Errorf("时间段 %q: %w", item, err)
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, fmt.Errorf("时间段 %q: %w", item, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("时间段 %q: 开始与结束时间相同", item)
+		}
+		w.windows = append(w.windows, [2]int{start, end})
+	}
+	return w, nil
+}
+
+// parseClock 把 HH:MM 解析为当天的分钟数,允许 24:00 表示一天结束
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("无效的时间 %q,应为 HH:MM", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// contains 判断 t 是否落在任一时间段内
+func (w *timeWindows) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	now := t.Hour()*60 + t.Minute()
+	for _, win := range w.windows {
+		start, end := win[0], win[1]
+		if start < end && now >= start && now < end {
+			return true
+		}
+		if start > end && (now >= start || now < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceAllowHours 每到整分钟检查一次,处于允许访问的时间段之外时断开所有现有连接,直到 stop 关闭
+func (s *Server) enforceAllowHours(stop <-chan struct{}) {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		active := s.ActiveConnections()
+		if active == 0 || s.cfg.AllowHours.contains(time.Now()) {
+			continue
+		}
+
+		s.logger.Info("已超出允许访问的时间段，断开现有连接", "event", "allow_hours_close", "allow_hours", s.cfg.AllowHours.spec, "active", active)
+		s.sessions.Range(func(_, value any) bool {
+			value.(*session).cancel(causeAllowHours)
+			return true
+		})
+	}
+}
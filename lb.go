@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Config.LoadBalance 的取值
+const (
+	lbFailover = "failover" // 按配置顺序尝试后端,前面的不可用时才用后面的
+	lbIPHash   = "iphash"   // 按客户端 IP(可选加上 SNI/Host)在一致性哈希环上选择后端,同一客户端总是落到同一后端
+)
+
+// hashRingReplicas 是每个后端在哈希环上的虚拟节点数,越多分布越均匀
+const hashRingReplicas = 160
+
+// hashRing 是一致性哈希环。后端增减时只有落在该后端虚拟节点上的 key 会重新映射,约为 1/n
+type hashRing struct {
+	hashes []uint64 // 升序排列的虚拟节点哈希
+	owners []string // hashes[i] 对应的后端
+}
+
+func newHashRing(backends []string) *hashRing {
+	type vnode struct {
+		hash  uint64
+		owner string
+	}
+	nodes := make([]vnode, 0, len(backends)*hashRingReplicas)
+	for _, addr := range backends {
+		for i := 0; i < hashRingReplicas; i++ {
+			nodes = append(nodes, vnode{hashKey(addr + "#" + strconv.Itoa(i)), addr})
+		}
+	}
+	slices.SortFunc(nodes, func(a, b vnode) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return strings.Compare(a.owner, b.owner)
+	})
+	ring := &hashRing{hashes: make([]uint64, len(nodes)), owners: make([]string, len(nodes))}
+	for i, n := range nodes {
+		ring.hashes[i], ring.owners[i] = n.hash, n.owner
+	}
+	return ring
+}
+
+// order 返回 key 在环上顺时针依次遇到的后端,每个后端只出现一次。第一个是 key 的首选后端,
+// 后面的是首选不可用时的备选,去掉任一后端后其余 key 的首选不变
+func (r *hashRing) order(key string, n int) []string {
+	start, _ := slices.BinarySearch(r.hashes, hashKey(key))
+	result := make([]string, 0, n)
+	for i := 0; i < len(r.owners) && len(result) < n; i++ {
+		owner := r.owners[(start+i)%len(r.owners)]
+		if !slices.Contains(result, owner) {
+			result = append(result, owner)
+		}
+	}
+	return result
+}
+
+// hashKey 是 FNV-1a 加 splitmix64 的终结混合,让只差一个字符的 key(如虚拟节点编号)也均匀分散
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := binary.BigEndian.Uint64(h.Sum(nil))
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// balancer 按 LoadBalance 策略排列候选后端,哈希环按后端列表缓存
+type balancer struct {
+	rings sync.Map // 以逗号连接的后端列表 -> *hashRing
+}
+
+func (b *balancer) ring(backends []string) *hashRing {
+	key := strings.Join(backends, ",")
+	if ring, ok := b.rings.Load(key); ok {
+		return ring.(*hashRing)
+	}
+	ring, _ := b.rings.LoadOrStore(key, newHashRing(backends))
+	return ring.(*hashRing)
+}
+
+// orderBackends 按负载均衡策略返回后端的尝试顺序。iphash 下哈希环由完整的后端列表构建,
+// 健康检查再按这个顺序过滤掉 down 的后端,效果等同于从环上摘掉它们
+func (s *Server) orderBackends(sess *session, backends []string) []string {
+	if s.cfg.LoadBalance != lbIPHash || len(backends) < 2 {
+		return backends
+	}
+	key, _ := remoteIP(sess.clientAddr)
+	if s.cfg.LBHashSNI {
+		key += "|" + normalizeDomain(sess.host)
+	}
+	ordered := s.balancer.ring(backends).order(key, len(backends))
+	sess.logger.Debug("按一致性哈希选择后端", "event", "lb", "dst", ordered[0])
+	return ordered
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// ringKeys 生成测试用的客户端 IP 作为哈希 key
+func ringKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+	}
+	return keys
+}
+
+func ringBackends(n int) []string {
+	backends := make([]string, n)
+	for i := range backends {
+		backends[i] = fmt.Sprintf("10.0.0.%d:443", i+1)
+	}
+	return backends
+}
+
+// primaries 返回每个 key 在环上的首选后端
+func primaries(r *hashRing, keys []string) map[string]string {
+	m := make(map[string]string, len(keys))
+	for _, k := range keys {
+		m[k] = r.order(k, 1)[0]
+	}
+	return m
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	const n = 5
+	keys := ringKeys(10000)
+	counts := map[string]int{}
+	for _, owner := range primaries(newHashRing(ringBackends(n)), keys) {
+		counts[owner]++
+	}
+	if len(counts) != n {
+		t.Fatalf("只有 %d 个后端分到了 key, 期望 %d 个", len(counts), n)
+	}
+	avg := len(keys) / n
+	for addr, c := range counts {
+		if c < avg/2 || c > avg*3/2 {
+			t.Errorf("%s 分到 %d 个 key, 偏离平均值 %d 太多", addr, c, avg)
+		}
+	}
+}
+
+func TestHashRingAddBackend(t *testing.T) {
+	keys := ringKeys(10000)
+	for _, n := range []int{2, 5, 10} {
+		backends := ringBackends(n + 1)
+		before := primaries(newHashRing(backends[:n]), keys)
+		after := primaries(newHashRing(backends), keys)
+		added := backends[n]
+
+		moved := 0
+		for _, k := range keys {
+			if before[k] == after[k] {
+				continue
+			}
+			moved++
+			// 只有被新后端接管的 key 才会移动,旧后端之间不互相搬 key
+			if after[k] != added {
+				t.Fatalf("n=%d: %s 从 %s 移到了 %s, 期望只移到新后端 %s", n, k, before[k], after[k], added)
+			}
+		}
+		// 理想情况下移动 1/(n+1) 的 key
+		frac := float64(moved) / float64(len(keys))
+		if want := 1 / float64(n+1); frac < want/2 || frac > want*2 {
+			t.Errorf("n=%d 增加一个后端后移动了 %.3f 的 key, 期望约 %.3f", n, frac, want)
+		}
+	}
+}
+
+func TestHashRingRemoveBackend(t *testing.T) {
+	keys := ringKeys(10000)
+	for _, n := range []int{3, 5, 10} {
+		backends := ringBackends(n)
+		full := newHashRing(backends)
+		before := primaries(full, keys)
+		removed := backends[n/2]
+		rest := append(append([]string{}, backends[:n/2]...), backends[n/2+1:]...)
+		after := primaries(newHashRing(rest), keys)
+
+		moved := 0
+		for _, k := range keys {
+			if before[k] != removed {
+				if after[k] != before[k] {
+					t.Fatalf("n=%d: %s 不在被移除的后端上,却从 %s 移到了 %s", n, k, before[k], after[k])
+				}
+				continue
+			}
+			moved++
+			// 原来落在被移除后端上的 key 改用环上的下一个后端,与健康检查跳过 down 后端的结果一致
+			if next := full.order(k, 2)[1]; after[k] != next {
+				t.Errorf("n=%d: %s 移到了 %s, 期望环上的下一个后端 %s", n, k, after[k], next)
+			}
+		}
+		frac := float64(moved) / float64(len(keys))
+		if want := 1 / float64(n); frac < want/2 || frac > want*2 {
+			t.Errorf("n=%d 移除一个后端后移动了 %.3f 的 key, 期望约 %.3f", n, frac, want)
+		}
+	}
+}
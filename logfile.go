@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile 是按大小轮转的日志文件:写入后超过 maxSize 时把当前文件改名为 path.1,
+// 已有的 path.1 ... path.N 依次后移,超出 maxBackups 的最旧文件被删除。
+// Write 加锁执行,每次调用的数据完整写入同一个文件,轮转不会拆开或丢弃日志
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64 // 字节数,0 表示不轮转
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// openRotatingFile 以追加方式打开 path,已有内容计入当前大小
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 当前文件为空时即使单条日志超过上限也直接写入,避免反复轮转出空文件
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// 轮转失败时继续写旧文件,宁可超出大小也不丢日志
+			fmt.Fprintf(os.Stderr, "日志文件轮转失败: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate 关闭当前文件并依次后移备份,调用方需持有锁
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	if r.maxBackups > 0 {
+		os.Remove(r.backupName(r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(r.backupName(i), r.backupName(i+1)); err != nil && !os.IsNotExist(err) {
+				return r.reopen(err)
+			}
+		}
+		if err := os.Rename(r.path, r.backupName(1)); err != nil {
+			return r.reopen(err)
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return r.reopen(err)
+	}
+
+	if err := r.open(); err != nil {
+		return r.reopen(err)
+	}
+	return nil
+}
+
+// reopen 在轮转中途失败时重新打开原文件继续写入,返回原始错误
+func (r *rotatingFile) reopen(cause error) error {
+	if err := r.open(); err != nil {
+		return fmt.Errorf("%w; 重新打开 %s 失败: %v", cause, r.path, err)
+	}
+	return cause
+}
+
+func (r *rotatingFile) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
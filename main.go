@@ -1,330 +1,892 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"maps"
 	"net"
 	"net/http"
-	"regexp"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-var activeConnections int32 // 用于跟踪活跃连接的数量
-
 func main() {
 	// 解析命令行参数
-	localAddr := flag.String("src", "0.0.0.0:1234", "本地监听的 IP 和端口")
+	localAddr := flag.String("src", "0.0.0.0:1234", "本地监听的 IP 和端口,也可以是 unix:/path/to.sock 形式的 unix socket,多个地址用逗号分隔,每个地址独立 Accept")
+	skipFailedSrc := flag.Bool("skip-failed-src", false, "-src 有多个地址或配置了多个 listener 时,监听失败的地址只记录错误并跳过,默认任一地址失败都退出;全部失败时仍然退出")
 	forwardAddrs := flag.String("dst", "127.0.0.1:4321", "转发的目标 IP 和端口,多目标模式用逗号分隔(第一个是非TLS地址,第二个是TLS地址,多出部分地址无效)")
+	plainBackends := flag.String("dst-http", "", "非TLS流量的候选后端,逗号分隔,连接失败时依次尝试下一个,设置后覆盖 -dst 的第一个地址")
+	tlsBackends := flag.String("dst-tls", "", "TLS 流量的候选后端,逗号分隔,连接失败时依次尝试下一个,设置后覆盖 -dst 的第二个地址")
 	cidrs := flag.String("cidr", "0.0.0.0/0,::/0", "允许的来源 IP 范围 (CIDR),多个范围用逗号分隔")
+	denyCIDRs := flag.String("deny-cidr", "", "拒绝的来源 IP 范围 (CIDR),多个范围用逗号分隔,在 -cidr 通过后再检查,同时命中时以拒绝为准")
 	domainList := flag.String("domain", "*", "允许的域名列表,用逗号分隔,支持通配符*,默认转发所有域名")
+	denyDomainList := flag.String("deny-domain", "", "拒绝的域名列表,用逗号分隔,支持通配符*,优先于 -domain")
+	domainFile := flag.String("domain-file", "", "从文件加载允许的域名,每行一个,支持 # 注释和通配符*,与 -domain 合并")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "收到退出信号后等待现有连接关闭的最长时间")
+	idleTimeout := flag.Duration("idle-timeout", 0, "连接空闲超时,任一方向超过该时长无数据即断开,0 表示关闭")
+	halfCloseTimeout := flag.Duration("half-close-timeout", 30*time.Second, "一个方向结束(对端关闭)后另一方向最多还能转发多久,超时关闭连接,0 表示一直等待")
+	maxConnLifetime := flag.Duration("max-conn-lifetime", 0, "连接的最长存活时间,超过后即使仍在传输也主动关闭,0 表示不限制")
+	allowHours := flag.String("allow-hours", "", "只在这些时间段内接受新连接,如 09:00-18:00,多个用逗号分隔,为空表示不限制")
+	allowHoursClose := flag.Bool("allow-hours-close", false, "离开 -allow-hours 的时间段时断开现有连接,默认只拒绝新连接")
+	tz := flag.String("tz", "", "-allow-hours 使用的 IANA 时区,如 Asia/Shanghai,默认使用本地时区")
+	handshakeTimeout := flag.Duration("handshake-timeout", 10*time.Second, "从建立连接到读完 ClientHello 或 HTTP 请求头的最长时间,超时即断开,0 表示不限制")
+	maxHeaderBytes := flag.Int("max-header-bytes", 64*1024, "非TLS请求的请求行加请求头的最大字节数,超过即返回 431 并断开,0 表示不限制")
+	dialTimeout := flag.Duration("dial-timeout", 10*time.Second, "连接转发目标的超时时间")
+	keepAlive := flag.Duration("keepalive", 30*time.Second, "客户端与后端 TCP 连接的 keepalive 探测间隔,0 表示关闭 keepalive")
+	noDelay := flag.Bool("nodelay", true, "对客户端与后端 TCP 连接开启 TCP_NODELAY,批量传输场景可用 -nodelay=false 关闭以提升吞吐")
+	maxConns := flag.Int("max-conns", 0, "最大并发连接数,0 表示不限制")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "单个源 IP 的最大并发连接数,0 表示不限制")
+	workers := flag.Int("workers", 0, "用固定数量的 worker 处理连接,每个 worker 同一时间处理一个连接,0 表示每个连接一个 goroutine")
+	workerQueue := flag.Int("worker-queue", 0, "开启 -workers 时等待 worker 的连接数上限,队列满时拒绝新连接,0 表示与 -workers 相同")
+	ratePerIP := flag.Float64("rate-per-ip", 0, "每个源 IP 每秒允许的新连接数,0 表示不限制")
+	rateLimit := flag.String("rate-limit", "", "单连接每个方向的带宽上限,如 512KB、10MB,为空表示不限速")
+	bufferSize := flag.Int("buffer-size", 32*1024, "每个转发方向使用的缓冲区大小(字节)")
+	dnsTTL := flag.Duration("dns-ttl", time.Minute, "后端主机名解析结果的缓存时间,后台按该间隔刷新,0 表示每次连接都重新解析")
+	healthInterval := flag.Duration("health-interval", 0, "后端健康检查间隔,0 表示不做健康检查")
+	healthFails := flag.Int("health-fails", 3, "健康检查连续失败多少次后把后端标记为 down")
+	healthTLS := flag.Bool("health-tls", false, "对 TLS 后端发送 ClientHello 探测而不只是 TCP 拨号")
+	minTLSVersion := flag.String("min-tls-version", "", "拒绝最高只支持低于该版本的 TLS 客户端,如 1.2,为空表示不限制")
+	allowNoSNI := flag.Bool("allow-no-sni", false, "放行合法但不带 SNI 的 TLS 连接到默认后端,默认只有 -domain 为 * 时才放行")
+	requireSNI := flag.Bool("require-sni", false, "拒绝所有不带 SNI 的 TLS 连接,即使 -domain 为 * 也拒绝,与 -allow-no-sni 互斥")
+	transparent := flag.Bool("transparent", false, "透明代理模式(仅 Linux):转发到 iptables REDIRECT 之前的原始目标地址,拿不到时回落到 -dst")
+	lb := flag.String("lb", "failover", "多个后端的选择策略: failover 按顺序故障转移,iphash 按客户端 IP 一致性哈希,同一客户端固定落到同一后端")
+	lbHashSNI := flag.Bool("lb-hash-sni", false, "-lb iphash 的哈希 key 除客户端 IP 外再加上 SNI/Host")
+	protocol := flag.String("protocol", "auto", "入站协议: auto 按首字节区分 TLS 与 HTTP,smtp 为 SMTP STARTTLS,在 STARTTLS 后按 SNI 过滤,socks5 为 SOCKS5 代理,按 CONNECT 目标过滤,connect 在 auto 基础上支持 HTTP CONNECT 正向代理")
+	mode := flag.String("mode", "", "-protocol 的别名,取值相同")
+	socksAuth := flag.String("socks-auth", "", "SOCKS5 用户名密码认证,格式 用户名:密码,多个用逗号分隔,为空时不要求认证")
+	udp := flag.Bool("udp", false, "同时在 -src 的地址上透传 UDP(如 DNS、QUIC),按源地址维护会话,只做 CIDR 白名单判断")
+	udpDst := flag.String("udp-dst", "", "UDP 转发目标 IP 和端口,为空时使用 TLS 后端的第一个地址")
+	udpIdleTimeout := flag.Duration("udp-idle-timeout", time.Minute, "UDP 会话两个方向都无数据超过该时长即关闭")
+	bindIPFlag := flag.String("bind-ip", "", "出站连接绑定的本地出口 IP,为空时由系统选择")
+	bindRouteList := flag.String("bind-route", "", "按 SNI/Host 选择出口 IP,格式 域名=IP,多个用逗号分隔,域名支持通配符*,未命中时使用 -bind-ip")
+	upstreamSOCKS := flag.String("upstream-socks", "", "出站连接经过的上游 SOCKS5 代理,格式 [socks5://][用户名:密码@]IP:端口,为空时直连")
+	sendProxy := flag.Bool("send-proxy", false, "向转发目标发送 PROXY protocol v1 头,传递真实客户端 IP")
+	acceptProxy := flag.Bool("accept-proxy", false, "解析入站 PROXY protocol v1/v2 头,按真实客户端 IP 做 CIDR 判断")
+	proxyFrom := flag.String("proxy-from", "127.0.0.0/8,::1/128", "开启 -accept-proxy 时允许发送 PROXY 头的对端 IP 范围 (CIDR),多个范围用逗号分隔,其余对端发来的连接直接拒绝")
+	routeList := flag.String("route", "", "按 SNI 选择后端,格式 域名=IP:端口,多个用逗号分隔,域名支持通配符*,未命中时使用 -dst")
+	routeFile := flag.String("route-file", "", "从文件加载 SNI 路由,每行 域名模式 -> 后端,按最具体的模式优先匹配,在 -route 之后匹配,SIGHUP 时重新加载")
+	alpnRouteList := flag.String("alpn-route", "", "按 ALPN 协议选择后端,格式 协议=IP:端口,多个用逗号分隔,SNI 路由优先")
+	sigRouteList := flag.String("sig-route", "", "按首包字节签名选择后端,格式 偏移:匹配=IP:端口,匹配以 hex: 开头时按十六进制解析,多个用逗号分隔,如 0:SSH-=127.0.0.1:22")
+	defaultDst := flag.String("default-dst", "", "SNI/ALPN 路由都未命中时的 TLS 兜底后端,为空时使用 -dst")
+	defaultDstAnyDomain := flag.Bool("default-dst-any-domain", false, "不在 -domain 白名单内的 SNI 也转发到 -default-dst 而不是拒绝")
+	ja3AllowFile := flag.String("ja3-allow", "", "JA3 指纹白名单文件,每行一个 JA3 MD5,设置后只放行列表中的客户端")
+	ja3DenyFile := flag.String("ja3-deny", "", "JA3 指纹黑名单文件,每行一个 JA3 MD5,命中即拒绝,优先于 -ja3-allow 和 -domain")
+	denyBody := flag.String("deny-body", "403 Forbidden\n", "拒绝非TLS请求时返回的 403 响应正文")
+	xff := flag.Bool("xff", false, "转发非TLS请求前把客户端 IP 追加到 X-Forwarded-For 并设置 X-Real-IP")
+	allowPath := flag.String("allow-path", "", "非TLS请求允许的路径前缀列表,用逗号分隔,如 /api/,/static/,为空时不限制")
+	allowMethod := flag.String("allow-method", "", "非TLS请求允许的方法列表,用逗号分隔,如 GET,POST,为空时不限制")
+	strictHTTP := flag.Bool("strict-http", false, "逐个解析 keep-alive 连接上的非TLS请求并校验 Host,任一请求不合规即断开")
+	tlsTerminate := flag.Bool("tls-terminate", false, "用 -cert/-key 或 -cert-dir 的证书终止 TLS,解密后按 HTTP 处理并转发到非TLS后端")
+	certFile := flag.String("cert", "", "-tls-terminate 使用的 PEM 证书文件,可以包含中间证书")
+	keyFile := flag.String("key", "", "-tls-terminate 使用的 PEM 私钥文件")
+	certDir := flag.String("cert-dir", "", "-tls-terminate 按 SNI 选择证书的目录,每套证书为同名的 .crt 与 .key 文件,没有匹配时使用 -cert")
+	backendTLS := flag.Bool("backend-tls", false, "以 TLS 连接非TLS后端(含 -tls-terminate 解密后的请求),可配合 -backend-cert/-backend-key 实现 mTLS")
+	backendCert := flag.String("backend-cert", "", "-backend-tls 出示给后端的 PEM 客户端证书")
+	backendKey := flag.String("backend-key", "", "-backend-tls 客户端证书的 PEM 私钥")
+	backendCA := flag.String("backend-ca", "", "-backend-tls 校验后端证书的 PEM CA 文件,默认使用系统根证书")
+	backendServerName := flag.String("backend-server-name", "", "-backend-tls 发送的 SNI 和校验后端证书的主机名,默认取后端地址中的主机名")
+	rewriteHost := flag.String("rewrite-host", "", "转发非TLS请求前把 Host 头和请求行中的主机改写为该值,为空时原样转发")
+	statsdAddr := flag.String("statsd-addr", "", "statsd 服务地址(UDP),如 127.0.0.1:8125,周期性推送指标,可与 -metrics-addr 同时使用,为空时不推送")
+	statsdPrefix := flag.String("statsd-prefix", "securetcprelay", "statsd 指标名的前缀")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "推送 statsd 指标的间隔")
+	metricsAddr := flag.String("metrics-addr", "", "Prometheus 指标服务监听地址,如 127.0.0.1:9100,为空时不启动")
+	banThreshold := flag.Int("ban-threshold", 0, "源 IP 在 -ban-window 内被拒绝达到该次数后临时封禁,0 表示不封禁")
+	banWindow := flag.Duration("ban-window", time.Minute, "统计被拒绝次数的滑动时间窗口")
+	banDuration := flag.Duration("ban-duration", 10*time.Minute, "封禁时长,期间该 IP 的连接直接关闭")
+	banFile := flag.String("ban-file", "", "封禁列表持久化文件,重启后恢复尚未到期的封禁,为空时只保存在内存中")
+	accessLogPath := flag.String("access-log", "", "访问日志文件路径,按类似 nginx combined 的格式每个请求写一行,为空时不记录")
+	rdns := flag.Bool("rdns", false, "对放行的连接在后台反向解析客户端 IP,结果(PTR)附加到连接关闭日志的 rdns 字段,带超时和缓存,不阻塞转发")
+	webhookURL := flag.String("webhook-url", "", "连接建立和关闭时异步 POST JSON 事件的地址,为空时不发送")
+	otelEndpoint := flag.String("otel-endpoint", "", "OTLP/HTTP collector 地址(如 http://127.0.0.1:4318),为每个连接导出 trace span,为空时不启用")
+	adminToken := flag.String("admin-token", "", "管理服务除 /healthz、/readyz 以外的接口要求的 Bearer token,为空时不校验,但 -admin-addr 不是回环地址时只允许查询")
+	adminAddr := flag.String("admin-addr", "", "管理服务监听地址,提供 /healthz 存活探针、/readyz 就绪探针、/maintenance 维护模式开关和 /connections 连接查询,为空时不启动")
+	reusePort := flag.Bool("reuseport", false, "用 SO_REUSEPORT 在同一端口上按 GOMAXPROCS 开多个 listener 并行 accept,也允许新进程在旧进程退出前绑定同一端口,只支持 Linux")
+	systemd := flag.Bool("systemd", false, "以 systemd Type=notify 服务运行:就绪后发送 READY=1,排空关闭时发送 STOPPING=1,开启看门狗时定期发送 WATCHDOG=1,非 Linux 下忽略")
+	pprofAddr := flag.String("pprof-addr", "", "pprof 调试服务监听地址,如 127.0.0.1:6060,为空时不启动,不要暴露到公网")
+	logFormat := flag.String("log-format", "text", "日志格式: text 或 json")
+	logLevel := flag.String("log-level", "info", "日志级别: debug、info、warn 或 error")
+	logFile := flag.String("log-file", "", "日志文件路径,为空时输出到 stderr")
+	logMaxSize := flag.Int("log-max-size", 100, "日志文件超过该大小(MB)后轮转,0 表示不轮转")
+	logMaxBackups := flag.Int("log-max-backups", 3, "轮转后保留的旧日志文件个数,0 表示不保留")
+	configFile := flag.String("config", "", "配置文件路径,按后缀 .yaml/.yml、.toml 或 .json 选择格式,键名与命令行参数相同,命令行参数和环境变量优先")
+	showVersion := flag.Bool("version", false, "打印版本号、commit 和构建时间后退出")
+	check := flag.Bool("check", false, "只解析并校验命令行参数和配置文件,不监听端口,校验通过时以 0 退出,否则以 1 退出")
 	flag.Parse()
 
-	// 解析多个 CIDR 范围
-	allowedNets := []*net.IPNet{}
-	for _, cidr := range strings.Split(*cidrs, ",") {
-		_, allowedNet, err := net.ParseCIDR(cidr)
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	// 环境变量只填充命令行没有显式指定的参数,配置文件再填充两者都没有设置的参数。
+	// sources 记录每个参数的取值来源,未出现的参数使用默认值
+	sources := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) { sources[f.Name] = "flag" })
+	envNames, err := applyEnv(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("无法解析环境变量: %v", err)
+	}
+	for _, name := range envNames {
+		sources[name] = "env"
+	}
+	// -mode 是 -protocol 的别名,按命令行或环境变量中的 -protocol 处理,优先于配置文件
+	if *mode != "" {
+		if sources["protocol"] != "" && *protocol != *mode {
+			log.Fatalf("-mode %s 与 -protocol %s 不一致", *mode, *protocol)
+		}
+		flag.Set("protocol", *mode)
+		sources["protocol"] = sources["mode"]
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var fileCfg *fileConfig
+	if *configFile != "" {
+		var err error
+		fileCfg, err = loadConfigFile(*configFile)
 		if err != nil {
-			log.Fatalf("无法解析 CIDR: %v", err)
+			log.Fatalf("无法加载配置文件: %v", err)
+		}
+		if err := fileCfg.applyTo(flag.CommandLine); err != nil {
+			log.Fatalf("无法加载配置文件: %v", err)
 		}
-		allowedNets = append(allowedNets, allowedNet)
+		flag.Visit(func(f *flag.Flag) {
+			if sources[f.Name] == "" {
+				sources[f.Name] = "config"
+			}
+		})
 	}
 
-	// 解析允许的域名列表
-	allowedDomains := strings.Split(*domainList, ",")
+	// 指定 -log-file 时写入按大小轮转的文件,否则输出到 stderr
+	var logOutput io.Writer = os.Stderr
+	if *logFile != "" {
+		if *logMaxSize < 0 || *logMaxBackups < 0 {
+			log.Fatal("-log-max-size 和 -log-max-backups 不能为负数")
+		}
+		f, err := openRotatingFile(*logFile, int64(*logMaxSize)<<20, *logMaxBackups)
+		if err != nil {
+			log.Fatalf("无法打开日志文件: %v", err)
+		}
+		logOutput = f
+	}
+	logger, err := newLogger(*logFormat, *logLevel, logOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	ver, rev, built := buildInfo()
+	logger.Info("SecureTCPRelay 启动", "event", "start", "version", ver, "commit", rev, "build_time", built, "go", runtime.Version())
+	logEffectiveConfig(logger, sources, fileCfg)
 
-	// 解析多个目标地址
-	destAddrs := strings.Split(*forwardAddrs, ",")
+	// 解析多个 CIDR 范围
+	allowedNets, err := parseCIDRs(strings.Split(*cidrs, ","))
+	if err != nil {
+		fatal("无法解析 CIDR", "error", err)
+	}
+	deniedNets, err := parseCIDRs(splitList(*denyCIDRs))
+	if err != nil {
+		fatal("无法解析 -deny-cidr", "error", err)
+	}
+	proxyNets, err := parseCIDRs(splitList(*proxyFrom))
+	if err != nil {
+		fatal("无法解析 -proxy-from", "error", err)
+	}
 
-	// 监听本地地址
-	listener, err := net.Listen("tcp", *localAddr)
+	// 合并 -domain 与域名文件
+	domains, err := allowedDomains(*domainList, isFlagSet("domain"), *domainFile)
 	if err != nil {
-		log.Fatalf("无法监听 %s: %v", *localAddr, err)
+		fatal("无法加载域名文件", "error", err)
 	}
-	defer listener.Close()
-	log.Printf("正在监听 %s 并转发到 %v", *localAddr, destAddrs)
 
-	for {
-		// 接受客户端连接
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("接受连接时发生错误: %v", err)
-			continue
-		}
+	// 加载 JA3 指纹黑白名单
+	ja3Allow, err := loadJA3File(*ja3AllowFile)
+	if err != nil {
+		fatal("无法加载 JA3 白名单", "error", err)
+	}
+	ja3Deny, err := loadJA3File(*ja3DenyFile)
+	if err != nil {
+		fatal("无法加载 JA3 黑名单", "error", err)
+	}
 
-		// 检查来源IP是否在白名单内
-		clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	// 解析单连接带宽上限
+	var rateLimitBytes int64
+	if *rateLimit != "" {
+		rateLimitBytes, err = parseByteSize(*rateLimit)
 		if err != nil {
-			log.Printf("无法解析客户端地址: %v", err)
-			conn.Close()
-			continue
+			fatal("无法解析 -rate-limit", "error", err)
 		}
+	}
 
-		clientIPAddr := net.ParseIP(clientIP)
-		allowed := false
-		for _, allowedNet := range allowedNets {
-			if allowedNet.Contains(clientIPAddr) {
-				allowed = true
-				break
-			}
-		}
+	// 解析 SNI 路由表
+	sniRoutes, err := parseRoutes(*routeList)
+	if err != nil {
+		fatal("无法解析 SNI 路由", "error", err)
+	}
 
-		if !allowed {
-			log.Printf("拒绝访问: IP %s 不在允许的范围内 (%s)", clientIP, *cidrs)
-			conn.Close()
-			continue
+	fileRoutes, err := loadRouteFile(*routeFile)
+	if err != nil {
+		fatal("无法加载路由文件", "error", err)
+	}
+
+	// 解析 ALPN 路由表
+	alpnRoutes, err := parseRoutes(*alpnRouteList)
+	if err != nil {
+		fatal("无法解析 ALPN 路由", "error", err)
+	}
+
+	var webhook *webhookNotifier
+	metrics := newMetrics()
+	if *webhookURL != "" {
+		webhook = newWebhookNotifier(*webhookURL, *dialTimeout, logger, metrics)
+	}
+	var statsd *statsdReporter
+	if *statsdAddr != "" {
+		if *statsdInterval <= 0 {
+			fatal("-statsd-interval 必须大于 0")
+		}
+		if statsd, err = newStatsdReporter(*statsdAddr, *statsdPrefix, logger); err != nil {
+			fatal("-statsd-addr 配置错误", "error", err)
 		}
+	}
+	var tracer *otelExporter
+	if *otelEndpoint != "" {
+		if tracer, err = newOtelExporter(*otelEndpoint, *dialTimeout, logger, metrics); err != nil {
+			fatal("-otel-endpoint 配置错误", "error", err)
+		}
+	}
 
-		// 增加活跃连接数
-		atomic.AddInt32(&activeConnections, 1)
-		log.Printf("允许访问: IP %s 在允许的范围内 (%s)", clientIP, *cidrs)
-		log.Printf("新连接建立，当前活跃连接数: %d", atomic.LoadInt32(&activeConnections))
+	var accessLogger *accessLog
+	if *accessLogPath != "" {
+		accessLogger, err = openAccessLog(*accessLogPath)
+		if err != nil {
+			fatal("无法打开访问日志", "error", err)
+		}
+	}
 
-		// 处理连接
-		go handleConnection(conn, destAddrs, allowedDomains)
+	var rdnsResolver *rdnsResolver
+	if *rdns {
+		rdnsResolver = newRDNSResolver()
 	}
-}
 
-func handleConnection(conn net.Conn, destAddrs []string, allowedDomains []string) {
-	defer func() {
-		// 减少活跃连接数
-		atomic.AddInt32(&activeConnections, -1)
-		log.Printf("连接关闭，当前活跃连接数: %d", atomic.LoadInt32(&activeConnections))
-		conn.Close()
-	}()
+	var bans *banList
+	if *banThreshold > 0 {
+		bans, err = newBanList(*banThreshold, *banWindow, *banDuration, *banFile, logger)
+		if err != nil {
+			fatal("无法加载封禁列表", "error", err)
+		}
+		go bans.run()
+	}
+	maintenance := newMaintenanceMode(logger)
 
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+	// 解析签名路由表
+	sigRoutes, err := parseSignatureRoutes(*sigRouteList)
 	if err != nil {
-		log.Printf("读取连接数据时发生错误: %v", err)
-		return
+		fatal("无法解析签名路由", "error", err)
 	}
 
-	var forwardAddr string
-	if n > 0 && buf[0] == 0x16 { // 判断是否是TLS握手开始的第一个字节
-		// TLS 数据处理
-		if len(destAddrs) >= 2 {
-			forwardAddr = destAddrs[1] // 使用第二个地址
-		} else if len(destAddrs) == 1 {
-			forwardAddr = destAddrs[0] // 只有一个地址也可以使用
-		} else {
-			return
+	socksUsers, err := parseSOCKSUsers(*socksAuth)
+	if err != nil {
+		fatal("无法解析 SOCKS5 用户", "error", err)
+	}
+	bindIP, bindRoutes, err := parseBindFlags(*bindIPFlag, *bindRouteList, !*check)
+	if err != nil {
+		fatal("出口 IP 配置错误", "error", err)
+	}
+	if *allowNoSNI && *requireSNI {
+		fatal("-allow-no-sni 和 -require-sni 不能同时开启")
+	}
+	var minTLS uint16
+	if *minTLSVersion != "" {
+		if minTLS, err = parseTLSVersion(*minTLSVersion); err != nil {
+			fatal("-min-tls-version 配置错误", "error", err)
 		}
-		log.Printf("转发 TLS 数据到: %s", forwardAddr) // 显示转发地址
-		handleHTTPS(conn, forwardAddr, allowedDomains, buf[:n])
-	} else {
-		// HTTP 数据处理
-		if len(destAddrs) > 0 {
-			forwardAddr = destAddrs[0]                 // 使用第一个地址
-			log.Printf("转发 非TLS 数据到: %s", forwardAddr) // 显示转发地址
-			handleHTTP(conn, forwardAddr, allowedDomains, buf[:n])
-		} else {
-			return
+	}
+	// 证书在顶层加载一次,listener 可以各自决定是否开启 tls-terminate
+	var tlsConfig *tls.Config
+	var certs *certStore
+	if *certFile != "" || *keyFile != "" || *certDir != "" {
+		// 解密后按 HTTP/1.1 转发,不协商 h2
+		tlsConfig = &tls.Config{NextProtos: []string{"http/1.1"}, MinVersion: minTLS}
+		var fallback *tls.Certificate
+		if *certFile != "" || *keyFile != "" {
+			if *certFile == "" || *keyFile == "" {
+				fatal("-cert 和 -key 需要同时指定")
+			}
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				fatal("无法加载 TLS 证书", "error", err)
+			}
+			fallback = &cert
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if *certDir != "" {
+			if certs, err = newCertStore(*certDir, fallback, logger); err != nil {
+				fatal("无法加载证书目录", "error", err)
+			}
+			tlsConfig.GetCertificate = certs.getCertificate
+		}
+	}
+
+	var hours *timeWindows
+	if *allowHours != "" {
+		if hours, err = parseTimeWindows(*allowHours, *tz); err != nil {
+			fatal("-allow-hours 配置错误", "error", err)
 		}
 	}
-}
 
-func handleHTTP(conn net.Conn, forwardAddr string, allowedDomains []string, initialData []byte) {
-	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(initialData), conn))
-	req, err := http.ReadRequest(reader)
+	backendTLSConfig, err := loadBackendTLSConfig(*backendCert, *backendKey, *backendCA, *backendServerName)
 	if err != nil {
-		log.Printf("读取 HTTP 请求时发生错误: %v", err)
-		return
+		fatal("后端 TLS 配置错误", "error", err)
 	}
 
-	host := req.Host
-	if strings.Contains(host, ":") {
-		host, _, _ = net.SplitHostPort(host)
+	var upstream *socksUpstream
+	if *upstreamSOCKS != "" {
+		if upstream, err = parseSOCKSUpstream(*upstreamSOCKS); err != nil {
+			fatal("无法解析上游 SOCKS5 代理", "error", err)
+		}
 	}
 
-	if !isAllowedDomain(host, allowedDomains) {
-		log.Printf("拒绝访问: Host %s 不在允许的域名列表中", host)
-		return
+	baseCfg := Config{
+		ListenAddr:          *localAddr,
+		DestAddrs:           strings.Split(*forwardAddrs, ","),
+		PlainBackends:       splitList(*plainBackends),
+		TLSBackends:         splitList(*tlsBackends),
+		AllowedNets:         allowedNets,
+		DeniedNets:          deniedNets,
+		AllowedDomains:      domains,
+		DeniedDomains:       splitList(*denyDomainList),
+		SNIRoutes:           sniRoutes,
+		FileRoutes:          fileRoutes,
+		ALPNRoutes:          alpnRoutes,
+		SignatureRoutes:     sigRoutes,
+		DefaultDst:          *defaultDst,
+		DefaultDstAnyDomain: *defaultDstAnyDomain,
+		JA3Allow:            ja3Allow,
+		JA3Deny:             ja3Deny,
+		DrainTimeout:        *drainTimeout,
+		IdleTimeout:         *idleTimeout,
+		HalfCloseTimeout:    *halfCloseTimeout,
+		MaxConnLifetime:     *maxConnLifetime,
+		AllowHours:          hours,
+		AllowHoursClose:     *allowHoursClose,
+		HandshakeTimeout:    *handshakeTimeout,
+		MaxHeaderBytes:      *maxHeaderBytes,
+		DialTimeout:         *dialTimeout,
+		KeepAlive:           *keepAlive,
+		DisableNoDelay:      !*noDelay,
+		MaxConns:            *maxConns,
+		MaxConnsPerIP:       *maxConnsPerIP,
+		Workers:             *workers,
+		WorkerQueue:         *workerQueue,
+		RatePerIP:           *ratePerIP,
+		RateLimit:           rateLimitBytes,
+		BufferSize:          *bufferSize,
+		DNSTTL:              *dnsTTL,
+		HealthInterval:      *healthInterval,
+		HealthFailThreshold: *healthFails,
+		HealthTLS:           *healthTLS,
+		AllowNoSNI:          *allowNoSNI,
+		RequireSNI:          *requireSNI,
+		MinTLSVersion:       minTLS,
+		Protocol:            *protocol,
+		LoadBalance:         *lb,
+		LBHashSNI:           *lbHashSNI,
+		SOCKSUsers:          socksUsers,
+		UpstreamSOCKS:       upstream,
+		BindIP:              bindIP,
+		BindRoutes:          bindRoutes,
+		UDP:                 *udp,
+		UDPBackend:          *udpDst,
+		UDPIdleTimeout:      *udpIdleTimeout,
+		Webhook:             webhook,
+		Tracer:              tracer,
+		Statsd:              statsd,
+		Bans:                bans,
+		Maintenance:         maintenance,
+		AccessLog:           accessLogger,
+		RDNS:                rdnsResolver,
+		Transparent:         *transparent,
+		SendProxy:           *sendProxy,
+		AcceptProxy:         *acceptProxy,
+		ProxyFrom:           proxyNets,
+		DenyBody:            *denyBody,
+		RewriteHost:         *rewriteHost,
+		XFF:                 *xff,
+		StrictHTTP:          *strictHTTP,
+		ReusePort:           *reusePort,
+		AllowPaths:          splitList(*allowPath),
+		AllowMethods:        splitList(*allowMethod),
+		TLSTerminate:        *tlsTerminate,
+		TLSConfig:           tlsConfig,
+		TLSCerts:            certs,
+		BackendTLS:          *backendTLS,
+		BackendTLSConfig:    backendTLSConfig,
+		Logger:              logger,
+		Metrics:             metrics,
 	}
-	log.Printf("允许访问: Host %s 在允许的域名列表中", host)
 
-	// 建立与目标服务器的连接并转发数据
-	forwardConn, err := net.Dial("tcp", forwardAddr)
-	if err != nil {
-		log.Printf("无法连接到 %s: %v", forwardAddr, err)
-		return
+	// 配置文件定义了 listeners 时每个 listener 各起一个 Server,否则 -src 中的每个地址各起一个,
+	// 它们共享指标与日志,其余配置相同
+	var cfgs []Config
+	if fileCfg != nil && len(fileCfg.Listeners) > 0 {
+		for i, l := range fileCfg.Listeners {
+			cfg, err := l.listenerConfig(baseCfg)
+			if err != nil {
+				fatal("无法解析 listener 配置", "listener", i, "error", err)
+			}
+			// conn_id 在所有 listener 之间唯一,日志里另外带上监听地址,便于按 listener 过滤
+			cfg.Logger = logger.With("listener", cfg.ListenAddr)
+			cfgs = append(cfgs, cfg)
+		}
+	} else {
+		srcs := strings.Split(*localAddr, ",")
+		for _, src := range srcs {
+			cfg := baseCfg
+			cfg.ListenAddr = src
+			if len(srcs) > 1 {
+				cfg.Logger = logger.With("listener", src)
+			}
+			cfgs = append(cfgs, cfg)
+		}
 	}
-	defer forwardConn.Close()
 
-	// 将初始数据发送给目标服务器
-	_, err = forwardConn.Write(initialData)
-	if err != nil {
-		log.Printf("向目标服务器发送初始数据时出错: %v", err)
+	// -check 到这里为止所有参数都已解析成功,再做地址与域名模式的静态校验后退出
+	if *check {
+		problems := checkConfigs(cfgs, map[string]string{"metrics-addr": *metricsAddr, "admin-addr": *adminAddr, "pprof-addr": *pprofAddr})
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "配置错误:", p)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("配置检查通过: %d 个 listener\n", len(cfgs))
 		return
 	}
 
-	// 开始双向数据转发
-	handleTCPForward(conn, forwardConn)
-}
+	// 启动前校验全部后端地址并解析主机名,有问题直接退出,而不是等每个连接拨号时再逐个报错
+	if problems := checkBackends(cfgs, *dialTimeout); len(problems) > 0 {
+		for _, p := range problems {
+			logger.Error("转发目标地址错误", "event", "config_error", "problem", p)
+		}
+		os.Exit(1)
+	}
 
-func handleHTTPS(conn net.Conn, forwardAddr string, allowedDomains []string, initialData []byte) {
-	// 读取 TLS ClientHello 消息
-	clientHello, err := readClientHello(initialData)
-	if err != nil {
-		log.Printf("读取 ClientHello 时发生错误: %v", err)
-		return
+	var servers []*Server
+	for _, cfg := range cfgs {
+		srv, err := NewServer(cfg)
+		if err != nil {
+			if *skipFailedSrc && len(cfgs) > 1 {
+				logger.Error("监听失败，跳过该地址", "event", "listen_error", "src", cfg.ListenAddr, "error", err)
+				continue
+			}
+			fatal("启动失败", "src", cfg.ListenAddr, "error", err)
+		}
+		servers = append(servers, srv)
+	}
+	if len(servers) == 0 {
+		fatal("启动失败: 所有监听地址都无法监听", "src", *localAddr)
 	}
 
-	// 验证 SNI
-	sni := clientHello.ServerName
-	if !isAllowedDomain(sni, allowedDomains) {
-		log.Printf("拒绝访问: SNI %s 不在允许的域名列表中", sni)
-		return
+	// 指标服务独立监听,只暴露 /metrics
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", MetricsHandler(servers...))
+		go func() {
+			logger.Info("指标服务监听", "event", "listen", "metrics_addr", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				fatal("指标服务启动失败", "error", err)
+			}
+		}()
 	}
-	log.Printf("允许访问: SNI %s 在允许的域名列表中", sni)
 
-	// 建立与目标服务器的连接
-	forwardConn, err := net.Dial("tcp", forwardAddr)
-	if err != nil {
-		log.Printf("无法连接到 %s: %v", forwardAddr, err)
-		return
+	if statsd != nil {
+		logger.Info("推送 statsd 指标", "event", "statsd", "statsd_addr", *statsdAddr, "interval", *statsdInterval)
+		go statsd.run(servers, *statsdInterval)
 	}
-	defer forwardConn.Close()
 
-	// 将初始数据发送给目标服务器
-	_, err = forwardConn.Write(initialData)
-	if err != nil {
-		log.Printf("向目标服务器发送初始数据时出错: %v", err)
-		return
+	// 管理服务提供探活接口、维护模式开关、连接查询和域名白名单,排空或维护期间 /readyz 返回 503。
+	// 探针不校验 token,其余接口按 -admin-token 鉴权;没有 token 且监听的不是回环地址时只允许查询
+	if *adminAddr != "" {
+		readOnly := *adminToken == "" && !isLoopbackAddr(*adminAddr)
+		if readOnly {
+			logger.Warn("管理服务没有设置 -admin-token 且不只监听回环地址，修改白名单、断开连接和维护模式开关已禁用", "event", "admin_read_only", "admin_addr", *adminAddr)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", HealthzHandler(maintenance))
+		mux.Handle("/readyz", ReadyzHandler(servers...))
+		mux.Handle("/maintenance", requireToken(*adminToken, readOnly, MaintenanceHandler(maintenance)))
+		connections := requireToken(*adminToken, readOnly, ConnectionsHandler(servers...))
+		mux.Handle("/connections", connections)
+		mux.Handle("/connections/", connections)
+		domains := requireToken(*adminToken, readOnly, DomainsHandler(logger, servers...))
+		mux.Handle("/domains", domains)
+		mux.Handle("/domains/add", domains)
+		go func() {
+			logger.Info("管理服务监听", "event", "listen", "admin_addr", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, mux); err != nil {
+				fatal("管理服务启动失败", "error", err)
+			}
+		}()
 	}
 
-	// 开始双向数据转发
-	handleTCPForward(conn, forwardConn)
-}
+	// pprof 使用独立的 mux,不注册到 http.DefaultServeMux,避免意外暴露到指标端口
+	if *pprofAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go func() {
+			logger.Info("pprof 调试服务监听", "event", "listen", "pprof_addr", *pprofAddr)
+			if err := http.ListenAndServe(*pprofAddr, mux); err != nil {
+				fatal("pprof 调试服务启动失败", "error", err)
+			}
+		}()
+	}
 
-func handleTCPForward(clientConn, serverConn net.Conn) {
-	var wg sync.WaitGroup
-	wg.Add(2)
+	var notifier *systemdNotifier
+	if *systemd {
+		notifier = newSystemdNotifier(logger)
+	}
+
+	// 收到 SIGINT/SIGTERM 后停止接受新连接并排空现有连接
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		logger.Info("收到信号，停止接受新连接", "event", "signal", "signal", sig.String())
+		notifier.notify("STOPPING=1")
+		var wg sync.WaitGroup
+		for _, srv := range servers {
+			wg.Add(1)
+			go func(srv *Server) {
+				defer wg.Done()
+				srv.Shutdown()
+			}(srv)
+		}
+		wg.Wait()
+	}()
 
+	// 收到 SIGUSR1 时切换维护模式,Windows 上没有这个信号
+	usr1Ch := make(chan os.Signal, 1)
+	notifyMaintenanceSignal(usr1Ch)
 	go func() {
-		defer wg.Done()
-		io.Copy(serverConn, clientConn)
-		serverConn.(*net.TCPConn).CloseWrite()
+		for range usr1Ch {
+			maintenance.toggle("signal")
+		}
 	}()
 
+	// 收到 SIGHUP 后重新读取配置文件与域名文件中的白名单,失败时保留旧规则
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
 	go func() {
-		defer wg.Done()
-		io.Copy(clientConn, serverConn)
-		clientConn.(*net.TCPConn).CloseWrite()
+		for range hupCh {
+			if certs != nil {
+				if err := certs.reload(); err != nil {
+					logger.Error("重载证书目录失败，继续使用旧证书", "event", "reload", "error", err)
+				}
+			}
+			if *configFile == "" && *domainFile == "" && *ja3AllowFile == "" && *ja3DenyFile == "" && *routeFile == "" {
+				if certs == nil {
+					logger.Warn("未指定 -config、-domain-file、-route-file、JA3 文件或 -cert-dir，忽略 SIGHUP", "event", "reload")
+				}
+				continue
+			}
+			if err := reloadAccessRules(servers, *configFile, explicit); err != nil {
+				logger.Error("重载配置失败，继续使用旧规则", "event", "reload", "error", err)
+			}
+		}
 	}()
 
+	// 每个 listener 有独立的 Accept 循环,全部排空后退出
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *Server) {
+			defer wg.Done()
+			if err := srv.Serve(context.Background()); err != nil {
+				fatal("服务异常退出", "src", srv.cfg.ListenAddr, "error", err)
+			}
+		}(srv)
+	}
+	// 监听 socket 在 NewServer 中已经绑定,此时连接不会被拒绝
+	notifier.notify("READY=1")
+	go notifier.runWatchdog()
 	wg.Wait()
+	logger.Info("程序退出", "event", "exit")
 }
 
-func isAllowedDomain(host string, allowedDomains []string) bool {
-	if len(allowedDomains) == 1 && allowedDomains[0] == "*" {
-		return true
+// newLogger 按日志格式和级别创建输出到 stderr 的 logger
+func newLogger(format, level string, w io.Writer) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("未知的日志级别: %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("未知的日志格式: %s", format)
 	}
+}
 
-	for _, pattern := range allowedDomains {
-		if matchDomain(host, pattern) {
-			return true
+// reloadAccessRules 重新读取配置文件与域名文件并替换白名单;命令行显式指定的参数依然优先,
+// 配置文件中删掉的配置项恢复为默认值
+func reloadAccessRules(servers []*Server, configPath string, explicit map[string]bool) error {
+	fileValues := map[string]string{}
+	var listeners []*fileConfig
+	if configPath != "" {
+		fileCfg, err := loadConfigFile(configPath)
+		if err != nil {
+			return err
 		}
+		fileValues = fileCfg.flagValues()
+		listeners = fileCfg.Listeners
+	}
+	value := func(name string) string {
+		f := flag.Lookup(name)
+		if explicit[name] {
+			return f.Value.String()
+		}
+		if v, ok := fileValues[name]; ok {
+			return v
+		}
+		return f.DefValue
 	}
 
-	return false
-}
-
-func matchDomain(host, pattern string) bool {
-	regexPattern := strings.Replace(pattern, ".", "\\.", -1)
-	regexPattern = strings.Replace(regexPattern, "*", ".*", -1)
-	regexPattern = "^" + regexPattern + "$"
+	cidrs := strings.Split(value("cidr"), ",")
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	deniedNets, err := parseCIDRs(splitList(value("deny-cidr")))
+	if err != nil {
+		return err
+	}
+	_, domainInFile := fileValues["domain"]
+	domains, err := allowedDomains(value("domain"), explicit["domain"] || domainInFile, value("domain-file"))
+	if err != nil {
+		return err
+	}
 
-	matched, err := regexp.MatchString(regexPattern, host)
+	ja3Allow, err := loadJA3File(value("ja3-allow"))
 	if err != nil {
-		log.Printf("域名匹配出错: %v", err)
-		return false
+		return err
+	}
+	ja3Deny, err := loadJA3File(value("ja3-deny"))
+	if err != nil {
+		return err
 	}
-	return matched
-}
 
-func readClientHello(data []byte) (*tls.ClientHelloInfo, error) {
-	reader := bytes.NewReader(data)
-	hello := &tls.ClientHelloInfo{}
+	fileRoutes, err := loadRouteFile(value("route-file"))
+	if err != nil {
+		return err
+	}
 
-	// 跳过 TLS 记录层头部
-	reader.Seek(5, io.SeekStart)
+	base := Config{AllowedNets: nets, DeniedNets: deniedNets, AllowedDomains: domains, DeniedDomains: splitList(value("deny-domain")), JA3Allow: ja3Allow, JA3Deny: ja3Deny, FileRoutes: fileRoutes}
 
-	// 读取 Handshake 消息类型
-	var handshakeType uint8
-	if err := binary.Read(reader, binary.BigEndian, &handshakeType); err != nil {
-		return nil, err
+	// 先算出所有 listener 的新规则,任何一个出错都不替换。新规则按监听地址对应到正在运行的 Server,
+	// 运行中的地址从配置里消失时需要重启进程;新增的地址(以及 -skip-failed-src 跳过的地址)不会被启动
+	cfgs := make(map[string]Config)
+	if len(listeners) > 0 {
+		for i, l := range listeners {
+			cfg, err := l.listenerConfig(base)
+			if err != nil {
+				return fmt.Errorf("listeners[%d]: %w", i, err)
+			}
+			cfgs[cfg.ListenAddr] = cfg
+		}
+	} else {
+		for _, src := range strings.Split(value("src"), ",") {
+			cfgs[src] = base
+		}
 	}
-
-	// 确保是 ClientHello 消息
-	if handshakeType != 1 {
-		return nil, fmt.Errorf("不是 ClientHello 消息")
+	for _, srv := range servers {
+		if _, ok := cfgs[srv.cfg.ListenAddr]; !ok {
+			return fmt.Errorf("监听地址 %s 已不在配置中,listener 发生变化,需要重启进程", srv.cfg.ListenAddr)
+		}
 	}
+	if len(cfgs) > len(servers) {
+		slog.Warn("配置中有未在运行的监听地址（新增或启动时被跳过），需要重启进程才会监听", "event", "reload", "configured", len(cfgs), "running", len(servers))
+	}
+	for _, srv := range servers {
+		cfg := cfgs[srv.cfg.ListenAddr]
+		srv.SetAccessRules(cfg.AllowedNets, cfg.DeniedNets, cfg.AllowedDomains, cfg.DeniedDomains)
+		srv.SetJA3Rules(cfg.JA3Allow, cfg.JA3Deny)
+		srv.SetFileRoutes(cfg.FileRoutes)
+		slog.Info("已重载白名单", "event", "reload", "src", srv.cfg.ListenAddr, "cidr", len(cfg.AllowedNets), "deny_cidr", len(cfg.DeniedNets), "domains", len(cfg.AllowedDomains), "denied_domains", cfg.DeniedDomains, "ja3_allow", len(cfg.JA3Allow), "ja3_deny", len(cfg.JA3Deny), "file_routes", len(cfg.FileRoutes))
+	}
+	return nil
+}
 
-	// 跳过 Handshake 消息长度
-	reader.Seek(3, io.SeekCurrent)
+// allowedDomains 合并 -domain 与域名文件;只指定了域名文件时不再使用 -domain 的默认值 *
+func allowedDomains(domainList string, domainSet bool, domainFile string) ([]string, error) {
+	var domains []string
+	if domainFile == "" || domainSet {
+		domains = strings.Split(domainList, ",")
+	}
+	if domainFile != "" {
+		fileDomains, err := loadListFile(domainFile)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, fileDomains...)
+	}
+	return domains, nil
+}
 
-	// 跳过协议版本和随机数
-	reader.Seek(34, io.SeekCurrent)
+// isFlagSet 判断参数是否由命令行或配置文件显式设置
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-	// 跳过 Session ID
-	var sessionIDLength uint8
-	binary.Read(reader, binary.BigEndian, &sessionIDLength)
-	reader.Seek(int64(sessionIDLength), io.SeekCurrent)
+// parseCIDRs 解析 CIDR 列表
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
 
-	// 跳过密码套件
-	var cipherSuitesLength uint16
-	binary.Read(reader, binary.BigEndian, &cipherSuitesLength)
-	reader.Seek(int64(cipherSuitesLength), io.SeekCurrent)
+// logEffectiveConfig 打印合并命令行、环境变量与配置文件后最终生效的全部参数,每个参数一组:
+// value 为脱敏后的取值,source 为来源(flag、env、config,sources 中没有的为 default)。
+// 配置文件定义了 listeners 时每个 listener 另打一条,只列出它覆盖的配置项
+func logEffectiveConfig(logger *slog.Logger, sources map[string]string, fileCfg *fileConfig) {
+	args := []any{"event", "config"}
+	flag.VisitAll(func(f *flag.Flag) {
+		source := sources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		args = append(args, slog.Group(f.Name, "value", redactFlagValue(f.Name, f.Value.String()), "source", source))
+	})
+	logger.Info("生效配置", args...)
 
-	// 跳过压缩方法
-	var compressionMethodsLength uint8
-	binary.Read(reader, binary.BigEndian, &compressionMethodsLength)
-	reader.Seek(int64(compressionMethodsLength), io.SeekCurrent)
+	if fileCfg == nil {
+		return
+	}
+	for i, l := range fileCfg.Listeners {
+		values := l.flagValues()
+		args := []any{"event", "config_listener", "index", i}
+		for _, name := range slices.Sorted(maps.Keys(values)) {
+			args = append(args, name, redactFlagValue(name, values[name]))
+		}
+		logger.Info("listener 生效配置", args...)
+	}
+}
 
-	// 读取扩展部分
-	var extensionsLength uint16
-	if err := binary.Read(reader, binary.BigEndian, &extensionsLength); err != nil {
-		return nil, err
+// redactFlagValue 隐去参数取值中的密码、token 和 URL 里的凭据
+func redactFlagValue(name, value string) string {
+	switch name {
+	case "socks-auth":
+		return redactSOCKSAuth(value)
+	case "admin-token":
+		if value != "" {
+			return "***"
+		}
+	case "upstream-socks":
+		if i := strings.LastIndex(value, "@"); i >= 0 {
+			userinfo := strings.TrimPrefix(value[:i], "socks5://")
+			return value[:i-len(userinfo)] + redactSOCKSAuth(userinfo) + value[i:]
+		}
+	case "webhook-url", "otel-endpoint":
+		// 回调地址常把 token 放在 userinfo 或查询参数里
+		if u, err := url.Parse(value); err == nil && (u.User != nil || u.RawQuery != "") {
+			if u.RawQuery != "" {
+				u.RawQuery = "***"
+			}
+			if u.User == nil {
+				return u.String()
+			}
+			u.User = nil
+			scheme, rest, _ := strings.Cut(u.String(), "://")
+			return scheme + "://***@" + rest
+		}
 	}
+	return value
+}
 
-	extensionsData := make([]byte, extensionsLength)
-	if _, err := io.ReadFull(reader, extensionsData); err != nil {
-		return nil, err
+// parseBindFlags 解析 -bind-ip 与 -bind-route。probe 为 true 时还确认其中每个 IP 都能在本机绑定,
+// -check 在 CI 等其它机器上运行时只校验格式
+func parseBindFlags(bindIP, bindRoutes string, probe bool) (net.IP, []Route, error) {
+	parse := func(s string) (net.IP, error) {
+		if probe {
+			return parseBindIP(s)
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("无效的出口 IP %q", s)
 	}
 
-	// 解析扩展以查找 SNI
-	for len(extensionsData) > 4 {
-		extensionType := binary.BigEndian.Uint16(extensionsData[:2])
-		extensionLength := binary.BigEndian.Uint16(extensionsData[2:4])
-		extensionData := extensionsData[4 : 4+extensionLength]
+	var ip net.IP
+	if bindIP != "" {
+		var err error
+		if ip, err = parse(bindIP); err != nil {
+			return nil, nil, err
+		}
+	}
+	routes, err := parseRoutes(bindRoutes)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, route := range routes {
+		if _, err := parse(route.Addr); err != nil {
+			return nil, nil, fmt.Errorf("出口路由 %s: %w", route.Pattern, err)
+		}
+	}
+	return ip, routes, nil
+}
 
-		if extensionType == 0 { // Server Name Indication
-			if len(extensionData) > 2 {
-				listLength := binary.BigEndian.Uint16(extensionData[:2])
-				nameList := extensionData[2 : 2+listLength]
-				if len(nameList) > 3 {
-					nameType := nameList[0]
-					if nameType == 0 { // host_name
-						nameLength := binary.BigEndian.Uint16(nameList[1:3])
-						if len(nameList) >= int(3+nameLength) {
-							hello.ServerName = string(nameList[3 : 3+nameLength])
-							return hello, nil
-						}
-					}
-				}
-			}
+// redactSOCKSAuth 隐去 用户名:密码 列表中的密码,只保留用户名
+func redactSOCKSAuth(spec string) string {
+	items := splitList(spec)
+	for i, item := range items {
+		if user, _, ok := strings.Cut(item, ":"); ok {
+			items[i] = user + ":***"
 		}
+	}
+	return strings.Join(items, ",")
+}
 
-		extensionsData = extensionsData[4+extensionLength:]
+// splitList 按逗号拆分参数,空字符串返回 nil
+func splitList(s string) []string {
+	if s == "" {
+		return nil
 	}
+	return strings.Split(s, ",")
+}
 
-	return hello, nil
+// fatal 记录错误日志后退出
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// maintenanceMode 是多个 Server 共享的维护模式开关。开启后新连接在识别协议后被拒绝:
+// HTTP 返回 503,TLS 返回 alert,已建立的连接不受影响
+type maintenanceMode struct {
+	on     atomic.Bool
+	logger *slog.Logger
+}
+
+func newMaintenanceMode(logger *slog.Logger) *maintenanceMode {
+	return &maintenanceMode{logger: logger}
+}
+
+func (m *maintenanceMode) enabled() bool {
+	return m != nil && m.on.Load()
+}
+
+// set 切换维护模式,状态有变化时记录日志。source 表示切换来源,如 signal、admin
+func (m *maintenanceMode) set(on bool, source string) {
+	if m.on.Swap(on) == on {
+		return
+	}
+	if on {
+		m.logger.Warn("进入维护模式，拒绝新连接", "event", "maintenance", "maintenance", true, "source", source)
+	} else {
+		m.logger.Info("退出维护模式，恢复接受新连接", "event", "maintenance", "maintenance", false, "source", source)
+	}
+}
+
+func (m *maintenanceMode) toggle(source string) {
+	m.set(!m.on.Load(), source)
+}
+
+// MaintenanceHandler 提供维护模式开关:GET 返回当前状态,POST 切换状态,
+// 带 ?on=true 或 ?on=false 时设为指定状态
+func MaintenanceHandler(m *maintenanceMode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			if v := r.URL.Query().Get("on"); v != "" {
+				on, err := strconv.ParseBool(v)
+				if err != nil {
+					http.Error(w, "on 参数应为 true 或 false", http.StatusBadRequest)
+					return
+				}
+				m.set(on, "admin")
+			} else {
+				m.toggle("admin")
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "maintenance: %v\n", m.enabled())
+	})
+}
+
+// rejectMaintenance 在维护模式下按协议回应并关闭新连接:HTTP 返回 503,TLS 返回 alert,
+// SMTP 返回 421,SOCKS5 直接关闭。维护模式不是客户端的错误,不计入自动封禁
+func (s *Server) rejectMaintenance(sess *session, initialData []byte) {
+	sess.logger.Warn("拒绝访问: 维护模式", "event", "reject", "reason", rejectMaintenance)
+	s.reject(sess, rejectMaintenance)
+
+	conn := sess.conn
+	switch {
+	case s.cfg.Protocol == protocolSMTP:
+		fmt.Fprintf(conn, "421 4.3.2 Service not available, maintenance\r\n")
+	case s.cfg.Protocol == protocolSOCKS5:
+	case len(initialData) > 0 && initialData[0] == 0x16:
+		writeTLSAlert(conn, tlsAlertInternalError)
+	default:
+		body := "maintenance\n"
+		fmt.Fprintf(conn, "HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+		sess.status = http.StatusServiceUnavailable
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var domainPatternCache sync.Map // 域名模式 -> 编译好的 *regexp.Regexp
+
+// Route 把匹配 Pattern 的 SNI(或 ALPN 协议)转发到 Addr
+type Route struct {
+	Pattern string
+	Addr    string
+}
+
+// parseRoutes 解析 "a.com=1.1.1.1:443,b.com=2.2.2.2:443" 形式的路由表
+func parseRoutes(spec string) ([]Route, error) {
+	var routes []Route
+	if spec == "" {
+		return routes, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		pattern, addr, ok := strings.Cut(item, "=")
+		if !ok || pattern == "" || addr == "" {
+			return nil, fmt.Errorf("路由格式错误: %q", item)
+		}
+		routes = append(routes, Route{Pattern: pattern, Addr: addr})
+	}
+	return routes, nil
+}
+
+// loadRouteFile 从文件加载 SNI 路由,每行 "域名模式 -> 后端",支持 # 注释和通配符 *,
+// 加载后按 sortRoutesBySpecificity 排序。也接受与 -route 相同的 "域名模式=后端" 写法
+func loadRouteFile(path string) ([]Route, error) {
+	if path == "" {
+		return nil, nil
+	}
+	lines, err := loadListFile(path)
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]Route, 0, len(lines))
+	for _, line := range lines {
+		pattern, addr, ok := strings.Cut(line, "->")
+		if !ok {
+			pattern, addr, ok = strings.Cut(line, "=")
+		}
+		pattern, addr = strings.TrimSpace(pattern), strings.TrimSpace(addr)
+		if !ok || pattern == "" || addr == "" {
+			return nil, fmt.Errorf("%s: 路由格式错误: %q,应为 \"域名模式 -> 后端\"", path, line)
+		}
+		if err := checkDomainPattern(pattern); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := validateBackendAddr(addr); err != nil {
+			return nil, fmt.Errorf("%s: 路由 %q: %w", path, pattern, err)
+		}
+		routes = append(routes, Route{Pattern: pattern, Addr: addr})
+	}
+	sortRoutesBySpecificity(routes)
+	return routes, nil
+}
+
+// sortRoutesBySpecificity 把路由按具体程度从高到低稳定排序,lookupRoute 取第一个命中的即为最具体的路由:
+// 精确域名优先于通配;通配之间标签多的优先(*.a.example.com 优先于 *.example.com);
+// 标签数相同时非通配字符多的优先(api-*.example.com 优先于 *.example.com);都相同时保持文件中的顺序
+func sortRoutesBySpecificity(routes []Route) {
+	specificity := func(pattern string) (wildcard bool, labels, literal int) {
+		pattern = normalizeDomain(pattern)
+		return strings.Contains(pattern, "*"), strings.Count(pattern, ".") + 1, len(pattern) - strings.Count(pattern, "*")
+	}
+	slices.SortStableFunc(routes, func(a, b Route) int {
+		aWild, aLabels, aLiteral := specificity(a.Pattern)
+		bWild, bLabels, bLiteral := specificity(b.Pattern)
+		if aWild != bWild {
+			if aWild {
+				return 1
+			}
+			return -1
+		}
+		if c := cmp.Compare(bLabels, aLabels); c != 0 {
+			return c
+		}
+		return cmp.Compare(bLiteral, aLiteral)
+	})
+}
+
+// lookupRoute 按顺序查找第一个匹配 host 的路由
+func lookupRoute(host string, routes []Route) (string, bool) {
+	for _, route := range routes {
+		if matchDomain(host, route.Pattern) {
+			return route.Addr, true
+		}
+	}
+	return "", false
+}
+
+// lookupALPNRoute 按客户端声明的 ALPN 偏好顺序查找第一个有路由的协议
+func lookupALPNRoute(protos []string, routes []Route) (string, string, bool) {
+	for _, proto := range protos {
+		for _, route := range routes {
+			if route.Pattern == proto {
+				return proto, route.Addr, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// cidrRejectMessages 是 accessRules.checkIP 返回的拒绝原因对应的日志说明
+var cidrRejectMessages = map[rejectReason]string{
+	rejectCIDR:       "IP 不在允许的范围内",
+	rejectDeniedCIDR: "IP 命中拒绝的范围",
+}
+
+// checkIP 按 CIDR 白名单与黑名单判断 ip,放行时返回空字符串。先要求命中白名单,再检查黑名单,
+// 同时命中两者(如白名单是大段、黑名单是其中的小段)时以黑名单为准
+func (r *accessRules) checkIP(ip net.IP) rejectReason {
+	if !isAllowedIP(ip, r.nets) {
+		return rejectCIDR
+	}
+	if isAllowedIP(ip, r.deniedNets) {
+		return rejectDeniedCIDR
+	}
+	return ""
+}
+
+// isAllowedIP 判断 IP 是否落在 allowedNets 的任一 CIDR 范围内
+func isAllowedIP(ip net.IP, allowedNets []*net.IPNet) bool {
+	for _, allowedNet := range allowedNets {
+		if allowedNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainSet 是编译好的域名白名单,适合上千条的大列表:精确域名查 map,
+// 整段通配(如 *.example.com)放进按标签倒序的后缀树,只有段内通配(如 api-*.com)才逐个正则匹配
+type domainSet struct {
+	all      bool
+	exact    map[string]struct{}
+	suffixes *domainNode
+	patterns []string
+}
+
+// domainNode 是后缀树的一个节点,子节点的键是标签或 "*"
+type domainNode struct {
+	children map[string]*domainNode
+	terminal bool
+}
+
+func newDomainSet(patterns []string) *domainSet {
+	d := &domainSet{
+		exact:    make(map[string]struct{}),
+		suffixes: &domainNode{},
+	}
+	for _, pattern := range patterns {
+		pattern = normalizeDomain(pattern)
+		switch {
+		case pattern == "*":
+			d.all = true
+		case !strings.Contains(pattern, "*"):
+			d.exact[pattern] = struct{}{}
+		case hasPartialWildcard(pattern):
+			d.patterns = append(d.patterns, pattern)
+		default:
+			d.suffixes.insert(strings.Split(pattern, "."))
+		}
+	}
+	return d
+}
+
+// contains 判断 host 是否匹配白名单中的任一模式,语义与 matchDomain 相同
+func (d *domainSet) contains(host string) bool {
+	if d.all {
+		return true
+	}
+	host = normalizeDomain(host)
+	if _, ok := d.exact[host]; ok {
+		return true
+	}
+	if d.suffixes.match(strings.Split(host, ".")) {
+		return true
+	}
+	for _, pattern := range d.patterns {
+		if matchDomain(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *domainNode) insert(labels []string) {
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*domainNode)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &domainNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	n.terminal = true
+}
+
+// match 从最后一个标签开始向前匹配,整段 * 匹配任意一个非空标签
+func (n *domainNode) match(labels []string) bool {
+	if len(labels) == 0 {
+		return n.terminal
+	}
+	last := labels[len(labels)-1]
+	if child, ok := n.children[last]; ok && child.match(labels[:len(labels)-1]) {
+		return true
+	}
+	if child, ok := n.children["*"]; ok && last != "" && child.match(labels[:len(labels)-1]) {
+		return true
+	}
+	return false
+}
+
+// hasPartialWildcard 判断模式中是否有不占满整个标签的 *
+func hasPartialWildcard(pattern string) bool {
+	for _, label := range strings.Split(pattern, ".") {
+		if label != "*" && strings.Contains(label, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain 逐段匹配域名: 每个 * 只在单个标签内匹配,*.example.com 匹配 a.example.com,
+// 不匹配 a.b.example.com 和 example.com 本身;单独的 * 匹配所有域名。
+// 比较前 host 与 pattern 都经过 normalizeDomain,大小写不敏感,中文域名按 punycode 比较
+func matchDomain(host, pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	host, pattern = normalizeDomain(host), normalizeDomain(pattern)
+
+	re, err := compileDomainPattern(pattern)
+	if err != nil {
+		slog.Warn("域名匹配出错", "pattern", pattern, "error", err)
+		return false
+	}
+	return re.MatchString(host)
+}
+
+// compileDomainPattern 把域名模式编译为正则并缓存,避免每个连接都重新编译
+func compileDomainPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := domainPatternCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	labels := strings.Split(pattern, ".")
+	for i, label := range labels {
+		// 整段 * 至少匹配一个字符,段内 * (如 api-*) 允许为空,都不跨越 "."
+		wildcard := "[^.]*"
+		if label == "*" {
+			wildcard = "[^.]+"
+		}
+		parts := strings.Split(label, "*")
+		for j := range parts {
+			parts[j] = regexp.QuoteMeta(parts[j])
+		}
+		labels[i] = strings.Join(parts, wildcard)
+	}
+
+	re, err := regexp.Compile("^" + strings.Join(labels, `\.`) + "$")
+	if err != nil {
+		return nil, err
+	}
+	domainPatternCache.Store(pattern, re)
+	return re, nil
+}
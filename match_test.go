@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+// checkDomainMatch 同时检查 matchDomain 与 domainSet.contains,两者对同一模式的结论必须一致
+func checkDomainMatch(t *testing.T, host, pattern string, want bool) {
+	t.Helper()
+	if got := matchDomain(host, pattern); got != want {
+		t.Errorf("matchDomain(%q, %q) = %v, 期望 %v", host, pattern, got, want)
+	}
+	if got := newDomainSet([]string{pattern}).contains(host); got != want {
+		t.Errorf("domainSet{%q}.contains(%q) = %v, 期望 %v", pattern, host, got, want)
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"*.example.com", "a.example.com", true},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "a.example.org", false},
+		{"*.example.com", "aexample.com", false},
+		{"example.com", "example.com", true},
+		{"example.com", "a.example.com", false},
+		{"*.*.example.com", "a.b.example.com", true},
+		{"*.*.example.com", "a.example.com", false},
+		{"a.*.example.com", "a.b.example.com", true},
+		{"a.*.example.com", "b.b.example.com", false},
+		{"api-*.example.com", "api-v1.example.com", true},
+		{"api-*.example.com", "api-.example.com", true},
+		{"api-*.example.com", "api-v1.b.example.com", false},
+		{"api-*.example.com", "web-v1.example.com", false},
+		{"*", "anything.example.com", true},
+		// 模式里的 . 只匹配字面的点,不是正则的任意字符
+		{"a.example.com", "axexample.com", false},
+	}
+	for _, tt := range tests {
+		checkDomainMatch(t, tt.host, tt.pattern, tt.want)
+	}
+}
+
+func TestDomainSetMixed(t *testing.T) {
+	set := newDomainSet([]string{"example.com", "*.example.org", "api-*.example.net"})
+	for host, want := range map[string]bool{
+		"example.com":        true,
+		"a.example.com":      false,
+		"a.example.org":      true,
+		"example.org":        false,
+		"a.b.example.org":    false,
+		"api-x.example.net":  true,
+		"www.example.net":    false,
+		"api-x.example.com":  false,
+		"unrelated.test":     false,
+		"api-x.example.net.": true,
+	} {
+		if got := set.contains(host); got != want {
+			t.Errorf("contains(%q) = %v, 期望 %v", host, got, want)
+		}
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Example.COM.", "example.com"},
+		{"例子.测试", "xn--fsqu00a.xn--0zwm56d"},
+		{"WWW.例子.测试.", "www.xn--fsqu00a.xn--0zwm56d"},
+		{"*.例子.测试", "*.xn--fsqu00a.xn--0zwm56d"},
+		{"Bücher.DE", "xn--bcher-kva.de"},
+		{"MÜNCHEN.de", "xn--mnchen-3ya.de"},
+		{"中文网", "xn--fiq228c5hs"},
+		{"xn--fsqu00a.xn--0zwm56d", "xn--fsqu00a.xn--0zwm56d"},
+	}
+	for _, tt := range tests {
+		if got := normalizeDomain(tt.in); got != tt.want {
+			t.Errorf("normalizeDomain(%q) = %q, 期望 %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatchDomainCaseAndIDN(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"example.com", "EXAMPLE.com", true},
+		{"Example.COM", "example.com", true},
+		{"*.EXAMPLE.com", "Api.Example.Com", true},
+		{"api-*.example.com", "API-V1.EXAMPLE.COM", true},
+		{"example.com", "example.com.", true},
+		// 中文域名与 punycode 形式互相匹配
+		{"例子.测试", "xn--fsqu00a.xn--0zwm56d", true},
+		{"xn--fsqu00a.xn--0zwm56d", "例子.测试", true},
+		{"例子.测试", "例子.测试", true},
+		{"*.例子.测试", "www.xn--fsqu00a.xn--0zwm56d", true},
+		{"*.xn--fsqu00a.xn--0zwm56d", "WWW.例子.测试", true},
+		{"*.例子.测试", "例子.测试", false},
+		{"例子.测试", "例子.com", false},
+		{"bücher.de", "XN--BCHER-KVA.DE", true},
+		{"BÜCHER.de", "bücher.de", true},
+	}
+	for _, tt := range tests {
+		checkDomainMatch(t, tt.host, tt.pattern, tt.want)
+	}
+}
+
+func TestCheckIPDenyInsideAllow(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deniedNets, err := parseCIDRs([]string{"10.1.2.0/24", "2001:db8:bad::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &accessRules{nets: nets, deniedNets: deniedNets}
+
+	tests := []struct {
+		ip   string
+		want rejectReason
+	}{
+		{"10.1.2.3", rejectDeniedCIDR},
+		{"10.1.2.0", rejectDeniedCIDR},
+		{"10.1.2.255", rejectDeniedCIDR},
+		{"10.1.3.0", ""},
+		{"10.1.1.255", ""},
+		{"10.200.0.1", ""},
+		{"11.0.0.1", rejectCIDR},
+		{"2001:db8:bad::1", rejectDeniedCIDR},
+		{"2001:db8:bad:ffff::1", rejectDeniedCIDR},
+		{"2001:db8:bac::1", ""},
+		{"2001:db9::1", rejectCIDR},
+		// IPv4 映射的 IPv6 地址按 IPv4 判断
+		{"::ffff:10.1.2.3", rejectDeniedCIDR},
+		{"::ffff:10.9.9.9", ""},
+	}
+	for _, tt := range tests {
+		if got := rules.checkIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("checkIP(%s) = %q, 期望 %q", tt.ip, got, tt.want)
+		}
+	}
+
+	// 黑名单为空时只看白名单
+	rules.deniedNets = nil
+	if got := rules.checkIP(net.ParseIP("10.1.2.3")); got != "" {
+		t.Errorf("没有黑名单时 checkIP(10.1.2.3) = %q, 期望放行", got)
+	}
+}
+
+func TestSortRoutesBySpecificity(t *testing.T) {
+	routes := []Route{
+		{Pattern: "*.example.com", Addr: "wild"},
+		{Pattern: "*", Addr: "any"},
+		{Pattern: "api-*.example.com", Addr: "api-wild"},
+		{Pattern: "*.a.example.com", Addr: "a-wild"},
+		{Pattern: "www.example.com", Addr: "exact"},
+		{Pattern: "*.example.org", Addr: "org-1"},
+		{Pattern: "*.example.net", Addr: "net"},
+		{Pattern: "*.EXAMPLE.org", Addr: "org-2"},
+	}
+	sortRoutesBySpecificity(routes)
+
+	var got []string
+	for _, r := range routes {
+		got = append(got, r.Addr)
+	}
+	// 精确域名最前;通配之间先比标签数,再比非通配字符数;
+	// *.example.com、*.example.org、*.example.net 具体程度相同,保持原有顺序
+	want := []string{"exact", "a-wild", "api-wild", "wild", "org-1", "net", "org-2", "any"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("排序结果 %v, 期望 %v", got, want)
+	}
+
+	for host, addr := range map[string]string{
+		"www.example.com":    "exact",
+		"x.a.example.com":    "a-wild",
+		"api-v1.example.com": "api-wild",
+		"foo.example.com":    "wild",
+		"a.example.com":      "wild",
+		"foo.example.org":    "org-1",
+		"other.test":         "any",
+	} {
+		if got, _ := lookupRoute(host, routes); got != addr {
+			t.Errorf("lookupRoute(%q) = %q, 期望 %q", host, got, addr)
+		}
+	}
+}
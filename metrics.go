@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 延迟 histogram 的默认 bucket 上界(秒)。拨号一般在毫秒级,连接时长从短请求到长连接跨度很大
+var (
+	dialDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	connDurationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+)
+
+// rejectReason 是拒绝连接的原因,用作日志的 reason 字段、连接的 close_reason 和 rejected 计数器的 reason label。
+// 所有拒绝都必须使用下面的常量,新增原因时同时加入 rejectReasons,保证指标中每个原因都有一条从 0 开始的序列
+type rejectReason string
+
+const (
+	rejectCIDR             rejectReason = "cidr"
+	rejectDeniedCIDR       rejectReason = "denied_cidr"
+	rejectDomain           rejectReason = "domain"
+	rejectSNI              rejectReason = "sni"
+	rejectNoSNI            rejectReason = "no_sni"
+	rejectMalformedHello   rejectReason = "malformed_client_hello"
+	rejectDeniedDomain     rejectReason = "denied_domain"
+	rejectJA3              rejectReason = "ja3"
+	rejectMaxConns         rejectReason = "max_conns"
+	rejectMaxConnsPerIP    rejectReason = "max_conns_per_ip"
+	rejectBanned           rejectReason = "banned"
+	rejectProxy            rejectReason = "proxy_header"
+	rejectUntrustedProxy   rejectReason = "untrusted_proxy"
+	rejectRateLimited      rejectReason = "rate_limited"
+	rejectSOCKSAuth        rejectReason = "socks_auth"
+	rejectNoCert           rejectReason = "no_cert"
+	rejectAllowHours       rejectReason = "allow_hours"
+	rejectMaintenance      rejectReason = "maintenance"
+	rejectTLSVersion       rejectReason = "tls_version"
+	rejectHandshakeTimeout rejectReason = "handshake_timeout"
+	rejectHeaderTooLarge   rejectReason = "header_too_large"
+	rejectMethod           rejectReason = "method"
+	rejectPath             rejectReason = "path"
+	rejectWorkersBusy      rejectReason = "workers_busy"
+)
+
+// rejectReasons 是全部拒绝原因,/metrics 按这个顺序输出
+var rejectReasons = []rejectReason{
+	rejectCIDR,
+	rejectDeniedCIDR,
+	rejectDomain,
+	rejectSNI,
+	rejectNoSNI,
+	rejectMalformedHello,
+	rejectDeniedDomain,
+	rejectJA3,
+	rejectMaxConns,
+	rejectMaxConnsPerIP,
+	rejectBanned,
+	rejectProxy,
+	rejectUntrustedProxy,
+	rejectRateLimited,
+	rejectSOCKSAuth,
+	rejectNoCert,
+	rejectAllowHours,
+	rejectMaintenance,
+	rejectTLSVersion,
+	rejectHandshakeTimeout,
+	rejectHeaderTooLarge,
+	rejectMethod,
+	rejectPath,
+	rejectWorkersBusy,
+}
+
+// metrics 汇总转发过程中的各项计数器
+type metrics struct {
+	accepted            atomic.Uint64
+	dialFailures        atomic.Uint64
+	bytesClientToServer atomic.Uint64
+	bytesServerToClient atomic.Uint64
+	webhookDropped      atomic.Uint64
+	webhookFailures     atomic.Uint64
+	otelDropped         atomic.Uint64
+	otelFailures        atomic.Uint64
+
+	dialDuration *histogram // 成功连上后端的拨号耗时
+	connDuration *histogram // 连接从 Accept 到关闭的总时长
+
+	mu       sync.Mutex
+	rejected map[rejectReason]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rejected:     make(map[rejectReason]uint64),
+		dialDuration: newHistogram(dialDurationBuckets),
+		connDuration: newHistogram(connDurationBuckets),
+	}
+}
+
+// histogram 是按 tls 标签区分两组的 Prometheus histogram,observe 只做原子加法,不加锁
+type histogram struct {
+	bounds []float64
+	series [2]histogramSeries // 下标 0 为非 TLS,1 为 TLS
+}
+
+type histogramSeries struct {
+	buckets []atomic.Uint64 // 落在各区间的次数(非累计),最后一个是超过最大上界的部分
+	sum     atomic.Int64    // 纳秒
+}
+
+func newHistogram(bounds []float64) *histogram {
+	h := &histogram{bounds: bounds}
+	for i := range h.series {
+		h.series[i].buckets = make([]atomic.Uint64, len(bounds)+1)
+	}
+	return h
+}
+
+func (h *histogram) observe(tls bool, d time.Duration) {
+	series := &h.series[0]
+	if tls {
+		series = &h.series[1]
+	}
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	series.buckets[i].Add(1)
+	series.sum.Add(int64(d))
+}
+
+// write 按 Prometheus 文本格式输出累计 bucket、_sum 和 _count
+func (h *histogram) write(w io.Writer, name, help string) {
+	writeMetricHeader(w, name, "histogram", help)
+	for i, label := range []string{"false", "true"} {
+		series := &h.series[i]
+		var count uint64
+		for j, bound := range h.bounds {
+			count += series.buckets[j].Load()
+			fmt.Fprintf(w, "%s_bucket{tls=%s,le=\"%s\"} %d\n", name, promLabel(label), strconv.FormatFloat(bound, 'g', -1, 64), count)
+		}
+		count += series.buckets[len(h.bounds)].Load()
+		fmt.Fprintf(w, "%s_bucket{tls=%s,le=\"+Inf\"} %d\n", name, promLabel(label), count)
+		fmt.Fprintf(w, "%s_sum{tls=%s} %g\n", name, promLabel(label), time.Duration(series.sum.Load()).Seconds())
+		fmt.Fprintf(w, "%s_count{tls=%s} %d\n", name, promLabel(label), count)
+	}
+}
+
+func (m *metrics) reject(reason rejectReason) {
+	m.mu.Lock()
+	m.rejected[reason]++
+	m.mu.Unlock()
+}
+
+// MetricsHandler 返回以 Prometheus 文本格式输出指标的 http.Handler
+func (s *Server) MetricsHandler() http.Handler {
+	return MetricsHandler(s)
+}
+
+// MetricsHandler 汇总多个共享同一套计数器(Config.Metrics)的 Server 的指标
+func MetricsHandler(servers ...*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, servers)
+	})
+}
+
+func writeMetrics(w io.Writer, servers []*Server) {
+	m := servers[0].metrics
+
+	var active int32
+	for _, s := range servers {
+		active += s.ActiveConnections()
+	}
+	ver, rev, _ := buildInfo()
+	writeMetricHeader(w, "securetcprelay_build_info", "gauge", "构建信息,值恒为 1")
+	fmt.Fprintf(w, "securetcprelay_build_info{version=%s,commit=%s,goversion=%s} 1\n", promLabel(ver), promLabel(rev), promLabel(runtime.Version()))
+
+	writeMetricHeader(w, "securetcprelay_active_connections", "gauge", "当前活跃连接数")
+	fmt.Fprintf(w, "securetcprelay_active_connections %d\n", active)
+
+	writeMetricHeader(w, "securetcprelay_connections_accepted_total", "counter", "累计接受的连接数")
+	fmt.Fprintf(w, "securetcprelay_connections_accepted_total %d\n", m.accepted.Load())
+
+	writeMetricHeader(w, "securetcprelay_connections_rejected_total", "counter", "累计拒绝的连接数,按原因区分")
+	m.mu.Lock()
+	for _, reason := range rejectReasons {
+		fmt.Fprintf(w, "securetcprelay_connections_rejected_total{reason=%s} %d\n", promLabel(string(reason)), m.rejected[reason])
+	}
+	m.mu.Unlock()
+
+	writeMetricHeader(w, "securetcprelay_forwarded_bytes_total", "counter", "累计转发的字节数,按方向区分")
+	fmt.Fprintf(w, "securetcprelay_forwarded_bytes_total{direction=\"client_to_server\"} %d\n", m.bytesClientToServer.Load())
+	fmt.Fprintf(w, "securetcprelay_forwarded_bytes_total{direction=\"server_to_client\"} %d\n", m.bytesServerToClient.Load())
+
+	writeMetricHeader(w, "securetcprelay_dial_failures_total", "counter", "连接转发目标失败的次数")
+	fmt.Fprintf(w, "securetcprelay_dial_failures_total %d\n", m.dialFailures.Load())
+
+	writeMetricHeader(w, "securetcprelay_webhook_dropped_total", "counter", "因 webhook 队列已满而丢弃的事件数")
+	fmt.Fprintf(w, "securetcprelay_webhook_dropped_total %d\n", m.webhookDropped.Load())
+
+	writeMetricHeader(w, "securetcprelay_webhook_failures_total", "counter", "发送 webhook 失败而丢弃的事件数")
+	fmt.Fprintf(w, "securetcprelay_webhook_failures_total %d\n", m.webhookFailures.Load())
+
+	writeMetricHeader(w, "securetcprelay_otel_dropped_spans_total", "counter", "因 OTLP 导出队列已满而丢弃的 span 数")
+	fmt.Fprintf(w, "securetcprelay_otel_dropped_spans_total %d\n", m.otelDropped.Load())
+
+	writeMetricHeader(w, "securetcprelay_otel_failed_spans_total", "counter", "导出到 collector 失败而丢弃的 span 数")
+	fmt.Fprintf(w, "securetcprelay_otel_failed_spans_total %d\n", m.otelFailures.Load())
+
+	m.dialDuration.write(w, "securetcprelay_backend_dial_duration_seconds", "成功连接后端的拨号耗时,按是否 TLS 流量区分")
+	m.connDuration.write(w, "securetcprelay_connection_duration_seconds", "连接从建立到关闭的总时长,按是否 TLS 流量区分")
+
+	// 不同 listener 可能探测同一个后端,只输出一次
+	header := false
+	seen := make(map[string]bool)
+	for _, s := range servers {
+		if s.health == nil {
+			continue
+		}
+		if !header {
+			writeMetricHeader(w, "securetcprelay_backend_up", "gauge", "后端健康检查状态,1 为健康,0 为 down")
+			header = true
+		}
+		for _, addr := range s.health.addrs() {
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			up := 0
+			if s.health.isUp(addr) {
+				up = 1
+			}
+			fmt.Fprintf(w, "securetcprelay_backend_up{backend=%s} %d\n", promLabel(addr), up)
+		}
+	}
+}
+
+// promLabelEscaper 按 Prometheus 文本格式转义标签值:只有反斜杠、双引号和换行需要转义,其余字符(包括非 ASCII)原样输出
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabel 返回加上双引号并转义后的标签值。不能用 %q:Go 的 \x..、\u.... 转义在 Prometheus 文本格式中是非法的
+func promLabel(v string) string {
+	return `"` + promLabelEscaper.Replace(v) + `"`
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromLabel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"127.0.0.1:443", `"127.0.0.1:443"`},
+		{`a"b\c`, `"a\"b\\c"`},
+		{"a\nb", `"a\nb"`},
+		// 非 ASCII 字符和 tab 原样输出,不能出现 Go 的 \u、\x 转义
+		{"unix:/run/后端.sock", `"unix:/run/后端.sock"`},
+		{"tab\there", "\"tab\there\""},
+	}
+	for _, tt := range tests {
+		if got := promLabel(tt.value); got != tt.want {
+			t.Errorf("promLabel(%q) = %s, 期望 %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsBackendLabel(t *testing.T) {
+	backend := "unix:/run/中继 \"后端\".sock"
+	s, err := NewServer(Config{
+		ListenAddr:     "127.0.0.1:0",
+		PlainBackends:  []string{backend},
+		HealthInterval: time.Hour,
+		Logger:         testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, []*Server{s})
+	want := `securetcprelay_backend_up{backend="unix:/run/中继 \"后端\".sock"} 1`
+	if !strings.Contains(buf.String(), want+"\n") {
+		t.Errorf("指标中没有 %s:\n%s", want, buf.String())
+	}
+	if strings.Contains(buf.String(), `\u`) || strings.Contains(buf.String(), `\x`) {
+		t.Errorf("指标中出现了 Prometheus 不支持的转义:\n%s", buf.String())
+	}
+}
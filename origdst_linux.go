@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst 是 netfilter 的 SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST,两者取值相同
+const soOriginalDst = 80
+
+// originalDst 读取被 iptables REDIRECT/DNAT 之前的目标地址
+func originalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("不是 TCP 连接")
+	}
+	rc, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	isIPv6 := tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var addr string
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if isIPv6 {
+			// IPv6MTUInfo 的开头恰好是一个 sockaddr_in6,借用它接收结果
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			sa := info.Addr
+			addr = net.JoinHostPort(net.IP(sa.Addr[:]).String(), fmt.Sprint(ntohs(sa.Port)))
+			return
+		}
+		// IPv6Mreq 是 20 字节,足够容纳 16 字节的 sockaddr_in
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr[0]))
+		addr = net.JoinHostPort(net.IP(sa.Addr[:]).String(), fmt.Sprint(ntohs(sa.Port)))
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return addr, nil
+}
+
+// ntohs 把网络字节序的端口转换为主机字节序
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst 只在 Linux 上可用
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.New("透明代理模式只支持 Linux")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	otelQueueSize     = 4096            // 等待导出的 span 数上限,队列满时直接丢弃新 span
+	otelBatchSize     = 256             // 每次 POST 最多携带的 span 数
+	otelFlushInterval = 5 * time.Second // 不满一批时最长等待多久导出
+	otelServiceName   = "secure-tcp-relay"
+	otelScopeName     = "github.com/badafans/SecureTCPRelay"
+)
+
+// OTLP 的 SpanKind 与 StatusCode 取值
+const (
+	otelKindInternal = 1
+	otelKindServer   = 2
+	otelKindClient   = 3
+
+	otelStatusError = 2
+)
+
+// otelSpan 是一个已经结束、等待导出的 span
+type otelSpan struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // 全零表示根 span
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []any  // 交替排列的 key 与 value,同 slog 的写法
+	errMsg   string // 非空时 span 状态为 ERROR
+}
+
+// otelExporter 在后台 goroutine 中把 span 按 OTLP/HTTP JSON 格式批量 POST 到 collector。
+// export 从不阻塞:队列满或发送失败的 span 直接丢弃并计数,不影响转发主路径
+type otelExporter struct {
+	url      string
+	client   *http.Client
+	queue    chan *otelSpan
+	logger   *slog.Logger
+	metrics  *metrics
+	resource []any
+}
+
+// newOtelExporter 创建导出器并启动发送 goroutine,它随进程一直运行。
+// endpoint 只写到端口(如 http://127.0.0.1:4318)时按 OTLP 规范补上 /v1/traces
+func newOtelExporter(endpoint string, timeout time.Duration, logger *slog.Logger, m *metrics) (*otelExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("无效的 OTLP 地址 %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	hostname, _ := os.Hostname()
+	e := &otelExporter{
+		url:      u.String(),
+		client:   &http.Client{Timeout: timeout},
+		queue:    make(chan *otelSpan, otelQueueSize),
+		logger:   logger,
+		metrics:  m,
+		resource: []any{"service.name", otelServiceName, "service.version", version, "host.name", hostname},
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *otelExporter) export(span *otelSpan) {
+	select {
+	case e.queue <- span:
+	default:
+		e.metrics.otelDropped.Add(1)
+	}
+}
+
+func (e *otelExporter) run() {
+	ticker := time.NewTicker(otelFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*otelSpan, 0, otelBatchSize)
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) < otelBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.send(batch); err != nil {
+			e.metrics.otelFailures.Add(uint64(len(batch)))
+			e.logger.Debug("导出 OTLP span 失败，丢弃本批数据", "event", "otel_error", "spans", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (e *otelExporter) send(batch []*otelSpan) error {
+	spans := make([]map[string]any, len(batch))
+	for i, span := range batch {
+		spans[i] = span.otlp()
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(e.resource)},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": otelScopeName, "version": version},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector 返回 %s", resp.Status)
+	}
+	return nil
+}
+
+// otlp 按 OTLP/JSON 编码 span:trace/span ID 用十六进制,时间戳用字符串形式的纳秒数
+func (span *otelSpan) otlp() map[string]any {
+	m := map[string]any{
+		"traceId":           hex.EncodeToString(span.traceID[:]),
+		"spanId":            hex.EncodeToString(span.spanID[:]),
+		"name":              span.name,
+		"kind":              span.kind,
+		"startTimeUnixNano": strconv.FormatInt(span.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(span.attrs),
+	}
+	if span.parentID != [8]byte{} {
+		m["parentSpanId"] = hex.EncodeToString(span.parentID[:])
+	}
+	if span.errMsg != "" {
+		m["status"] = map[string]any{"code": otelStatusError, "message": span.errMsg}
+	}
+	return m
+}
+
+// otlpAttributes 把交替排列的 key/value 转成 OTLP 的 KeyValue 列表,空字符串的属性省略
+func otlpAttributes(kv []any) []map[string]any {
+	attrs := make([]map[string]any, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		var value map[string]any
+		switch v := kv[i+1].(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case uint64:
+			value = map[string]any{"intValue": strconv.FormatUint(v, 10)}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		attrs = append(attrs, map[string]any{"key": kv[i], "value": value})
+	}
+	return attrs
+}
+
+// newSpanID 返回随机的非零 span ID,OTLP 规定全零的 ID 无效
+func newSpanID() (id [8]byte) {
+	for id == [8]byte{} {
+		binary.BigEndian.PutUint64(id[:], rand.Uint64())
+	}
+	return id
+}
+
+func newTraceID() (id [16]byte) {
+	for id == [16]byte{} {
+		binary.BigEndian.PutUint64(id[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(id[8:], rand.Uint64())
+	}
+	return id
+}
+
+// traceSpan 为 sess 导出一个从 start 到现在的子 span,err 非空时状态为 ERROR。未开启追踪时什么也不做
+func (s *Server) traceSpan(sess *session, name string, kind int, start time.Time, err error, attrs ...any) {
+	if s.cfg.Tracer == nil {
+		return
+	}
+	span := &otelSpan{
+		traceID:  sess.traceID,
+		spanID:   newSpanID(),
+		parentID: sess.spanID,
+		name:     name,
+		kind:     kind,
+		start:    start,
+		end:      time.Now(),
+		attrs:    attrs,
+	}
+	if err != nil {
+		span.errMsg = err.Error()
+	}
+	s.cfg.Tracer.export(span)
+}
+
+// traceConnection 在连接关闭时导出握手子 span 和代表整条连接的根 span
+func (s *Server) traceConnection(sess *session) {
+	if s.cfg.Tracer == nil {
+		return
+	}
+	now := time.Now()
+	handshake := &otelSpan{traceID: sess.traceID, spanID: newSpanID(), parentID: sess.spanID, name: "handshake", kind: otelKindInternal, start: sess.start, end: sess.handshakeEnd}
+	if sess.handshakeEnd.IsZero() {
+		// 没有走完握手就结束的连接(被拒绝、超时),握手 span 持续到连接关闭
+		handshake.end, handshake.errMsg = now, sess.closeReason
+	}
+	s.cfg.Tracer.export(handshake)
+
+	clientIP, _ := remoteIP(sess.clientAddr)
+	hostKey := "host"
+	if sess.tls {
+		hostKey = "sni"
+	}
+	root := &otelSpan{
+		traceID: sess.traceID,
+		spanID:  sess.spanID,
+		name:    "connection",
+		kind:    otelKindServer,
+		start:   sess.start,
+		end:     now,
+		attrs: []any{
+			"listener", s.cfg.ListenAddr,
+			"conn_id", sess.id,
+			"client_ip", clientIP,
+			hostKey, sess.host,
+			"dst", sess.dst,
+			"bytes_in", sess.bytesIn.Load(),
+			"bytes_out", sess.bytesOut.Load(),
+			"duration_ms", now.Sub(sess.start).Milliseconds(),
+			"close_reason", sess.closeReason,
+			"closed_by", sess.closedBy,
+		},
+	}
+	if sess.closeReason != "closed" {
+		root.errMsg = sess.closeReason
+	}
+	s.cfg.Tracer.export(root)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/badafans/SecureTCPRelay/clienthello"
+)
+
+// PROXY protocol v2 的 12 字节签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyV1MaxLen = 107 // v1 头(含 \r\n)的最大长度
+
+// writeProxyHeader 写入 PROXY protocol v1 头,src 为客户端地址,dst 为本地监听地址
+func writeProxyHeader(w io.Writer, src, dst net.Addr) error {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		// unix socket 等非 TCP 连接按协议规范发送 UNKNOWN,后端应使用连接本身的地址
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+
+	proto := "TCP4"
+	srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		// 任一端是 IPv6 时两端都按 IPv6 表示
+		proto = "TCP6"
+		srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+	}
+
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcAddr.Port, dstAddr.Port)
+	return err
+}
+
+// proxyHeaderReader 在首包基础上按需从 conn 补读,只读到头所需的长度为止
+type proxyHeaderReader struct {
+	conn net.Conn
+	data []byte
+}
+
+// ensure 确保已缓存至少 n 字节
+func (r *proxyHeaderReader) ensure(n int) error {
+	data, err := clienthello.ReadAtLeast(r.conn, r.data, n)
+	if err != nil {
+		return err
+	}
+	r.data = data
+	return nil
+}
+
+// readProxyHeader 从首包 data 开始解析 PROXY protocol v1/v2 头,数据不足时继续从 conn 读取。
+// 返回头中声明的客户端地址(LOCAL/UNKNOWN 时为 nil)以及头之后剩余的字节。
+func readProxyHeader(conn net.Conn, data []byte) (net.Addr, []byte, error) {
+	r := &proxyHeaderReader{conn: conn, data: data}
+	// 最短的 v1 头 "PROXY UNKNOWN\r\n" 也比 v2 签名长,先补齐签名长度
+	if err := r.ensure(len(proxyV2Signature)); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(r.data, proxyV2Signature):
+		return r.readV2()
+	case bytes.HasPrefix(r.data, []byte("PROXY ")):
+		return r.readV1()
+	default:
+		return nil, nil, fmt.Errorf("缺少 PROXY protocol 头")
+	}
+}
+
+// readV1 读取以 \r\n 结尾的文本格式 v1 头
+func (r *proxyHeaderReader) readV1() (net.Addr, []byte, error) {
+	end := bytes.Index(r.data, []byte("\r\n"))
+	for end < 0 {
+		if len(r.data) >= proxyV1MaxLen {
+			return nil, nil, fmt.Errorf("v1 头超过 %d 字节", proxyV1MaxLen)
+		}
+		if err := r.ensure(len(r.data) + 1); err != nil {
+			return nil, nil, err
+		}
+		end = bytes.Index(r.data, []byte("\r\n"))
+	}
+	if end+2 > proxyV1MaxLen {
+		return nil, nil, fmt.Errorf("v1 头超过 %d 字节", proxyV1MaxLen)
+	}
+
+	addr, err := parseProxyV1(string(r.data[:end]))
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, r.data[end+2:], nil
+}
+
+// parseProxyV1 解析形如 "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222" 的 v1 头
+func parseProxyV1(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("v1 头字段数量错误: %q", line)
+	}
+	if fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("v1 头协议非法: %s", fields[1])
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("v1 头源地址非法: %s", fields[2])
+	}
+	if net.ParseIP(fields[3]) == nil {
+		return nil, fmt.Errorf("v1 头目的地址非法: %s", fields[3])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("v1 头源端口非法: %s", fields[4])
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("v1 头目的端口非法: %s", fields[5])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 读取二进制格式的 v2 头
+func (r *proxyHeaderReader) readV2() (net.Addr, []byte, error) {
+	if err := r.ensure(16); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := r.data[12], r.data[13]
+	length := int(binary.BigEndian.Uint16(r.data[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("v2 头版本非法: %d", verCmd>>4)
+	}
+	if err := r.ensure(16 + length); err != nil {
+		return nil, nil, err
+	}
+	payload, rest := r.data[16:16+length], r.data[16+length:]
+
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL,健康检查等由代理自身发起的连接
+		return nil, rest, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("v2 头命令非法: %d", verCmd&0x0f)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, nil, fmt.Errorf("v2 头 IPv4 地址长度不足")
+		}
+		ip := net.IP(append([]byte(nil), payload[0:4]...))
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, rest, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, nil, fmt.Errorf("v2 头 IPv6 地址长度不足")
+		}
+		ip := net.IP(append([]byte(nil), payload[0:16]...))
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, rest, nil
+	case 0x00: // UNSPEC
+		return nil, rest, nil
+	default:
+		return nil, nil, fmt.Errorf("v2 头地址族不支持: 0x%02x", family)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket 是一个简单的令牌桶: 每秒补充 rate 个令牌,最多累积 burst 个。
+// 没有用 golang.org/x/time/rate:中继不引入第三方依赖,而这里只需要 allow 和允许欠账的 wait 两种用法
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill 按距上次补充经过的时间补充令牌,调用方需持有锁
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+}
+
+// allow 有可用令牌时取走一个并返回 true
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait 取走 n 个令牌,不足时允许先欠账,再阻塞到欠账补足为止
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// rateLimitedReader 按令牌桶限制读取速率,每个令牌代表一个字节
+type rateLimitedReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+	chunk  int // 单次读取上限,避免一次读取欠账过多
+}
+
+// newRateLimitedReader 把 r 的读取速率限制在每秒 bytesPerSec 字节
+func newRateLimitedReader(r io.Reader, bytesPerSec int64) *rateLimitedReader {
+	chunk := int(min(bytesPerSec, 32*1024))
+	return &rateLimitedReader{
+		r:      r,
+		bucket: newTokenBucket(float64(bytesPerSec), int(bytesPerSec)),
+		chunk:  max(chunk, 1),
+	}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.bucket.wait(n)
+	}
+	return n, err
+}
+
+// parseByteSize 解析 "512KB"、"10MB"、"1GB" 这类大小,单位按 1024 进位,不带单位时为字节
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1 << 30}, {"G", 1 << 30},
+		{"MB", 1 << 20}, {"M", 1 << 20},
+		{"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	}
+
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			scale = unit.scale
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(upper, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("无法解析大小: %q", s)
+	}
+	return int64(value * float64(scale)), nil
+}
+
+// ipRateLimiterCapacity 是最多同时跟踪的源 IP 数量,超出后淘汰最久未出现的 IP
+const ipRateLimiterCapacity = 65536
+
+// ipRateLimiter 为每个源 IP 维护一个令牌桶,用 LRU 淘汰避免 map 无限增长
+type ipRateLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    int
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List // 越靠前越近期出现,元素值为 *ipLimiterEntry
+}
+
+type ipLimiterEntry struct {
+	ip     string
+	bucket *tokenBucket
+}
+
+// newIPRateLimiter 创建每个 IP 每秒最多 rate 个新连接的限流器,允许的突发量为 rate 向上取整
+func newIPRateLimiter(rate float64) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:     rate,
+		burst:    int(math.Max(1, math.Ceil(rate))),
+		capacity: ipRateLimiterCapacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// allow 判断来自 ip 的新连接是否在速率限制内
+func (l *ipRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	elem, ok := l.entries[ip]
+	if ok {
+		l.lru.MoveToFront(elem)
+	} else {
+		elem = l.lru.PushFront(&ipLimiterEntry{ip: ip, bucket: newTokenBucket(l.rate, l.burst)})
+		l.entries[ip] = elem
+		if l.lru.Len() > l.capacity {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.entries, oldest.Value.(*ipLimiterEntry).ip)
+		}
+	}
+	bucket := elem.Value.(*ipLimiterEntry).bucket
+	l.mu.Unlock()
+
+	return bucket.allow()
+}
+
+// ipConnLimiter 限制每个源 IP 同时保持的连接数。计数器的指针交给连接持有,
+// 关闭时直接原子递减,计数归零的条目由 run 定期清理
+type ipConnLimiter struct {
+	mu     sync.Mutex
+	limit  int32
+	counts map[string]*int32
+}
+
+func newIPConnLimiter(limit int) *ipConnLimiter {
+	return &ipConnLimiter{limit: int32(limit), counts: make(map[string]*int32)}
+}
+
+// acquire 未超过上限时把 ip 的连接数加一并返回计数器,连接关闭时调用方需对其原子减一;
+// 超过上限时返回 nil
+func (l *ipConnLimiter) acquire(ip string) *int32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count, ok := l.counts[ip]
+	if !ok {
+		count = new(int32)
+		l.counts[ip] = count
+	}
+	if atomic.LoadInt32(count) >= l.limit {
+		return nil
+	}
+	atomic.AddInt32(count, 1)
+	return count
+}
+
+// cleanup 删除连接数为 0 的条目。计数器只在持有锁时从 0 增加,删除后不会再被新连接使用
+func (l *ipConnLimiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, count := range l.counts {
+		if atomic.LoadInt32(count) == 0 {
+			delete(l.counts, ip)
+		}
+	}
+}
+
+// run 每隔 interval 清理一次,直到 done 关闭
+func (l *ipConnLimiter) run(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			l.cleanup()
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIPRateLimiterEviction(t *testing.T) {
+	// 速率足够低,测试期间不会补充出新的令牌
+	l := newIPRateLimiter(0.001)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if !l.allow(ip) {
+			t.Fatalf("%s 的第一个连接被拒绝", ip)
+		}
+		if l.allow(ip) {
+			t.Fatalf("%s 的令牌桶没有耗尽", ip)
+		}
+	}
+	// 10.0.0.2 再次出现,变为最近使用;之后填满容量,只有最久未出现的 10.0.0.1 被淘汰
+	l.allow("10.0.0.2")
+	for i := 0; i < ipRateLimiterCapacity-1; i++ {
+		l.allow(fmt.Sprintf("fd00::%x", i))
+	}
+	if got := len(l.entries); got != ipRateLimiterCapacity {
+		t.Fatalf("跟踪了 %d 个 IP, 期望上限 %d", got, ipRateLimiterCapacity)
+	}
+	if got := l.lru.Len(); got != ipRateLimiterCapacity {
+		t.Fatalf("LRU 链表长度 %d, 期望 %d", got, ipRateLimiterCapacity)
+	}
+	if _, ok := l.entries["10.0.0.1"]; ok {
+		t.Fatal("最久未出现的 10.0.0.1 没有被淘汰")
+	}
+	if l.allow("10.0.0.2") {
+		t.Fatal("最近出现过的 10.0.0.2 被淘汰,令牌桶重新装满")
+	}
+
+	// 被淘汰的 IP 再次出现时从满的令牌桶开始
+	if !l.allow("10.0.0.1") {
+		t.Fatal("被淘汰的 10.0.0.1 再次出现时没有从满的令牌桶开始")
+	}
+	if l.allow("10.0.0.1") {
+		t.Fatal("10.0.0.1 的新令牌桶容量超过 burst")
+	}
+}
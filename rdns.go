@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rdnsTimeout    = 2 * time.Second // 单次反向解析的超时
+	rdnsTTL        = 10 * time.Minute
+	rdnsMaxEntries = 10000 // 缓存的 IP 数上限,超过时先清理过期记录,仍然满则随机淘汰一条
+)
+
+// rdnsResolver 在后台反向解析已放行连接的客户端 IP,结果(包括查不到)按 IP 缓存 rdnsTTL。
+// 同一 IP 进行中的解析由多个连接共享,调用方从不等待解析结果
+type rdnsResolver struct {
+	mu      sync.Mutex
+	entries map[string]*rdnsEntry
+}
+
+type rdnsEntry struct {
+	done    chan struct{} // 解析结束后关闭,之后 name 不再变化
+	name    string        // 第一条 PTR 记录,去掉末尾的点;查不到时为空
+	expires time.Time
+}
+
+func newRDNSResolver() *rdnsResolver {
+	return &rdnsResolver{entries: make(map[string]*rdnsEntry)}
+}
+
+// lookup 返回 ip 的缓存记录,没有或已过期时新建记录并在后台解析
+func (r *rdnsResolver) lookup(ip string) *rdnsEntry {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.entries[ip]; ok && now.Before(entry.expires) {
+		return entry
+	}
+
+	if len(r.entries) >= rdnsMaxEntries {
+		for key, entry := range r.entries {
+			if !now.Before(entry.expires) {
+				delete(r.entries, key)
+			}
+		}
+		for key := range r.entries {
+			if len(r.entries) < rdnsMaxEntries {
+				break
+			}
+			delete(r.entries, key)
+		}
+	}
+	entry := &rdnsEntry{done: make(chan struct{}), expires: now.Add(rdnsTTL)}
+	r.entries[ip] = entry
+	go entry.resolve(ip)
+	return entry
+}
+
+func (e *rdnsEntry) resolve(ip string) {
+	defer close(e.done)
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err == nil && len(names) > 0 {
+		e.name = strings.TrimSuffix(names[0], ".")
+	}
+}
+
+// result 返回已经完成的解析结果,仍在解析或查不到时返回空字符串,e 为空时同样返回空字符串
+func (e *rdnsEntry) result() string {
+	if e == nil {
+		return ""
+	}
+	select {
+	case <-e.done:
+		return e.name
+	default:
+		return ""
+	}
+}
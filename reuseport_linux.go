@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// soReusePort 是 Linux 的 SO_REUSEPORT,syscall 包没有导出
+const soReusePort = 0xf
+
+// reusePortSupported 表示当前平台是否支持用 SO_REUSEPORT 在同一端口上开多个 listener
+const reusePortSupported = true
+
+// reusePortControl 在 bind 之前给 socket 设置 SO_REUSEPORT,内核按四元组哈希把新连接
+// 分散到绑定同一端口的所有 socket 上,包括其他进程的
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
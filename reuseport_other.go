@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortSupported 为 false:BSD/macOS 的 SO_REUSEPORT 不在多个 socket 间均衡分配连接,
+// 其他平台没有这个选项,都回退为单个 listener
+const reusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT 只支持 Linux")
+}
@@ -0,0 +1,1760 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/badafans/SecureTCPRelay/clienthello"
+)
+
+// Config 是 Server 的全部配置
+type Config struct {
+	ListenAddr      string           // 本地监听的 IP 和端口
+	DestAddrs       []string         // 转发目标,第一个是非TLS地址,第二个是TLS地址
+	PlainBackends   []string         // 非TLS流量的候选后端,依次尝试;为空时使用 DestAddrs[0]
+	TLSBackends     []string         // TLS 流量的候选后端,依次尝试;为空时使用 DestAddrs[1],没有则同非TLS
+	AllowedNets     []*net.IPNet     // 允许的来源 IP 范围
+	DeniedNets      []*net.IPNet     // 拒绝的来源 IP 范围,优先于 AllowedNets
+	AllowedDomains  []string         // 允许的域名列表,支持通配符*,nil 表示允许所有域名
+	DeniedDomains   []string         // 拒绝的域名列表,支持通配符*,优先于 AllowedDomains
+	SNIRoutes       []Route          // 按 SNI 选择后端的路由表,按配置顺序匹配
+	FileRoutes      []Route          // 从 -route-file 加载的 SNI 路由,已按具体程度排序,在 SNIRoutes 之后匹配,可用 SetFileRoutes 替换
+	ALPNRoutes      []Route          // 按 ALPN 协议选择后端的路由表,协议名精确匹配
+	SignatureRoutes []SignatureRoute // 按首包字节签名选择后端,优先于 TLS/HTTP 识别,命中时不做域名过滤
+	DefaultDst      string           // SNI/ALPN 路由都未命中时的 TLS 兜底后端,为空时使用 TLSBackends
+	// DefaultDstAnyDomain 为 true 时不在白名单内的 SNI 也转发到 DefaultDst 而不是拒绝,黑名单仍然生效
+	DefaultDstAnyDomain bool
+
+	JA3Allow []string // 允许的 JA3 指纹(MD5),为空时不限制
+	JA3Deny  []string // 拒绝的 JA3 指纹(MD5),优先于 JA3Allow 和域名白名单
+
+	DrainTimeout     time.Duration // Shutdown 时等待现有连接关闭的最长时间
+	IdleTimeout      time.Duration // 单方向无数据超过该时长即断开,0 表示不限制
+	MaxConnLifetime  time.Duration // 连接从建立起超过该时长即主动关闭,即使仍在传输,0 表示不限制
+	AllowHours       *timeWindows  // 只在这些时间段内接受新连接,为空时不限制
+	AllowHoursClose  bool          // 离开允许的时间段时断开现有连接,否则只拒绝新连接
+	HandshakeTimeout time.Duration // 从建立连接到读完 ClientHello/HTTP 请求头的最长时间,0 表示不限制
+	MaxHeaderBytes   int           // HTTP 请求行加请求头的最大字节数,0 表示不限制
+	HalfCloseTimeout time.Duration // 一个方向结束后另一方向最多还能转发多久,0 表示一直等到它结束
+	DialTimeout      time.Duration // 连接后端的超时时间,0 表示使用系统默认
+	KeepAlive        time.Duration // 客户端与后端 TCP 连接的 keepalive 探测间隔,0 表示关闭 keepalive
+	DisableNoDelay   bool          // 关闭两端连接的 TCP_NODELAY,默认与 Go 一致保持开启
+	MaxConns         int           // 最大并发连接数,0 表示不限制
+	MaxConnsPerIP    int           // 单个源 IP 的最大并发连接数,0 表示不限制
+	Workers          int           // 处理连接的固定 worker 数,0 表示每个连接一个 goroutine
+	WorkerQueue      int           // 等待 worker 的连接数上限,队列满时拒绝新连接,0 表示与 Workers 相同
+	RatePerIP        float64       // 每个源 IP 每秒允许的新连接数,0 表示不限制
+	RateLimit        int64         // 单连接每个方向每秒最多转发的字节数,0 表示不限制
+	BufferSize       int           // 转发缓冲区大小,0 表示默认 32KB
+	DNSTTL           time.Duration // 后端主机名解析结果的缓存时间,0 表示每次连接都重新解析
+
+	HealthInterval      time.Duration // 后端健康检查间隔,0 表示不做健康检查
+	HealthFailThreshold int           // 连续失败多少次后标记为 down
+	HealthTLS           bool          // 对 TLS 后端发送 ClientHello 探测而不只是 TCP 拨号
+
+	AllowNoSNI    bool         // 是否放行合法但不带 SNI 的 ClientHello
+	RequireSNI    bool         // 拒绝所有不带 SNI 的 ClientHello,白名单为 * 时也拒绝,与 AllowNoSNI 互斥
+	MinTLSVersion uint16       // 客户端支持的最高 TLS 版本低于该值时拒绝,0 表示不限制
+	Transparent   bool         // 透明代理模式,转发到 SO_ORIGINAL_DST 而不是固定后端
+	SendProxy     bool         // 是否在转发前向后端发送 PROXY protocol v1 头
+	AcceptProxy   bool         // 是否解析入站 PROXY protocol 头获取真实客户端地址
+	ProxyFrom     []*net.IPNet // 开启 AcceptProxy 时允许发送 PROXY 头的对端范围,为空时只信任本机回环地址
+	DenyBody      string       // 拒绝 HTTP 请求时返回的 403 响应正文
+	RewriteHost   string       // 转发非 TLS 请求前把 Host 改写为该值,为空时原样转发
+	XFF           bool         // 转发非 TLS 请求前追加 X-Forwarded-For 并设置 X-Real-IP
+	StrictHTTP    bool         // 逐个解析 keep-alive 连接上的请求并校验 Host,而不是只校验第一个
+	ReusePort     bool         // 用 SO_REUSEPORT 按 GOMAXPROCS 开多个 listener,只支持 Linux,其他平台回退为单个 listener
+
+	AllowPaths   []string // 非 TLS 请求允许的路径前缀,为空时不限制
+	AllowMethods []string // 非 TLS 请求允许的方法,为空时不限制
+
+	TLSTerminate bool        // 用本地证书终止 TLS,解密后按 HTTP 处理并转发到非 TLS 后端
+	TLSConfig    *tls.Config // 终止 TLS 使用的证书配置,TLSTerminate 为 true 时必须设置
+	TLSCerts     *certStore  // 按 SNI 选择证书,为空时只使用 TLSConfig 中的固定证书
+
+	BackendTLS       bool        // 非 TLS 流程(含终止 TLS 之后)以 TLS 连接后端,可以出示客户端证书
+	BackendTLSConfig *tls.Config // 连接后端的 TLS 配置,BackendTLS 为 true 时必须设置
+
+	Protocol string // 入站协议: auto(默认,按首字节区分 TLS/HTTP)、connect(另外支持 HTTP CONNECT)、smtp(STARTTLS)或 socks5
+
+	LoadBalance string // 后端选择策略: failover(默认,按顺序故障转移)或 iphash(一致性哈希)
+	LBHashSNI   bool   // iphash 的哈希 key 除客户端 IP 外再加上 SNI/Host
+
+	SOCKSUsers    map[string]string // SOCKS5 用户名到密码,为空时不要求认证
+	UpstreamSOCKS *socksUpstream    // 出站连接经过的上游 SOCKS5 代理,为空时直连
+	BindIP        net.IP            // 出站连接绑定的出口 IP,为空时由系统选择
+	BindRoutes    []Route           // 按 SNI/Host 选择出口 IP,Addr 为 IP,未命中时使用 BindIP
+
+	UDP            bool          // 同时在 ListenAddr 上透传 UDP,只做 CIDR 白名单判断
+	UDPBackend     string        // UDP 转发目标,为空时使用第一个 TLS 后端
+	UDPIdleTimeout time.Duration // UDP 会话两个方向都无数据超过该时长即关闭,0 表示默认 60 秒
+
+	Logger      *slog.Logger     // 为空时使用 slog.Default()
+	Metrics     *metrics         // 多个 Server 共享的计数器,为空时单独创建
+	Webhook     *webhookNotifier // 多个 Server 共享的连接事件通知,为空时不发送
+	Tracer      *otelExporter    // 多个 Server 共享的 OTLP span 导出器,为空时不追踪
+	Statsd      *statsdReporter  // 多个 Server 共享的 statsd 推送,为空时不推送
+	Bans        *banList         // 多个 Server 共享的自动封禁列表,为空时不封禁
+	Maintenance *maintenanceMode // 多个 Server 共享的维护模式开关,为空时不支持维护模式
+	AccessLog   *accessLog       // 多个 Server 共享的访问日志,为空时不记录
+	RDNS        *rdnsResolver    // 多个 Server 共享的客户端 IP 反向解析缓存,为空时不解析
+}
+
+const defaultBufferSize = 32 * 1024
+
+// nextConnID 是自增的连接编号,贯穿同一连接的所有日志。所有 listener 共用,编号在进程内唯一
+var nextConnID atomic.Uint64
+
+// Server 是带 CIDR 与域名白名单的 TCP 转发代理
+type Server struct {
+	cfg       Config
+	logger    *slog.Logger
+	listeners []net.Listener // 开启 ReusePort 时有多个,各自运行 Accept 循环
+	metrics   *metrics
+	limiter   *ipRateLimiter // 按源 IP 的新连接限流,未开启时为 nil
+	ipConns   *ipConnLimiter // 按源 IP 的并发连接数限制,未开启时为 nil
+	bufPool   sync.Pool      // 转发用的 *[]byte 缓冲区,在连接之间复用以降低 GC 压力
+	health    *healthChecker // 后端健康检查,未开启时为 nil
+	dns       *dnsCache      // 后端主机名解析缓存,未开启时为 nil
+	udp       *udpRelay      // UDP 透传,未开启时为 nil
+	balancer  balancer
+	rules     atomic.Pointer[accessRules]
+	ja3       atomic.Pointer[ja3Rules]
+	routes    atomic.Pointer[[]Route] // 当前的 FileRoutes
+	jobs      chan connJob            // worker pool 的任务队列,未开启时为 nil
+
+	activeConnections int32    // 用于跟踪活跃连接的数量
+	sessions          sync.Map // conn_id -> *session,供管理接口查询和断开连接
+
+	// ctx 是所有连接 context 的根,排空超时时取消,所有连接随之关闭
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	shutdownOnce sync.Once
+	serving      atomic.Bool   // Serve 已开始接受连接
+	draining     atomic.Bool   // Shutdown 已开始,不再接受新连接
+	done         chan struct{} // Shutdown 排空结束后关闭
+}
+
+// accessRules 是可以在运行时整体替换的 CIDR 与域名白名单
+type accessRules struct {
+	nets       []*net.IPNet
+	deniedNets []*net.IPNet
+	domains    *domainSet
+	denied     *domainSet
+	domainList []string // domains 的原始模式,供管理接口读取
+}
+
+// NewServer 校验配置并监听 cfg.ListenAddr,调用 Serve 后开始接受连接
+func NewServer(cfg Config) (*Server, error) {
+	if len(cfg.PlainBackends) == 0 && len(cfg.DestAddrs) > 0 {
+		cfg.PlainBackends = cfg.DestAddrs[:1]
+	}
+	if len(cfg.TLSBackends) == 0 {
+		if len(cfg.DestAddrs) >= 2 {
+			cfg.TLSBackends = cfg.DestAddrs[1:2] // 使用第二个地址
+		} else {
+			cfg.TLSBackends = cfg.PlainBackends // 只有一个地址也可以使用
+		}
+	}
+	if len(cfg.PlainBackends) == 0 || len(cfg.TLSBackends) == 0 {
+		return nil, errors.New("至少需要一个转发目标地址")
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+	for _, p := range cfg.AllowPaths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("允许的路径前缀必须以 / 开头: %s", p)
+		}
+	}
+	methods := make([]string, len(cfg.AllowMethods))
+	for i, m := range cfg.AllowMethods {
+		methods[i] = strings.ToUpper(m)
+	}
+	cfg.AllowMethods = methods
+	if cfg.TLSTerminate && cfg.TLSConfig == nil {
+		return nil, errors.New("终止 TLS 需要指定证书和私钥")
+	}
+	if cfg.BackendTLS && cfg.BackendTLSConfig == nil {
+		return nil, errors.New("以 TLS 连接后端需要指定 BackendTLSConfig")
+	}
+	switch cfg.Protocol {
+	case "":
+		cfg.Protocol = protocolAuto
+	case protocolAuto, protocolSMTP, protocolSOCKS5, protocolConnect:
+	default:
+		return nil, fmt.Errorf("未知的协议: %s", cfg.Protocol)
+	}
+	switch cfg.LoadBalance {
+	case "":
+		cfg.LoadBalance = lbFailover
+	case lbFailover, lbIPHash:
+	default:
+		return nil, fmt.Errorf("未知的负载均衡策略: %s", cfg.LoadBalance)
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	var listeners []net.Listener
+	var err error
+	switch {
+	case !cfg.ReusePort || strings.HasPrefix(cfg.ListenAddr, "unix:"):
+		var listener net.Listener
+		if listener, err = listen(cfg.ListenAddr); err == nil {
+			listeners = []net.Listener{listener}
+		}
+	case !reusePortSupported:
+		logger.Warn("当前平台不支持 SO_REUSEPORT，使用单个 listener", "event", "listen", "src", cfg.ListenAddr)
+		var listener net.Listener
+		if listener, err = net.Listen("tcp", cfg.ListenAddr); err == nil {
+			listeners = []net.Listener{listener}
+		}
+	default:
+		listeners, err = listenReusePort(cfg.ListenAddr, runtime.GOMAXPROCS(0))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无法监听 %s: %w", cfg.ListenAddr, err)
+	}
+	listener := listeners[0]
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	s := &Server{
+		cfg:       cfg,
+		logger:    logger,
+		listeners: listeners,
+		metrics:   cfg.Metrics,
+		done:      make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	if s.metrics == nil {
+		s.metrics = newMetrics()
+	}
+	if cfg.AllowedDomains == nil {
+		cfg.AllowedDomains = []string{"*"}
+	}
+	s.SetAccessRules(cfg.AllowedNets, cfg.DeniedNets, cfg.AllowedDomains, cfg.DeniedDomains)
+	s.SetJA3Rules(cfg.JA3Allow, cfg.JA3Deny)
+	s.SetFileRoutes(cfg.FileRoutes)
+	if cfg.RatePerIP > 0 {
+		s.limiter = newIPRateLimiter(cfg.RatePerIP)
+	}
+	if cfg.MaxConnsPerIP > 0 {
+		s.ipConns = newIPConnLimiter(cfg.MaxConnsPerIP)
+	}
+	if cfg.Workers > 0 {
+		if cfg.WorkerQueue <= 0 {
+			s.cfg.WorkerQueue = cfg.Workers
+		}
+		s.jobs = make(chan connJob, s.cfg.WorkerQueue)
+	}
+	s.bufPool.New = func() any {
+		buf := make([]byte, cfg.BufferSize)
+		return &buf
+	}
+	if cfg.DNSTTL > 0 {
+		s.dns = newDNSCache(cfg.DNSTTL, logger)
+	}
+	if cfg.HealthInterval > 0 {
+		s.health = newHealthChecker(s)
+	}
+	if cfg.UDP {
+		if strings.HasPrefix(cfg.ListenAddr, "unix:") {
+			closeListeners()
+			return nil, errors.New("UDP 转发不支持 unix socket 监听地址")
+		}
+		backend := cfg.UDPBackend
+		if backend == "" {
+			backend = cfg.TLSBackends[0]
+		}
+		idle := cfg.UDPIdleTimeout
+		if idle <= 0 {
+			idle = defaultUDPIdleTimeout
+		}
+		// 监听端口为 0 时与 TCP 使用同一个实际端口
+		if s.udp, err = newUDPRelay(s, listener.Addr().String(), backend, idle, cfg.ReusePort && reusePortSupported); err != nil {
+			closeListeners()
+			return nil, fmt.Errorf("无法监听 UDP %s: %w", cfg.ListenAddr, err)
+		}
+	}
+	return s, nil
+}
+
+// SetAccessRules 原子替换 CIDR 白名单与域名白名单、黑名单,只影响之后新建的连接;
+// domains 为空时拒绝所有域名
+func (s *Server) SetAccessRules(nets, deniedNets []*net.IPNet, domains, denied []string) {
+	s.rules.Store(&accessRules{
+		nets:       nets,
+		deniedNets: deniedNets,
+		domains:    newDomainSet(domains),
+		denied:     newDomainSet(denied),
+		domainList: slices.Clone(domains),
+	})
+}
+
+// AllowedDomains 返回当前的域名白名单
+func (s *Server) AllowedDomains() []string {
+	return slices.Clone(s.rules.Load().domainList)
+}
+
+// UpdateAllowedDomains 用 update 的返回值替换域名白名单,CIDR 与黑名单保持不变。
+// 与 SetAccessRules 并发时用 CAS 重试,保证基于最新的白名单计算,改动对新连接原子生效
+func (s *Server) UpdateAllowedDomains(update func(domains []string) []string) []string {
+	for {
+		old := s.rules.Load()
+		domains := update(slices.Clone(old.domainList))
+		rules := &accessRules{nets: old.nets, deniedNets: old.deniedNets, domains: newDomainSet(domains), denied: old.denied, domainList: domains}
+		if s.rules.CompareAndSwap(old, rules) {
+			return slices.Clone(domains)
+		}
+	}
+}
+
+// ja3Rules 是 JA3 指纹(MD5)的白名单与黑名单,allow 为空表示不限制
+type ja3Rules struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// SetFileRoutes 原子替换从路由文件加载的 SNI 路由,routes 需已按具体程度排序,只影响之后新建的连接
+func (s *Server) SetFileRoutes(routes []Route) {
+	s.routes.Store(&routes)
+}
+
+// SetJA3Rules 原子替换 JA3 指纹白名单与黑名单,只影响之后新建的连接
+func (s *Server) SetJA3Rules(allow, deny []string) {
+	rules := &ja3Rules{allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, h := range allow {
+		rules.allow[strings.ToLower(h)] = true
+	}
+	for _, h := range deny {
+		rules.deny[strings.ToLower(h)] = true
+	}
+	s.ja3.Store(rules)
+}
+
+// Addr 返回实际监听的地址
+func (s *Server) Addr() net.Addr {
+	return s.listeners[0].Addr()
+}
+
+// ActiveConnections 返回当前活跃连接数
+func (s *Server) ActiveConnections() int32 {
+	return atomic.LoadInt32(&s.activeConnections)
+}
+
+// Serve 接受并处理连接,直到 ctx 被取消或调用 Shutdown;排空结束后返回
+func (s *Server) Serve(ctx context.Context) error {
+	s.logger.Info("正在监听并转发", "event", "listen", "src", s.cfg.ListenAddr, "dst_plain", s.cfg.PlainBackends, "dst_tls", s.cfg.TLSBackends, "listeners", len(s.listeners))
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Shutdown()
+		case <-s.done:
+		}
+	}()
+
+	if s.health != nil {
+		go s.health.run(s.done)
+	}
+	if s.dns != nil {
+		go s.dns.run(s.done, s.cfg.DialTimeout)
+	}
+	if s.ipConns != nil {
+		go s.ipConns.run(s.done, time.Minute)
+	}
+	if s.udp != nil {
+		go s.udp.serve()
+	}
+	if s.jobs != nil {
+		s.runWorkers()
+	}
+	if s.cfg.AllowHours != nil && s.cfg.AllowHoursClose {
+		go s.enforceAllowHours(s.done)
+	}
+	s.serving.Store(true)
+
+	for _, l := range s.listeners[1:] {
+		go s.accept(l)
+	}
+	s.accept(s.listeners[0])
+	<-s.done
+	return nil
+}
+
+// accept 在 l 上循环接受连接并交给 handleConnection,直到 l 被 Shutdown 关闭
+func (s *Server) accept(l net.Listener) {
+	for {
+		// 接受客户端连接
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Error("接受连接时发生错误", "event", "accept_error", "error", err)
+			continue
+		}
+
+		// 检查来源IP是否在白名单内;unix socket 连接没有来源 IP,只可能来自本机,跳过 IP 相关的判断
+		clientIP, hasIP := remoteIP(conn.RemoteAddr())
+
+		if s.cfg.AllowHours != nil && !s.cfg.AllowHours.contains(time.Now()) {
+			s.logger.Warn("拒绝访问: 不在允许访问的时间段内", "event", "reject", "reason", rejectAllowHours, "client_ip", clientIP, "allow_hours", s.cfg.AllowHours.spec)
+			s.metrics.reject(rejectAllowHours)
+			conn.Close()
+			continue
+		}
+
+		// 开启 -accept-proxy 且对端是可信的负载均衡时,封禁和 CIDR 判断推迟到解析出真实客户端 IP 之后;
+		// 不可信的对端仍按 TCP 来源地址判断,随后在 handleConnection 中拒绝
+		proxied := s.cfg.AcceptProxy && s.trustedProxy(conn.RemoteAddr())
+		if hasIP && !proxied && s.banned(clientIP) {
+			s.logger.Debug("拒绝访问: 源 IP 处于封禁期", "event", "reject", "reason", rejectBanned, "client_ip", clientIP)
+			s.metrics.reject(rejectBanned)
+			conn.Close()
+			continue
+		}
+		if hasIP && !proxied {
+			if reason := s.rules.Load().checkIP(net.ParseIP(clientIP)); reason != "" {
+				s.logger.Warn("拒绝访问: "+cidrRejectMessages[reason], "event", "reject", "reason", reason, "client_ip", clientIP)
+				s.metrics.reject(reason)
+				s.recordFailure(clientIP)
+				conn.Close()
+				continue
+			}
+		}
+
+		// 按源 IP 限制新连接速率,必须在增加活跃连接数之前判断。可信的负载均衡后面所有客户端共用它的地址,
+		// 改为在 handleConnection 中按 PROXY 头中的真实客户端 IP 判断;不可信对端的头不能采信,仍按 TCP 来源地址限流
+		if hasIP && !proxied && s.limiter != nil && !s.limiter.allow(clientIP) {
+			s.logger.Warn("拒绝访问: 源 IP 新连接速率超限", "event", "reject", "reason", rejectRateLimited, "client_ip", clientIP, "rate_per_ip", s.cfg.RatePerIP)
+			s.metrics.reject(rejectRateLimited)
+			s.recordFailure(clientIP)
+			conn.Close()
+			continue
+		}
+
+		// 限制单个源 IP 的并发连接数,避免一个客户端占满 MaxConns。对端是可信的负载均衡时同样推迟到解析出真实客户端 IP 之后
+		var ipSlot *int32
+		if hasIP && !proxied && s.ipConns != nil {
+			if ipSlot = s.ipConns.acquire(clientIP); ipSlot == nil {
+				s.logger.Warn("拒绝访问: 源 IP 并发连接数超限", "event", "reject", "reason", rejectMaxConnsPerIP, "client_ip", clientIP, "max_conns_per_ip", s.cfg.MaxConnsPerIP)
+				s.metrics.reject(rejectMaxConnsPerIP)
+				conn.Close()
+				continue
+			}
+		}
+
+		// 增加活跃连接数,达到上限时拒绝
+		if !s.acquireConnSlot() {
+			s.logger.Warn("达到最大连接数，拒绝新连接", "event", "reject", "reason", rejectMaxConns, "client_ip", clientIP, "max_conns", s.cfg.MaxConns)
+			s.metrics.reject(rejectMaxConns)
+			if ipSlot != nil {
+				atomic.AddInt32(ipSlot, -1)
+			}
+			conn.Close()
+			continue
+		}
+
+		// 处理连接
+		if !s.dispatch(connJob{conn: conn, ipSlot: ipSlot}) {
+			s.logger.Warn("worker 队列已满，拒绝新连接", "event", "reject", "reason", rejectWorkersBusy, "client_ip", clientIP, "workers", s.cfg.Workers)
+			s.metrics.reject(rejectWorkersBusy)
+			atomic.AddInt32(&s.activeConnections, -1)
+			if ipSlot != nil {
+				atomic.AddInt32(ipSlot, -1)
+			}
+			conn.Close()
+			continue
+		}
+		s.metrics.accepted.Add(1)
+	}
+}
+
+// Shutdown 停止接受新连接,等待活跃连接归零,超过 DrainTimeout 后强制关闭剩余连接。
+// 可以多次调用,后续调用会等待第一次调用完成。
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		s.draining.Store(true)
+		for _, l := range s.listeners {
+			l.Close()
+		}
+		if s.udp != nil {
+			s.udp.close()
+		}
+		s.drainConnections()
+		s.cancel(nil)
+		s.closeQueued()
+		close(s.done)
+	})
+}
+
+// acquireConnSlot 在未超过 MaxConns 时把活跃连接数加一,用 CAS 保证并发下不会超过上限
+func (s *Server) acquireConnSlot() bool {
+	limit := int32(s.cfg.MaxConns)
+	if limit <= 0 {
+		atomic.AddInt32(&s.activeConnections, 1)
+		return true
+	}
+	for {
+		current := atomic.LoadInt32(&s.activeConnections)
+		if current >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.activeConnections, current, current+1) {
+			return true
+		}
+	}
+}
+
+// drainConnections 等待活跃连接归零,超过 DrainTimeout 后取消根 context,强制关闭剩余连接
+func (s *Server) drainConnections() {
+	deadline := time.After(s.cfg.DrainTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		remaining := s.ActiveConnections()
+		if remaining == 0 {
+			s.logger.Info("所有连接已关闭", "event", "drained")
+			return
+		}
+		s.logger.Info("正在排空连接", "event", "draining", "active", remaining)
+
+		select {
+		case <-deadline:
+			s.logger.Warn("排空超时，强制关闭剩余连接", "event", "drain_timeout", "active", remaining)
+			s.cancel(causeDrainTimeout)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeCause 是取消连接 context 的原因,同时作为该连接的 close_reason
+type closeCause string
+
+func (c closeCause) Error() string { return string(c) }
+
+const (
+	causeKilled       closeCause = "killed"            // 通过管理接口断开
+	causeDrainTimeout closeCause = "drain_timeout"     // 退出时排空超时
+	causeAllowHours   closeCause = "allow_hours_close" // 超出允许访问的时间段
+)
+
+// closeOnCancel 在 sess.ctx 被取消时关闭 conn,返回的 stop 解除关联,应在 conn 关闭前调用。
+// 关闭而不是把 deadline 设为过去:空闲超时在每次读之前都会重设 deadline,会把取消覆盖掉;
+// 关闭后两个方向阻塞中的读写都立即返回 net.ErrClosed,转发随之结束
+func (sess *session) closeOnCancel(conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(sess.ctx, func() { conn.Close() })
+}
+
+// listen 监听 TCP 地址,或 unix:/path/to.sock 形式的 unix socket。
+// unix socket 文件在 listener 关闭时由标准库删除
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// 上次异常退出会残留 socket 文件导致监听失败;确认没有进程在使用后再删除
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s 正在被其它进程使用", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// listenReusePort 用 SO_REUSEPORT 在 addr 上开 n 个 TCP listener,由内核把新连接分散到各个 listener。
+// 端口为 0 时其余 listener 绑定第一个实际分到的端口
+func listenReusePort(addr string, n int) ([]net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		addr = l.Addr().String()
+	}
+	return listeners, nil
+}
+
+// remoteIP 返回地址中的 IP;unix socket 等没有 IP 的地址返回网络类型(如 "unix")和 false。
+// IPv6 链路本地地址带有 zone(如 fe80::1%eth0),net.ParseIP 无法解析,这里去掉 zone 只保留 IP
+func remoteIP(addr net.Addr) (string, bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.Network(), false
+	}
+	host, _, _ = strings.Cut(host, "%")
+	return host, true
+}
+
+// session 是单个客户端连接的处理上下文
+type session struct {
+	id         uint64
+	conn       net.Conn
+	raw        net.Conn     // Accept 返回的原始连接,conn 在终止 TLS 后会被替换,断开连接时关闭 raw
+	clientAddr net.Addr     // 真实客户端地址,开启 AcceptProxy 时来自 PROXY protocol 头
+	logger     *slog.Logger // 带有 conn_id 等该连接公共字段的 logger
+	start      time.Time
+
+	bytesIn  atomic.Int64 // 客户端发往后端的字节数
+	bytesOut atomic.Int64 // 后端发往客户端的字节数
+
+	// 以下字段供 webhook 事件和访问日志使用
+	host        string // TLS 连接的 SNI 或非TLS 连接的 Host
+	dst         string // 实际连接的后端地址
+	closeReason string // 拒绝原因或导致连接结束的错误类型,正常结束时为空
+	closedBy    string // 先断开的一方: client、backend、idle_timeout、max_lifetime 或 strict_http,未开始转发时为空
+
+	smtpHelo string        // SMTP 模式下客户端的 EHLO 命令,连上后端后原样重放
+	req      *http.Request // 非TLS 连接的请求头
+	tls      bool          // 客户端连接是否为 TLS:已读到合法的 ClientHello,或终止 TLS 时握手成功
+	status   int           // 返回给客户端的 HTTP 状态码,转发的请求为 0
+
+	// 开启 OTel 追踪时该连接的 trace ID 与根 span ID,子 span 都挂在根 span 下
+	traceID      [16]byte
+	spanID       [8]byte
+	handshakeEnd time.Time // 握手阶段结束的时间,未走完握手时为零值
+
+	// ctx 派生自 Server 的根 context,连接结束、管理接口断开或排空超时时取消,
+	// 客户端连接、后端连接和进行中的拨号都随之结束;取消原因见 closeCause
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// 处理连接的协程之外(管理接口)读取的状态
+	route atomic.Pointer[sessionRoute] // 开始转发时的客户端、域名与后端,握手阶段为空
+
+	rdns *rdnsEntry // 客户端 IP 的反向解析,开启 RDNS 且连接被放行后才有
+}
+
+// sessionRoute 是开始转发时 session 中路由相关字段的快照
+type sessionRoute struct {
+	clientIP string
+	host     string
+	dst      string
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	clientIP, _ := remoteIP(conn.RemoteAddr())
+	sess := &session{
+		id:         nextConnID.Add(1),
+		conn:       conn,
+		raw:        conn,
+		clientAddr: conn.RemoteAddr(),
+		start:      time.Now(),
+	}
+	if s.cfg.Tracer != nil {
+		sess.traceID, sess.spanID = newTraceID(), newSpanID()
+	}
+	sess.ctx, sess.cancel = context.WithCancelCause(s.ctx)
+	stop := sess.closeOnCancel(conn)
+	sess.logger = s.logger.With("conn_id", sess.id, "client_ip", clientIP)
+	sess.logger.Info("新连接建立", "event", "accept", "active", s.ActiveConnections())
+	setSocketOptions(conn, s.cfg.KeepAlive, !s.cfg.DisableNoDelay)
+	s.sessions.Store(sess.id, sess)
+
+	defer func() {
+		// 减少活跃连接数
+		atomic.AddInt32(&s.activeConnections, -1)
+		s.sessions.Delete(sess.id)
+		closeArgs := []any{"event", "close",
+			"bytes_in", sess.bytesIn.Load(), "bytes_out", sess.bytesOut.Load(), "closed_by", sess.closedBy,
+			"duration", time.Since(sess.start).Round(time.Millisecond), "active", s.ActiveConnections()}
+		if s.cfg.RDNS != nil {
+			closeArgs = append(closeArgs, "rdns", sess.rdns.result())
+		}
+		sess.logger.Info("连接关闭", closeArgs...)
+		var cause closeCause
+		if errors.As(context.Cause(sess.ctx), &cause) {
+			sess.closeReason = string(cause)
+		}
+		if sess.closeReason == "" {
+			sess.closeReason = "closed"
+		}
+		s.notify(sess, "close")
+		s.traceConnection(sess)
+		s.metrics.connDuration.observe(sess.tls, time.Since(sess.start))
+		s.cfg.Statsd.timing("connection.duration", time.Since(sess.start))
+		if s.cfg.AccessLog != nil {
+			s.cfg.AccessLog.log(sess)
+		}
+		stop()
+		sess.cancel(nil)
+		conn.Close()
+	}()
+
+	// 握手阶段(PROXY 头、ClientHello 或 HTTP 请求头)整体限时,防止 slowloris 式的慢速握手占着连接,
+	// 开始转发前由 endHandshake 清除
+	if s.cfg.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.cfg.HandshakeTimeout))
+	}
+
+	// 只有 auto 需要按首包识别协议。SMTP 由服务端先发送问候,客户端在此之前不会发送数据;
+	// SOCKS5 的方法协商可能只有 3 字节。这两种协议只有 PROXY 头需要先读
+	probe := s.cfg.Protocol == protocolAuto || s.cfg.Protocol == protocolConnect
+
+	// PROXY 头中的客户端 IP 可以随意填写,只有 ProxyFrom 内的对端(负载均衡)发来的才可信,
+	// 否则任何能连上端口的主机都能冒充白名单内的 IP
+	if s.cfg.AcceptProxy && !s.trustedProxy(conn.RemoteAddr()) {
+		sess.logger.Warn("拒绝访问: 对端不在 -proxy-from 范围内，不信任其 PROXY protocol 头", "event", "reject", "reason", rejectUntrustedProxy)
+		s.reject(sess, rejectUntrustedProxy)
+		return
+	}
+
+	// 先只读 5 字节,刚好是 TLS 记录头;TLS 时再由 clienthello.Read 按 recordLen 精确读取完整记录
+	var initialData []byte
+	if probe || s.cfg.AcceptProxy {
+		var err error
+		initialData, err = clienthello.ReadAtLeast(conn, nil, 5)
+		if err != nil {
+			s.logHandshakeError(sess, "读取连接数据时发生错误", err)
+			return
+		}
+	}
+
+	if s.cfg.AcceptProxy {
+		addr, rest, err := readProxyHeader(conn, initialData)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.logHandshakeError(sess, "", err)
+			return
+		}
+		if err != nil {
+			sess.logger.Warn("拒绝访问: PROXY protocol 头非法", "event", "reject", "reason", rejectProxy, "error", err)
+			s.reject(sess, rejectProxy)
+			return
+		}
+		if addr != nil {
+			sess.clientAddr = addr
+		}
+
+		realIP, hasIP := remoteIP(sess.clientAddr)
+		sess.logger = s.logger.With("conn_id", sess.id, "client_ip", realIP, "proxy_ip", clientIP)
+		if hasIP && s.banned(realIP) {
+			sess.logger.Debug("拒绝访问: 源 IP 处于封禁期", "event", "reject", "reason", rejectBanned)
+			s.metrics.reject(rejectBanned)
+			sess.closeReason = string(rejectBanned)
+			return
+		}
+		if hasIP {
+			if reason := s.rules.Load().checkIP(net.ParseIP(realIP)); reason != "" {
+				sess.logger.Warn("拒绝访问: "+cidrRejectMessages[reason], "event", "reject", "reason", reason)
+				s.reject(sess, reason)
+				return
+			}
+		}
+		if hasIP && s.limiter != nil && !s.limiter.allow(realIP) {
+			sess.logger.Warn("拒绝访问: 源 IP 新连接速率超限", "event", "reject", "reason", rejectRateLimited, "rate_per_ip", s.cfg.RatePerIP)
+			s.reject(sess, rejectRateLimited)
+			return
+		}
+		if hasIP && s.ipConns != nil {
+			ipSlot := s.ipConns.acquire(realIP)
+			if ipSlot == nil {
+				sess.logger.Warn("拒绝访问: 源 IP 并发连接数超限", "event", "reject", "reason", rejectMaxConnsPerIP, "max_conns_per_ip", s.cfg.MaxConnsPerIP)
+				s.metrics.reject(rejectMaxConnsPerIP)
+				sess.closeReason = string(rejectMaxConnsPerIP)
+				return
+			}
+			defer atomic.AddInt32(ipSlot, -1)
+		}
+		sess.logger.Debug("允许访问: IP 在允许的范围内", "event", "allow")
+
+		// 头之后的剩余数据不足记录头长度时继续读取
+		initialData = rest
+		if probe {
+			initialData, err = clienthello.ReadAtLeast(conn, rest, 5)
+			if err != nil {
+				s.logHandshakeError(sess, "读取连接数据时发生错误", err)
+				return
+			}
+		}
+	}
+
+	if s.cfg.Maintenance.enabled() {
+		s.rejectMaintenance(sess, initialData)
+		return
+	}
+
+	plainBackends, tlsBackends := s.cfg.PlainBackends, s.cfg.TLSBackends
+	if s.cfg.Transparent {
+		if addr, ok := s.transparentDst(sess); ok {
+			plainBackends, tlsBackends = []string{addr}, []string{addr}
+		}
+	}
+
+	// 签名路由优先于 TLS/HTTP 识别,未命中时按首字节区分
+	if probe && len(s.cfg.SignatureRoutes) > 0 {
+		route, data, err := matchSignature(conn, initialData, s.cfg.SignatureRoutes)
+		if err != nil {
+			s.logHandshakeError(sess, "读取连接数据时发生错误", err)
+			return
+		}
+		initialData = data
+		if route != nil {
+			sess.logger.Debug("首包命中签名路由", "event", "detect", "signature", route.Spec, "dst", route.Addr)
+			s.handleSignature(sess, route, initialData)
+			return
+		}
+	}
+
+	if s.cfg.Protocol == protocolSMTP {
+		sess.logger.Debug("SMTP 连接，等待 STARTTLS", "event", "detect", "dst", tlsBackends)
+		s.handleSMTP(sess, tlsBackends, initialData)
+	} else if s.cfg.Protocol == protocolSOCKS5 {
+		sess.logger.Debug("SOCKS5 连接，等待 CONNECT 请求", "event", "detect")
+		s.handleSOCKS5(sess, initialData)
+	} else if initialData[0] == 0x16 && s.cfg.TLSTerminate {
+		sess.logger.Debug("识别为 TLS 连接，本地终止 TLS", "event", "detect", "dst", plainBackends)
+		s.handleTLSTerminate(sess, plainBackends, initialData)
+	} else if initialData[0] == 0x16 { // 判断是否是TLS握手开始的第一个字节
+		// TLS 数据处理
+		sess.logger.Debug("识别为 TLS 连接", "event", "detect", "dst", tlsBackends)
+		s.handleHTTPS(sess, tlsBackends, initialData)
+	} else {
+		// HTTP 数据处理
+		sess.logger.Debug("识别为非TLS 连接", "event", "detect", "dst", plainBackends)
+		s.handleHTTP(sess, plainBackends, initialData)
+	}
+}
+
+// logHandshakeError 记录握手阶段的读取错误,超过 HandshakeTimeout 的单独记为握手超时
+func (s *Server) logHandshakeError(sess *session, msg string, err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		sess.logger.Warn("握手超时", "event", "handshake_timeout", "handshake_timeout", s.cfg.HandshakeTimeout, "error", err)
+		s.reject(sess, rejectHandshakeTimeout)
+		return
+	}
+	sess.logger.Warn(msg, "event", "read_error", "error", err)
+	sess.closeReason = "read_error"
+}
+
+// reject 记录拒绝计数,并作为 webhook 事件的 close_reason,同时计入自动封禁的失败次数。
+// PROXY 头非法时来源地址是负载均衡而不是客户端,不计入封禁
+func (s *Server) reject(sess *session, reason rejectReason) {
+	s.metrics.reject(reason)
+	sess.closeReason = string(reason)
+	if ip, ok := remoteIP(sess.clientAddr); ok && reason != rejectProxy && reason != rejectMaintenance {
+		s.recordFailure(ip)
+	}
+}
+
+// trustedProxy 判断 TCP 对端是否可以发送 PROXY 头:unix socket 只可能来自本机,直接信任;
+// 其余对端必须落在 ProxyFrom 内,ProxyFrom 为空时只信任回环地址
+func (s *Server) trustedProxy(peer net.Addr) bool {
+	host, ok := remoteIP(peer)
+	if !ok {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if len(s.cfg.ProxyFrom) == 0 {
+		return ip.IsLoopback()
+	}
+	return isAllowedIP(ip, s.cfg.ProxyFrom)
+}
+
+// banned 判断源 IP 是否处于自动封禁期
+func (s *Server) banned(ip string) bool {
+	return s.cfg.Bans != nil && s.cfg.Bans.banned(ip)
+}
+
+// recordFailure 记录源 IP 被拒绝一次,未开启自动封禁时什么也不做
+func (s *Server) recordFailure(ip string) {
+	if s.cfg.Bans != nil {
+		s.cfg.Bans.fail(ip)
+	}
+}
+
+// notify 异步发送连接事件,未配置 webhook 时不发送。开始转发(open)时同时记录路由快照供管理接口查询,
+// 开启 RDNS 时在后台开始反向解析客户端 IP
+func (s *Server) notify(sess *session, event string) {
+	clientIP, isIP := remoteIP(sess.clientAddr)
+	if event == "open" {
+		sess.route.Store(&sessionRoute{clientIP: clientIP, host: sess.host, dst: sess.dst})
+		if s.cfg.RDNS != nil && isIP {
+			sess.rdns = s.cfg.RDNS.lookup(clientIP)
+		}
+	}
+	if s.cfg.Webhook == nil {
+		return
+	}
+	ev := webhookEvent{
+		Event:      event,
+		Time:       time.Now(),
+		Listener:   s.cfg.ListenAddr,
+		ConnID:     sess.id,
+		ClientIP:   clientIP,
+		Host:       sess.host,
+		Dst:        sess.dst,
+		BytesIn:    sess.bytesIn.Load(),
+		BytesOut:   sess.bytesOut.Load(),
+		DurationMS: time.Since(sess.start).Milliseconds(),
+	}
+	if event == "close" {
+		ev.CloseReason = sess.closeReason
+	}
+	s.cfg.Webhook.notify(ev)
+}
+
+// endHandshake 在握手数据读完后清除握手超时
+func (s *Server) endHandshake(sess *session) {
+	if sess.handshakeEnd.IsZero() {
+		sess.handshakeEnd = time.Now()
+	}
+	if s.cfg.HandshakeTimeout > 0 {
+		sess.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// transparentDst 取得被 iptables 重定向之前的原始目标地址;拿不到,
+// 或原始目标就是本机监听地址(客户端直连、没有经过 REDIRECT)时返回 false,回落到 -dst
+func (s *Server) transparentDst(sess *session) (string, bool) {
+	addr, err := originalDst(sess.conn)
+	if errors.Is(err, os.ErrNotExist) {
+		// ENOENT 表示连接没有经过 NAT,是客户端直接连过来的
+		sess.logger.Debug("连接未经过 REDIRECT，回落到 -dst", "event", "original_dst")
+		return "", false
+	}
+	if err != nil {
+		sess.logger.Warn("无法获取原始目标地址，回落到 -dst", "event", "original_dst", "error", err)
+		return "", false
+	}
+	if addr == sess.conn.LocalAddr().String() {
+		sess.logger.Debug("原始目标就是本机监听地址，回落到 -dst", "event", "original_dst", "original_dst", addr)
+		return "", false
+	}
+	sess.logger.Debug("透明代理原始目标地址", "event", "original_dst", "original_dst", addr)
+	return addr, true
+}
+
+func (s *Server) handleHTTP(sess *session, backends []string, initialData []byte) {
+	conn := sess.conn
+
+	// 记录 bufio 从客户端读走的全部原始字节,校验通过后原样重放给后端,保证请求体完整。
+	// 需要改写请求头(Host、X-Forwarded-For)或逐个校验请求(StrictHTTP)时请求由 req.Write 重新生成,不需要记录
+	rewrite := s.cfg.RewriteHost != "" || s.cfg.XFF
+	var consumed bytes.Buffer
+	var src io.Reader = io.MultiReader(bytes.NewReader(initialData), conn)
+	if !rewrite && !s.cfg.StrictHTTP {
+		src = io.TeeReader(src, &consumed)
+	}
+	limit := &headerLimitReader{r: src}
+	reader := bufio.NewReader(limit)
+	req, err := s.readRequest(reader, limit)
+	if errors.Is(err, errHeaderTooLarge) {
+		sess.logger.Warn("拒绝访问: HTTP 请求头过大", "event", "reject", "reason", rejectHeaderTooLarge, "max_header_bytes", s.cfg.MaxHeaderBytes)
+		s.reject(sess, rejectHeaderTooLarge)
+		io.WriteString(conn, "HTTP/1.1 431 Request Header Fields Too Large\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		sess.status = http.StatusRequestHeaderFieldsTooLarge
+		return
+	}
+	if err != nil {
+		s.logHandshakeError(sess, "读取 HTTP 请求时发生错误", err)
+		return
+	}
+	s.endHandshake(sess)
+
+	host := requestHost(req)
+	sess.host = host
+	sess.req = req
+
+	if reason, msg := s.checkRequest(req, host); reason != "" {
+		sess.logger.Warn(msg, "event", "reject", "reason", reason, "host", host, "method", req.Method, "path", req.URL.Path)
+		s.reject(sess, reason)
+		s.writeForbidden(conn)
+		sess.status = http.StatusForbidden
+		return
+	}
+	sess.logger = sess.logger.With("host", host)
+	sess.logger.Info("允许访问: Host 在允许的域名列表中", "event", "allow")
+	if isWebSocketUpgrade(req) {
+		// 升级请求与普通请求走同一条路径:请求头和 bufio 中已缓冲的帧原样(或改写后)发给后端,
+		// 之后不再解析 HTTP,后端回 101 后的 WebSocket 帧由 handleTCPForward 做裸 TCP 双向转发
+		sess.logger.Info("WebSocket 升级", "event", "websocket", "path", req.URL.Path)
+	}
+
+	// connect 模式下 CONNECT 请求连接请求中的目标,其余请求仍转发到后端
+	if s.cfg.Protocol == protocolConnect && req.Method == http.MethodConnect {
+		s.handleConnect(sess, req, reader)
+		return
+	}
+
+	// 建立与目标服务器的连接并转发数据
+	forwardConn, forwardAddr, err := s.dialBackends(sess, backends)
+	if err != nil {
+		return
+	}
+	sess.logger.Info("转发非TLS 数据", "event", "forward", "dst", forwardAddr)
+
+	// 改写请求头或逐个校验请求时,请求由 sess.conn 上替换后的读取端重新生成,不需要重放已读取的字节
+	initial := consumed.Bytes()
+	if rewrite || s.cfg.StrictHTTP {
+		initial = nil
+	}
+	var pending io.Closer
+	var violation *atomic.Pointer[strictViolation]
+	s.relayTo(sess, forwardConn, forwardAddr, true, func(forwardConn net.Conn) (net.Conn, bool) {
+		// PROXY 头走明文,之后与后端握手 TLS,请求经加密后转发
+		if s.cfg.BackendTLS {
+			tlsConn, err := s.backendTLSHandshake(sess, forwardConn, forwardAddr)
+			if err != nil {
+				sess.logger.Error("无法与目标服务器建立 TLS 连接", "event", "backend_tls_error", "dst", forwardAddr, "error", err)
+				sess.closeReason = "backend_tls_error"
+				return nil, false
+			}
+			// 关闭底层连接即可打断 TLS 连接上的读写,不需要重新关联
+			forwardConn = tlsConn
+		}
+		if s.cfg.StrictHTTP {
+			pending, violation = s.strictRequests(sess, req, reader, limit, forwardConn)
+		} else if rewrite {
+			pending = s.rewriteRequest(sess, req, reader)
+		}
+		return forwardConn, true
+	}, initial)
+	if pending != nil {
+		pending.Close()
+	}
+	if violation != nil {
+		if v := violation.Load(); v != nil {
+			sess.logger.Warn(v.msg, "event", "reject", "reason", v.reason, "request_host", v.host, "method", v.method, "path", v.path, "request", v.index)
+			s.reject(sess, v.reason)
+			sess.closedBy = "strict_http"
+		}
+	}
+}
+
+// isWebSocketUpgrade 判断请求是否为 WebSocket 升级:Connection 中含 upgrade 且 Upgrade 中含 websocket,均不区分大小写
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken 判断逗号分隔的头部列表中是否有 token,头部可以出现多次
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errHeaderTooLarge = errors.New("HTTP 请求头超过大小上限")
+
+// headerLimitReader 限制读取请求头期间从 r 读走的字节数,额度用完后返回 errHeaderTooLarge。
+// n 为 0 时不限制,由 readRequest 在每次读请求头前设置、读完后清零,请求体不受限制
+type headerLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *headerLimitReader) Read(p []byte) (int, error) {
+	if l.n == 0 {
+		return l.r.Read(p)
+	}
+	if l.n < 0 {
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n == 0 {
+		l.n = -1
+	}
+	return n, err
+}
+
+// readRequest 在 MaxHeaderBytes 限制下从 reader 读取一个请求的请求行和请求头。与 net/http 的服务端一样
+// 额外放宽一个 bufio 缓冲区的大小,因为 bufio 会一次性预读紧跟在请求头后的请求体
+func (s *Server) readRequest(reader *bufio.Reader, limit *headerLimitReader) (*http.Request, error) {
+	if s.cfg.MaxHeaderBytes > 0 {
+		limit.n = int64(s.cfg.MaxHeaderBytes+reader.Size()) - int64(reader.Buffered())
+		defer func() { limit.n = 0 }()
+	}
+	return http.ReadRequest(reader)
+}
+
+// requestHost 返回请求 Host 去掉端口后的主机名。Host 可能带端口,IPv6 字面量还带方括号(如 [::1]:8080 或 [::1])
+func requestHost(req *http.Request) string {
+	if h, _, err := net.SplitHostPort(req.Host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(req.Host, "["), "]")
+}
+
+// checkRequest 依次检查 HTTP 请求的 Host、方法和路径。Host 先过白名单再过黑名单,两者同时命中时以黑名单为准。
+// 通过时 reason 为空,否则返回拒绝原因和日志消息
+func (s *Server) checkRequest(req *http.Request, host string) (reason rejectReason, msg string) {
+	rules := s.rules.Load()
+	if !rules.domains.contains(host) {
+		return rejectDomain, "拒绝访问: Host 不在允许的域名列表中"
+	}
+	if rules.denied.contains(host) {
+		return rejectDeniedDomain, "拒绝访问: Host 命中域名黑名单"
+	}
+	if len(s.cfg.AllowMethods) > 0 && !slices.Contains(s.cfg.AllowMethods, req.Method) {
+		return rejectMethod, "拒绝访问: 请求方法不在允许的列表中"
+	}
+	// CONNECT 请求没有路径,只受方法限制
+	if len(s.cfg.AllowPaths) > 0 && req.Method != http.MethodConnect && !allowedPath(s.cfg.AllowPaths, req.URL.Path) {
+		return rejectPath, "拒绝访问: 请求路径不在允许的前缀列表中"
+	}
+	return "", ""
+}
+
+// allowedPath 判断 p 是否以 prefixes 中的某一项开头。先按 path.Clean 规范化,
+// 避免用 /api/../admin 这类路径绕过前缀检查;结尾的 / 保留,使 /api/ 这样的前缀能匹配 /api/ 本身
+func allowedPath(prefixes []string, p string) bool {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(cleaned, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// strictViolation 记录 StrictHTTP 下第一个没有通过 Host 校验的后续请求
+type strictViolation struct {
+	reason rejectReason
+	msg    string
+	host   string
+	method string
+	path   string
+	index  int // 连接上的第几个请求,从 1 开始
+}
+
+var errStrictHTTP = errors.New("后续请求没有通过 Host 校验")
+
+// strictRequests 在 StrictHTTP 下接管客户端到后端的方向:逐个解析连接上的请求,第一个之后的每个请求都重新校验 Host,
+// 通过后按配置改写请求头,由 req.Write 写给后端,请求体边读边写。任一请求不合规时不再转发,记录到返回的 violation
+// 并立即断开两端(后端可能正在回应上一个请求,无法再插入 403)。协议升级请求之后的数据不再是 HTTP,原样转发;
+// 为防止后端拒绝升级后继续在这条连接上处理未经校验的请求,升级请求的 Connection 追加 close。
+// sess.conn 被替换为从管道读取的连接,返回的 PipeReader 需要在转发结束后关闭
+func (s *Server) strictRequests(sess *session, req *http.Request, reader *bufio.Reader, limit *headerLimitReader, backend net.Conn) (*io.PipeReader, *atomic.Pointer[strictViolation]) {
+	client := sess.conn
+	violation := new(atomic.Pointer[strictViolation])
+	pr, pw := io.Pipe()
+	go func() {
+		for index := 1; ; index++ {
+			if index > 1 {
+				next, err := s.readRequest(reader, limit)
+				if errors.Is(err, io.EOF) {
+					pw.Close()
+					return
+				}
+				if errors.Is(err, errHeaderTooLarge) {
+					violation.Store(&strictViolation{reason: rejectHeaderTooLarge, msg: "拒绝访问: HTTP 请求头过大", index: index})
+					pw.CloseWithError(errStrictHTTP)
+					client.Close()
+					backend.Close()
+					return
+				}
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				req = next
+				host := requestHost(req)
+				if reason, msg := s.checkRequest(req, host); reason != "" {
+					violation.Store(&strictViolation{reason: reason, msg: msg, host: host, method: req.Method, path: req.URL.Path, index: index})
+					pw.CloseWithError(errStrictHTTP)
+					client.Close()
+					backend.Close()
+					return
+				}
+				sess.logger.Debug("后续请求通过 Host 校验", "event", "allow", "request", index, "request_host", host)
+			}
+
+			s.rewriteHeaders(sess, req)
+			upgrade := req.Header.Get("Upgrade") != ""
+			if upgrade {
+				req.Header.Set("Connection", req.Header.Get("Connection")+", close")
+			}
+			if err := req.Write(pw); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if upgrade {
+				_, err := reader.WriteTo(pw)
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	sess.conn = &replayConn{Conn: sess.conn, r: pr}
+	return pr, violation
+}
+
+// rewriteRequest 按配置改写请求头后由 req.Write 重新生成请求,之后把 reader 中剩余的数据和 conn 上的后续数据
+// 原样接在后面。sess.conn 被替换为按这个顺序读取的连接,请求体边读边写,不会等整个请求体读完才开始转发。
+// 同一连接上的后续请求无法改写,所以除协议升级(WebSocket)外都加上 Connection: close,让客户端为下一个请求重新建连。
+// 返回的 PipeReader 需要在转发结束后关闭,避免客户端中途断开时写请求的协程阻塞
+func (s *Server) rewriteRequest(sess *session, req *http.Request, reader *bufio.Reader) *io.PipeReader {
+	s.rewriteHeaders(sess, req)
+	if req.Header.Get("Upgrade") == "" {
+		req.Close = true
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(req.Write(pw))
+	}()
+	sess.conn = &replayConn{Conn: sess.conn, r: io.MultiReader(pr, reader)}
+	return pr
+}
+
+// rewriteHeaders 按配置改写请求头:RewriteHost 改写 Host(含绝对形式请求行中的主机),
+// XFF 把客户端 IP 追加到 X-Forwarded-For 并设置 X-Real-IP
+func (s *Server) rewriteHeaders(sess *session, req *http.Request) {
+	if s.cfg.RewriteHost != "" {
+		sess.logger.Debug("改写 Host", "event", "rewrite_host", "from", req.Host, "to", s.cfg.RewriteHost)
+		req.Host = s.cfg.RewriteHost
+		if req.URL.Host != "" {
+			req.URL.Host = s.cfg.RewriteHost
+		}
+	}
+	// 真实客户端 IP 来自 PROXY 头(开启 -accept-proxy 时)或 TCP 连接,unix socket 客户端没有 IP 不处理。
+	// X-Real-IP 直接覆盖,避免客户端自带的值被后端当成真实 IP
+	if clientIP, ok := remoteIP(sess.clientAddr); s.cfg.XFF && ok {
+		xff := clientIP
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			xff = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		req.Header.Set("X-Forwarded-For", xff)
+		req.Header.Set("X-Real-IP", clientIP)
+	}
+	// 客户端没发 User-Agent 时 req.Write 会补上 Go 的默认值,置空表示不写
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+}
+
+// replayConn 从 r 读取数据而不是直接读底层连接,其余操作(写、超时、半关闭)交给底层连接
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// writeForbidden 向客户端返回 403 响应,让浏览器明确显示被拒绝
+func (s *Server) writeForbidden(w io.Writer) {
+	fmt.Fprintf(w, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(s.cfg.DenyBody), s.cfg.DenyBody)
+}
+
+// TLS alert 描述码 (RFC 8446 6.2)
+const (
+	tlsAlertAccessDenied     = 49
+	tlsAlertInternalError    = 80 // 维护模式使用,TLS 没有与 503 对应的告警
+	tlsAlertDecodeError      = 50
+	tlsAlertProtocolVersion  = 70
+	tlsAlertUnrecognizedName = 112
+)
+
+// writeTLSAlert 向客户端发送一条 fatal 级别的 TLS alert 记录,让客户端知道是被策略拒绝
+func writeTLSAlert(w io.Writer, description byte) {
+	// 记录类型 alert(0x15),版本 TLS 1.2,长度 2,级别 fatal(2)
+	w.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, description})
+}
+
+// logExtensionError 在 err 是扩展长度不自洽时用 Debug 级别打印出错扩展的边界,其它错误忽略
+func logExtensionError(logger *slog.Logger, err error) {
+	var extErr *clienthello.ExtensionError
+	if errors.As(err, &extErr) {
+		logger.Debug("ClientHello 扩展边界", "event", "client_hello_error", "ext_index", extErr.Index, "ext_type", extErr.Type,
+			"ext_offset", extErr.Offset, "ext_length", extErr.Length, "remaining", extErr.Remaining, "detail", extErr.Detail)
+	}
+}
+
+func (s *Server) handleHTTPS(sess *session, backends []string, initialData []byte) {
+	conn := sess.conn
+
+	// 读取完整的 TLS ClientHello 消息,读到的全部原始字节需要原样转发给后端
+	clientHello, fullHello, err := clienthello.Read(conn, initialData)
+	if errors.Is(err, clienthello.ErrMalformed) {
+		// 畸形的 ClientHello 无论配置如何都拒绝
+		sess.logger.Warn("拒绝访问: ClientHello 畸形", "event", "reject", "reason", rejectMalformedHello, "error", err)
+		logExtensionError(sess.logger, err)
+		s.reject(sess, rejectMalformedHello)
+		writeTLSAlert(conn, tlsAlertDecodeError)
+		return
+	}
+	if err != nil {
+		s.logHandshakeError(sess, "读取 ClientHello 时发生错误", err)
+		return
+	}
+	s.endHandshake(sess)
+	initialData = fullHello
+	sess.tls = true
+	sess.host = clientHello.ServerName
+	// 后续日志都带上 JA3 指纹,便于按客户端指纹做安全分析
+	ja3 := clientHello.JA3Hash()
+	maxVersion := clientHello.MaxVersion()
+	sess.logger = sess.logger.With("ja3", ja3, "tls_version", tls.VersionName(maxVersion))
+	sess.logger.Debug("解析 ClientHello", "event", "client_hello", "bytes", len(fullHello), "sni", clientHello.ServerName, "alpn", clientHello.SupportedProtos,
+		"tls13", maxVersion >= tls.VersionTLS13, "ja3_full", clientHello.JA3())
+
+	if s.cfg.MinTLSVersion > 0 && maxVersion < s.cfg.MinTLSVersion {
+		sess.logger.Warn("拒绝访问: 客户端支持的 TLS 版本过旧", "event", "reject", "reason", rejectTLSVersion, "sni", clientHello.ServerName, "min_tls_version", tls.VersionName(s.cfg.MinTLSVersion))
+		s.reject(sess, rejectTLSVersion)
+		writeTLSAlert(conn, tlsAlertProtocolVersion)
+		return
+	}
+
+	// JA3 检查先于 SNI:命中黑名单的客户端即使 SNI 在白名单内也拒绝
+	if ja3Rules := s.ja3.Load(); ja3Rules.deny[ja3] || (len(ja3Rules.allow) > 0 && !ja3Rules.allow[ja3]) {
+		sess.logger.Warn("拒绝访问: JA3 指纹被禁止", "event", "reject", "reason", rejectJA3, "sni", clientHello.ServerName)
+		s.reject(sess, rejectJA3)
+		writeTLSAlert(conn, tlsAlertAccessDenied)
+		return
+	}
+
+	// 验证 SNI
+	sni := clientHello.ServerName
+	sess.host = sni
+	rules := s.rules.Load()
+	if sni == "" {
+		// ClientHello 合法但不带 SNI(直连 IP、老客户端):开启 AllowNoSNI 或白名单为 * 时放行到默认后端,
+		// 开启 RequireSNI 时一律拒绝
+		if s.cfg.RequireSNI || (!s.cfg.AllowNoSNI && !rules.domains.all) {
+			sess.logger.Warn("拒绝访问: ClientHello 不含 SNI", "event", "reject", "reason", rejectNoSNI)
+			s.reject(sess, rejectNoSNI)
+			writeTLSAlert(conn, tlsAlertUnrecognizedName)
+			return
+		}
+		sess.logger.Info("允许访问: ClientHello 不含 SNI，转发到默认后端", "event", "allow")
+	}
+	// outside 表示 SNI 不在白名单内,但开启了 DefaultDstAnyDomain,直接转发到默认后端
+	outside := false
+	if sni != "" {
+		if !rules.domains.contains(sni) {
+			if s.cfg.DefaultDst == "" || !s.cfg.DefaultDstAnyDomain {
+				sess.logger.Warn("拒绝访问: SNI 不在允许的域名列表中", "event", "reject", "reason", rejectSNI, "sni", sni)
+				s.reject(sess, rejectSNI)
+				writeTLSAlert(conn, tlsAlertAccessDenied)
+				return
+			}
+			outside = true
+		}
+		// 黑名单对默认后端同样生效
+		if rules.denied.contains(sni) {
+			sess.logger.Warn("拒绝访问: SNI 命中域名黑名单", "event", "reject", "reason", rejectDeniedDomain, "sni", sni)
+			s.reject(sess, rejectDeniedDomain)
+			writeTLSAlert(conn, tlsAlertAccessDenied)
+			return
+		}
+		sess.logger = sess.logger.With("sni", sni)
+		if outside {
+			sess.logger.Info("SNI 不在允许的域名列表中，转发到默认后端", "event", "allow", "dst", s.cfg.DefaultDst)
+		} else {
+			sess.logger.Info("允许访问: SNI 在允许的域名列表中", "event", "allow")
+		}
+	}
+
+	// 按 SNI 路由选择后端,未命中时使用 DefaultDst,没有配置 DefaultDst 时保持默认地址
+	if outside {
+		backends = []string{s.cfg.DefaultDst}
+	} else if addr, ok := lookupRoute(sni, s.cfg.SNIRoutes); ok {
+		backends = []string{addr}
+		sess.logger.Debug("SNI 命中路由", "event", "route", "dst", addr)
+	} else if addr, ok := lookupRoute(sni, *s.routes.Load()); ok {
+		backends = []string{addr}
+		sess.logger.Debug("SNI 命中路由文件", "event", "route", "dst", addr)
+	} else if proto, addr, ok := lookupALPNRoute(clientHello.SupportedProtos, s.cfg.ALPNRoutes); ok {
+		backends = []string{addr}
+		sess.logger.Debug("ALPN 命中路由", "event", "route", "alpn", proto, "dst", addr)
+	} else if s.cfg.DefaultDst != "" {
+		backends = []string{s.cfg.DefaultDst}
+		sess.logger.Debug("未命中路由，使用默认后端", "event", "route", "dst", s.cfg.DefaultDst)
+	}
+
+	// 建立与目标服务器的连接
+	forwardConn, forwardAddr, err := s.dialBackends(sess, backends)
+	if err != nil {
+		return
+	}
+	sess.logger.Info("转发 TLS 数据", "event", "forward", "dst", forwardAddr)
+	s.relayTo(sess, forwardConn, forwardAddr, true, func(forwardConn net.Conn) (net.Conn, bool) {
+		// STARTTLS 连接先用客户端的 EHLO 与后端完成明文阶段
+		if sess.smtpHelo != "" {
+			if err := smtpStartTLS(forwardConn, sess.smtpHelo, s.cfg.DialTimeout); err != nil {
+				sess.logger.Error("与目标服务器协商 STARTTLS 时出错", "event", "smtp_error", "dst", forwardAddr, "error", err)
+				sess.closeReason = "smtp_error"
+				return nil, false
+			}
+		}
+		return forwardConn, true
+	}, initialData)
+}
+
+// relayTo 把 sess 转发到已连上的后端 forwardConn(地址为 dst),返回时关闭 forwardConn。
+// 依次记录 dst 并发出 open 事件、让 forwardConn 随 sess.ctx 取消而关闭、sendProxy 为 true 且开启 SendProxy 时发送 PROXY 头、
+// 调用 prepare 完成转发前与后端或客户端的协议交互、把 initial 发给后端,最后双向转发直到结束。
+// prepare 可以为 nil,它返回接下来使用的后端连接(如握手后的 TLS 连接),失败时自行记录原因并返回 false
+func (s *Server) relayTo(sess *session, forwardConn net.Conn, dst string, sendProxy bool, prepare func(net.Conn) (net.Conn, bool), initial []byte) {
+	sess.dst = dst
+	s.notify(sess, "open")
+	stop := sess.closeOnCancel(forwardConn)
+	defer func() {
+		stop()
+		forwardConn.Close()
+	}()
+
+	// 发送 PROXY protocol 头,必须在任何数据之前
+	if sendProxy && s.cfg.SendProxy {
+		if err := writeProxyHeader(forwardConn, sess.clientAddr, sess.conn.LocalAddr()); err != nil {
+			sess.logger.Error("向目标服务器发送 PROXY protocol 头时出错", "event", "write_error", "dst", dst, "error", err)
+			sess.closeReason = "write_error"
+			return
+		}
+	}
+
+	backend := forwardConn
+	if prepare != nil {
+		var ok bool
+		if backend, ok = prepare(forwardConn); !ok {
+			return
+		}
+	}
+
+	if len(initial) > 0 {
+		n, err := backend.Write(initial)
+		sess.bytesIn.Add(int64(n))
+		s.metrics.bytesClientToServer.Add(uint64(n))
+		if err != nil {
+			sess.logger.Error("向目标服务器发送初始数据时出错", "event", "write_error", "dst", dst, "error", err)
+			sess.closeReason = "write_error"
+			return
+		}
+	}
+
+	// 开始双向数据转发
+	sess.forwardDone(s.handleTCPForward(sess, backend))
+}
+
+// dialBackends 依次尝试候选后端,返回第一个连接成功的连接及其地址;全部失败时返回最后一个错误
+func (s *Server) dialBackends(sess *session, backends []string) (net.Conn, string, error) {
+	backends = s.healthyBackends(sess, s.orderBackends(sess, backends))
+
+	var lastErr error
+	for i, addr := range backends {
+		conn, err := s.dialBackend(sess, addr)
+		if err == nil {
+			return conn, addr, nil
+		}
+		lastErr = err
+		if i < len(backends)-1 {
+			sess.logger.Warn("无法连接到转发目标，尝试下一个", "event", "dial_error", "dst", addr, "next", backends[i+1], "error", err)
+		} else {
+			sess.logger.Error("无法连接到转发目标", "event", "dial_error", "dst", addr, "error", err)
+		}
+	}
+	if len(backends) > 1 {
+		sess.logger.Error("所有转发目标均无法连接", "event", "dial_error", "dst", backends)
+	}
+	sess.closeReason = "dial_failed"
+	return nil, "", lastErr
+}
+
+// dialBackend 在 DialTimeout 内连接转发目标,超时则返回明确的错误;
+// 主机名后端解析出多个 IP 时逐个尝试
+func (s *Server) dialBackend(sess *session, addr string) (conn net.Conn, err error) {
+	start := time.Now()
+	defer func() {
+		s.traceSpan(sess, "dial", otelKindClient, start, err, "dst", addr)
+	}()
+	conn, err = s.dialOutbound(sess.ctx, addr, s.cfg.DialTimeout, s.bindIP(sess), func(ip string, err error) {
+		sess.logger.Warn("无法连接到后端的解析地址，尝试下一个", "event", "dial_error", "dst", addr, "ip", ip, "error", err)
+	})
+	if err != nil {
+		s.metrics.dialFailures.Add(1)
+		if os.IsTimeout(err) {
+			return nil, fmt.Errorf("连接超时 (超过 %v): %w", s.cfg.DialTimeout, err)
+		}
+		return nil, err
+	}
+	s.metrics.dialDuration.observe(sess.tls, time.Since(start))
+	setSocketOptions(conn, s.cfg.KeepAlive, !s.cfg.DisableNoDelay)
+	return conn, nil
+}
+
+// dialOutbound 是所有出站连接的入口:配置了上游 SOCKS5 时经上游 CONNECT 到 addr,
+// 主机名交给上游解析;unix: 地址和未配置上游时由 dialAddr 直连。local 是绑定的出口 IP,可以为 nil
+func (s *Server) dialOutbound(ctx context.Context, addr string, timeout time.Duration, local net.IP, onFail func(ip string, err error)) (net.Conn, error) {
+	if s.cfg.UpstreamSOCKS != nil && !strings.HasPrefix(addr, "unix:") {
+		return s.cfg.UpstreamSOCKS.dial(ctx, addr, timeout, local)
+	}
+	return dialAddr(ctx, addr, timeout, local, s.dns, onFail)
+}
+
+// bindIP 返回连接应使用的出口 IP:-bind-route 按 SNI/Host 命中时优先,否则为 -bind-ip,都没有时为 nil
+func (s *Server) bindIP(sess *session) net.IP {
+	if sess.host != "" {
+		if addr, ok := lookupRoute(sess.host, s.cfg.BindRoutes); ok {
+			return net.ParseIP(addr)
+		}
+	}
+	return s.cfg.BindIP
+}
+
+// dialTarget 连接 SOCKS5/CONNECT 客户端指定的 host:port。目标不是配置的后端,
+// 直接按 TCP 拨号(或经上游 SOCKS5),不经过健康检查、DNS 缓存和 unix: 地址
+func (s *Server) dialTarget(sess *session, target string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if s.cfg.UpstreamSOCKS != nil {
+		conn, err = s.cfg.UpstreamSOCKS.dial(sess.ctx, target, s.cfg.DialTimeout, s.bindIP(sess))
+	} else {
+		conn, err = dialTCP(sess.ctx, target, s.cfg.DialTimeout, s.bindIP(sess))
+	}
+	if err != nil {
+		s.metrics.dialFailures.Add(1)
+		sess.logger.Error("无法连接到代理目标", "event", "dial_error", "dst", target, "error", err)
+		sess.closeReason = "dial_failed"
+		return nil, err
+	}
+	setSocketOptions(conn, s.cfg.KeepAlive, !s.cfg.DisableNoDelay)
+	return conn, nil
+}
+
+// handleTCPForward 双向转发直到两个方向都结束,返回每个方向转发的字节数和拷贝结束时的错误,
+// 并在 sess 中记录先断开的一方
+func (s *Server) handleTCPForward(sess *session, serverConn net.Conn) (bytesC2S, bytesS2C int64, errC2S, errS2C error) {
+	clientConn := sess.conn
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var idle, expired, finished, lingered atomic.Bool
+	var linger *time.Timer
+
+	// 到达最大寿命时关闭两端,两个方向阻塞中的读写都会返回 net.ErrClosed
+	if s.cfg.MaxConnLifetime > 0 {
+		timer := time.AfterFunc(s.cfg.MaxConnLifetime-time.Since(sess.start), func() {
+			sess.logger.Info("连接达到最大寿命关闭", "event", "max_lifetime", "max_conn_lifetime", s.cfg.MaxConnLifetime)
+			expired.Store(true)
+			clientConn.Close()
+			serverConn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	// 单方向转发,两个方向各自维护自己的空闲超时和限速令牌桶
+	forward := func(dst, src net.Conn, copied *int64, copyErr *error) {
+		defer wg.Done()
+		var reader io.Reader = src
+		if s.cfg.IdleTimeout > 0 {
+			reader = &idleTimeoutReader{conn: src, timeout: s.cfg.IdleTimeout}
+		}
+		if s.cfg.RateLimit > 0 {
+			reader = newRateLimitedReader(reader, s.cfg.RateLimit)
+		}
+		n, err := s.copyStream(dst, src, reader)
+		*copied, *copyErr = n, err
+		// 先结束的方向说明是它的读端先断开:客户端到后端方向先结束即客户端先断开
+		first := finished.CompareAndSwap(false, true)
+		if first {
+			if dst == serverConn {
+				sess.closedBy = "client"
+			} else {
+				sess.closedBy = "backend"
+			}
+		}
+		if dst == serverConn {
+			sess.bytesIn.Add(n)
+			s.metrics.bytesClientToServer.Add(uint64(n))
+		} else {
+			sess.bytesOut.Add(n)
+			s.metrics.bytesServerToClient.Add(uint64(n))
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			sess.logger.Info("连接因空闲超时关闭", "event", "idle_timeout", "peer", src.RemoteAddr().String(), "idle_timeout", s.cfg.IdleTimeout)
+			idle.Store(true)
+			clientConn.Close()
+			serverConn.Close()
+			return
+		}
+		closeWrite(dst)
+		// 另一方向的对端可能既不发数据也不关闭,阻塞中的 Read 永远不会返回,两个 goroutine 和连接都无法回收。
+		// 半关闭后允许它再转发 HalfCloseTimeout,到时关闭两端
+		if first && s.cfg.HalfCloseTimeout > 0 {
+			linger = time.AfterFunc(s.cfg.HalfCloseTimeout, func() {
+				sess.logger.Info("半关闭后另一方向未在限定时间内结束，关闭连接", "event", "half_close_timeout", "half_close_timeout", s.cfg.HalfCloseTimeout)
+				lingered.Store(true)
+				clientConn.Close()
+				serverConn.Close()
+			})
+		}
+	}
+
+	go forward(serverConn, clientConn, &bytesC2S, &errC2S)
+	go forward(clientConn, serverConn, &bytesS2C, &errS2C)
+
+	wg.Wait()
+	if linger != nil {
+		linger.Stop()
+	}
+	if lingered.Load() {
+		sess.closeReason = "half_close_timeout"
+	}
+	if idle.Load() {
+		sess.closeReason = "idle_timeout"
+		sess.closedBy = "idle_timeout"
+	}
+	if expired.Load() {
+		sess.closeReason = "max_lifetime"
+		sess.closedBy = "max_lifetime"
+	}
+	return bytesC2S, bytesS2C, errC2S, errS2C
+}
+
+// io.Copy 结束原因,见 copyEndReason
+const (
+	copyEOF      = "eof"      // 对端正常关闭
+	copyCanceled = "canceled" // 中继主动关闭:另一方向结束、kill、排空超时、strict-http 拦截等
+	copyTimeout  = "timeout"  // 空闲超时,已单独记录
+	copyReset    = "reset"    // 对端 RST 或写入已关闭的连接
+	copyError    = "error"    // 其余异常
+)
+
+// copyEndReason 把 io.Copy 返回的错误归类为结束原因
+func copyEndReason(err error) string {
+	switch {
+	case err == nil:
+		return copyEOF
+	case errors.Is(err, net.ErrClosed), errors.Is(err, errStrictHTTP), errors.Is(err, context.Canceled):
+		return copyCanceled
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return copyTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNABORTED):
+		return copyReset
+	}
+	return copyError
+}
+
+// forwardDone 记录 handleTCPForward 的结果。每个方向的结束原因记 Debug,
+// 连接被重置记 Info,无法归类的异常记 Warn
+func (sess *session) forwardDone(bytesC2S, bytesS2C int64, errC2S, errS2C error) {
+	for _, e := range []struct {
+		direction string
+		err       error
+	}{{"client_to_server", errC2S}, {"server_to_client", errS2C}} {
+		reason := copyEndReason(e.err)
+		switch reason {
+		case copyReset:
+			sess.logger.Info("转发时连接被重置", "event", "copy_error", "direction", e.direction, "reason", reason, "error", e.err)
+		case copyError:
+			sess.logger.Warn("转发时发生错误", "event", "copy_error", "direction", e.direction, "reason", reason, "error", e.err)
+		default:
+			sess.logger.Debug("转发方向结束", "event", "copy_done", "direction", e.direction, "reason", reason)
+		}
+	}
+	sess.logger.Debug("转发结束", "event", "forward_done", "bytes_c2s", bytesC2S, "bytes_s2c", bytesS2C, "closed_by", sess.closedBy)
+}
+
+// copyStream 把 reader 的数据拷贝到 dst。reader 就是 src 本身(没有空闲超时、限速等包装)
+// 且两端都是 *net.TCPConn 时交给 ReadFrom,Linux 下走 splice 零拷贝;否则使用池化缓冲区拷贝。
+func (s *Server) copyStream(dst, src net.Conn, reader io.Reader) (int64, error) {
+	if tcpDst, ok := dst.(*net.TCPConn); ok && reader == io.Reader(src) {
+		if _, ok := src.(*net.TCPConn); ok {
+			return tcpDst.ReadFrom(src)
+		}
+	}
+
+	buf := s.bufPool.Get().(*[]byte)
+	defer s.bufPool.Put(buf)
+	return io.CopyBuffer(onlyWriter{dst}, onlyReader{reader}, *buf)
+}
+
+// onlyReader 和 onlyWriter 隐藏 WriterTo/ReaderFrom 接口,确保 io.CopyBuffer 使用传入的缓冲区
+type onlyReader struct {
+	io.Reader
+}
+
+type onlyWriter struct {
+	io.Writer
+}
+
+// setSocketOptions 设置 TCP keepalive(keepAlive 为 0 时关闭)和 TCP_NODELAY;非 TCP 连接(unix socket)不处理
+func setSocketOptions(conn net.Conn, keepAlive time.Duration, noDelay bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tcpConn.SetNoDelay(noDelay)
+	if keepAlive <= 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(keepAlive)
+}
+
+// closeWrite 尽量只关闭写方向以保留半关闭语义,不支持半关闭的连接直接关闭
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// idleTimeoutReader 每次读取前把读超时往后推,读不到数据超过 timeout 即返回超时错误
+type idleTimeoutReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
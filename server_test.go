@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogger 丢弃日志,排查失败的测试时可以暂时换成 os.Stderr
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func mustParseCIDRs(t testing.TB, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+// startServer 在本机随机端口启动 Server,未指定 AllowedNets 时只允许本机来源,测试结束时关闭
+func startServer(t testing.TB, cfg Config) *Server {
+	t.Helper()
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = "127.0.0.1:0"
+	}
+	if cfg.AllowedNets == nil {
+		cfg.AllowedNets = mustParseCIDRs(t, "127.0.0.0/8")
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = testLogger()
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// startBackend 启动一个 TCP 后端,每个连接在单独的 goroutine 中交给 handle,返回监听地址
+func startBackend(t testing.TB, handle func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// rejectCount 返回 s 按 reason 拒绝的连接数
+func rejectCount(s *Server, reason rejectReason) uint64 {
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	return s.metrics.rejected[reason]
+}
+
+func TestCheckRequestDomainPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		host  string
+		want  rejectReason
+	}{
+		{name: "同时在白名单和黑名单", allow: []string{"*.example.com"}, deny: []string{"bad.example.com"}, host: "bad.example.com", want: rejectDeniedDomain},
+		{name: "只在黑名单,白名单为 *", allow: []string{"*"}, deny: []string{"bad.example.com"}, host: "bad.example.com", want: rejectDeniedDomain},
+		{name: "只在黑名单,不在白名单", allow: []string{"good.example.com"}, deny: []string{"bad.example.com"}, host: "bad.example.com", want: rejectDomain},
+		{name: "只在白名单", allow: []string{"*.example.com"}, deny: []string{"bad.example.com"}, host: "good.example.com"},
+		{name: "黑名单通配", allow: []string{"*"}, deny: []string{"*.ads.example.com"}, host: "x.ads.example.com", want: rejectDeniedDomain},
+		{name: "都不在", allow: []string{"good.example.com"}, deny: []string{"bad.example.com"}, host: "other.example.com", want: rejectDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			s.SetAccessRules(nil, nil, tt.allow, tt.deny)
+			req, _ := http.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			if got, _ := s.checkRequest(req, tt.host); got != tt.want {
+				t.Errorf("checkRequest(%q) = %q, 期望 %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSDomainPrecedence(t *testing.T) {
+	reached := make(chan struct{}, 1)
+	backend := startBackend(t, func(conn net.Conn) {
+		reached <- struct{}{}
+	})
+	s := startServer(t, Config{
+		DestAddrs:      []string{backend},
+		AllowedDomains: []string{"*.example.com"},
+		DeniedDomains:  []string{"bad.example.com", "ads-*.example.com"},
+	})
+
+	tests := []struct {
+		sni  string
+		want rejectReason // 为空表示应当转发到后端
+	}{
+		{sni: "bad.example.com", want: rejectDeniedDomain},
+		{sni: "ads-1.example.com", want: rejectDeniedDomain},
+		// 不在白名单时先按白名单拒绝
+		{sni: "a.b.example.com", want: rejectSNI},
+		{sni: "good.example.com"},
+		{sni: "bad.example.org", want: rejectSNI},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sni, func(t *testing.T) {
+			before := rejectCount(s, tt.want)
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			err = tls.Client(conn, &tls.Config{ServerName: tt.sni, InsecureSkipVerify: true}).Handshake()
+			if err == nil {
+				t.Fatal("握手意外成功")
+			}
+
+			if tt.want == "" {
+				select {
+				case <-reached:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("SNI %s 没有转发到后端, 握手错误: %v", tt.sni, err)
+				}
+				return
+			}
+			if !strings.Contains(err.Error(), "access denied") {
+				t.Errorf("握手错误 = %v, 期望 access_denied alert", err)
+			}
+			if got := rejectCount(s, tt.want) - before; got != 1 {
+				t.Errorf("%s 拒绝数增加 %d, 期望 1", tt.want, got)
+			}
+			select {
+			case <-reached:
+				t.Errorf("被拒绝的 SNI %s 到达了后端", tt.sni)
+			default:
+			}
+		})
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   net.Addr
+		cidrs  []string
+		wantIP string
+		wantOK bool
+		allow  bool
+	}{
+		{name: "IPv6 与 ::/0", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, cidrs: []string{"::/0"}, wantIP: "2001:db8::1", wantOK: true, allow: true},
+		{name: "IPv4 不在 ::/0 内", addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, cidrs: []string{"::/0"}, wantIP: "192.0.2.1", wantOK: true},
+		{name: "默认的 0.0.0.0/0,::/0", addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, cidrs: []string{"0.0.0.0/0", "::/0"}, wantIP: "192.0.2.1", wantOK: true, allow: true},
+		{name: "指定的 IPv6 范围内", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8:1::5"), Port: 443}, cidrs: []string{"2001:db8:1::/48"}, wantIP: "2001:db8:1::5", wantOK: true, allow: true},
+		{name: "指定的 IPv6 范围外", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8:2::5"), Port: 443}, cidrs: []string{"2001:db8:1::/48"}, wantIP: "2001:db8:2::5", wantOK: true},
+		{name: "链路本地地址去掉 zone", addr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 443, Zone: "eth0"}, cidrs: []string{"fe80::/10"}, wantIP: "fe80::1", wantOK: true, allow: true},
+		{name: "数字 zone", addr: &net.UDPAddr{IP: net.ParseIP("fe80::abcd"), Port: 53, Zone: "3"}, cidrs: []string{"fe80::/64"}, wantIP: "fe80::abcd", wantOK: true, allow: true},
+		{name: "unix socket", addr: &net.UnixAddr{Name: "/tmp/relay.sock", Net: "unix"}, wantIP: "unix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, ok := remoteIP(tt.addr)
+			if ip != tt.wantIP || ok != tt.wantOK {
+				t.Fatalf("remoteIP(%v) = %q, %v, 期望 %q, %v", tt.addr, ip, ok, tt.wantIP, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			parsed := net.ParseIP(ip)
+			if parsed == nil {
+				t.Fatalf("remoteIP 返回的 %q 无法解析", ip)
+			}
+			rules := &accessRules{nets: mustParseCIDRs(t, tt.cidrs...)}
+			if got := rules.checkIP(parsed) == ""; got != tt.allow {
+				t.Errorf("%s 在 -cidr %v 下放行 = %v, 期望 %v", ip, tt.cidrs, got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestIPv6ClientAllowed(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("本机不支持 IPv6: %v", err)
+	} else {
+		l.Close()
+	}
+
+	reached := make(chan struct{}, 1)
+	backend := startBackend(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+		reached <- struct{}{}
+	})
+	for _, cidr := range []string{"::/0", "::1/128"} {
+		s := startServer(t, Config{ListenAddr: "[::1]:0", DestAddrs: []string{backend}, AllowedNets: mustParseCIDRs(t, cidr)})
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		conn.Close()
+		select {
+		case <-reached:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("-cidr %s 下 ::1 的连接没有转发到后端, cidr 拒绝数 %d", cidr, rejectCount(s, rejectCIDR))
+		}
+	}
+
+	s := startServer(t, Config{ListenAddr: "[::1]:0", DestAddrs: []string{backend}, AllowedNets: mustParseCIDRs(t, "2001:db8::/32")})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("不在 -cidr 范围内的 ::1 没有被断开")
+	}
+	if got := rejectCount(s, rejectCIDR); got != 1 {
+		t.Errorf("cidr 拒绝数 %d, 期望 1", got)
+	}
+}
+
+// dialProxied 以 PROXY v1 头声明真实客户端为 ip 连接 addr 并发出一个 HTTP 请求,返回该连接
+func dialProxied(t *testing.T, addr, ip string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "PROXY TCP4 %s 127.0.0.1 40000 80\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n", ip)
+	return conn
+}
+
+// proxiedAllowed 判断经 dialProxied 发出的请求是否转发到了回复 200 的后端,被拒绝的连接直接断开
+func proxiedAllowed(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func TestAcceptProxyRatePerIP(t *testing.T) {
+	backend := startBackend(t, func(conn net.Conn) {
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+	// 限流的 burst 为 1,测试期间补充的令牌不足一个
+	s := startServer(t, Config{DestAddrs: []string{backend}, AcceptProxy: true, RatePerIP: 0.01})
+	addr := s.Addr().String()
+
+	// 所有连接都来自同一个负载均衡地址,按真实客户端 IP 分别计数
+	if !proxiedAllowed(t, dialProxied(t, addr, "127.0.0.2")) {
+		t.Fatal("127.0.0.2 的第一个连接被拒绝")
+	}
+	if !proxiedAllowed(t, dialProxied(t, addr, "127.0.0.3")) {
+		t.Fatal("127.0.0.3 与 127.0.0.2 共用了令牌桶")
+	}
+	if proxiedAllowed(t, dialProxied(t, addr, "127.0.0.2")) {
+		t.Fatal("127.0.0.2 的第二个连接没有被限流")
+	}
+	if got := rejectCount(s, rejectRateLimited); got != 1 {
+		t.Errorf("rate_limited 拒绝数 %d, 期望 1", got)
+	}
+}
+
+func TestAcceptProxyMaxConnsPerIP(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	backend := startBackend(t, func(conn net.Conn) {
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+		<-release
+	})
+	s := startServer(t, Config{DestAddrs: []string{backend}, AcceptProxy: true, MaxConnsPerIP: 1})
+	addr := s.Addr().String()
+
+	// 第一个连接转发后保持打开,占住 127.0.0.2 的名额
+	if !proxiedAllowed(t, dialProxied(t, addr, "127.0.0.2")) {
+		t.Fatal("127.0.0.2 的第一个连接被拒绝")
+	}
+	if !proxiedAllowed(t, dialProxied(t, addr, "127.0.0.3")) {
+		t.Fatal("127.0.0.3 与 127.0.0.2 共用了并发名额")
+	}
+	if proxiedAllowed(t, dialProxied(t, addr, "127.0.0.2")) {
+		t.Fatal("127.0.0.2 的第二个并发连接没有被拒绝")
+	}
+	if got := rejectCount(s, rejectMaxConnsPerIP); got != 1 {
+		t.Errorf("max_conns_per_ip 拒绝数 %d, 期望 1", got)
+	}
+}
+
+func TestAcceptProxyUntrustedPeer(t *testing.T) {
+	backend := startBackend(t, func(conn net.Conn) {
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+	// 测试连接来自 127.0.0.1,不在 -proxy-from 内,头中声称的 127.0.0.2 虽在白名单内也不能采信
+	s := startServer(t, Config{DestAddrs: []string{backend}, AcceptProxy: true, ProxyFrom: mustParseCIDRs(t, "10.0.0.0/8")})
+
+	if proxiedAllowed(t, dialProxied(t, s.Addr().String(), "127.0.0.2")) {
+		t.Fatal("不可信对端发来的 PROXY 头被采信")
+	}
+	if got := rejectCount(s, rejectUntrustedProxy); got != 1 {
+		t.Errorf("untrusted_proxy 拒绝数 %d, 期望 1", got)
+	}
+}
+
+func TestAcceptProxyUntrustedPeerRateLimit(t *testing.T) {
+	s := startServer(t, Config{DestAddrs: []string{"127.0.0.1:1"}, AcceptProxy: true, ProxyFrom: mustParseCIDRs(t, "10.0.0.0/8"), RatePerIP: 0.01})
+	addr := s.Addr().String()
+
+	// 不可信对端换着头里的 IP 发连接,仍按 TCP 来源地址共用一个令牌桶
+	proxiedAllowed(t, dialProxied(t, addr, "127.0.0.2"))
+	proxiedAllowed(t, dialProxied(t, addr, "127.0.0.3"))
+	if got := rejectCount(s, rejectRateLimited); got != 1 {
+		t.Errorf("rate_limited 拒绝数 %d, 期望 1", got)
+	}
+}
+
+func TestAcceptProxyUntrustedPeerMaxConnsPerIP(t *testing.T) {
+	s := startServer(t, Config{DestAddrs: []string{"127.0.0.1:1"}, AcceptProxy: true, ProxyFrom: mustParseCIDRs(t, "10.0.0.0/8"), MaxConnsPerIP: 1})
+	// 占住对端地址 127.0.0.1 的名额,不可信对端不能靠头里换一个 IP 绕过
+	if s.ipConns.acquire("127.0.0.1") == nil {
+		t.Fatal("无法占用 127.0.0.1 的名额")
+	}
+
+	proxiedAllowed(t, dialProxied(t, s.Addr().String(), "127.0.0.2"))
+	if got := rejectCount(s, rejectMaxConnsPerIP); got != 1 {
+		t.Errorf("max_conns_per_ip 拒绝数 %d, 期望 1", got)
+	}
+}
+
+// tcpPair 返回一对已连接的本机 TCP 连接
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestCloseWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		// pair 返回要半关闭的连接 conn 与它的对端 peer,wrap 把 conn 包装成实际传给 closeWrite 的连接
+		pair      func(t *testing.T) (conn, peer net.Conn)
+		wrap      func(net.Conn) net.Conn
+		halfClose bool // 底层连接支持半关闭,closeWrite 之后仍能读到对端的数据
+	}{
+		{name: "net.Pipe", pair: func(*testing.T) (net.Conn, net.Conn) { return net.Pipe() }},
+		{name: "replayConn 包装 net.Pipe", pair: func(*testing.T) (net.Conn, net.Conn) { return net.Pipe() },
+			wrap: func(c net.Conn) net.Conn { return &replayConn{Conn: c, r: c} }},
+		{name: "TCP", pair: tcpPair, halfClose: true},
+		{name: "replayConn 包装 TCP", pair: tcpPair, halfClose: true,
+			wrap: func(c net.Conn) net.Conn { return &replayConn{Conn: c, r: c} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := tt.pair(t)
+			defer conn.Close()
+			defer peer.Close()
+			target := conn
+			if tt.wrap != nil {
+				target = tt.wrap(conn)
+			}
+			closeWrite(target)
+
+			// 对端读到 EOF,而不是一直阻塞
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if n, err := peer.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("对端读到 %d 字节, err = %v, 期望 EOF", n, err)
+			}
+
+			if tt.halfClose {
+				go peer.Write([]byte("pong"))
+				buf := make([]byte, 4)
+				target.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadFull(target, buf); err != nil || string(buf) != "pong" {
+					t.Errorf("半关闭后读到 %q, err = %v, 期望 pong", buf, err)
+				}
+			}
+
+			// 重复调用或在已关闭的连接上调用也不能 panic
+			closeWrite(target)
+			conn.Close()
+			closeWrite(target)
+		})
+	}
+}
+
+// hashBackend 是一个 HTTP/1.1 后端,对连接上的每个请求回复请求体的 sha256 与长度
+func hashBackend(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, req.Body)
+		if err != nil {
+			return
+		}
+		body := fmt.Sprintf("%x %d", h.Sum(nil), n)
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	}
+}
+
+func TestHTTPLargeBody(t *testing.T) {
+	body := make([]byte, 1<<20)
+	rand.NewChaCha8([32]byte{}).Read(body)
+	sum := sha256.Sum256(body)
+	want := fmt.Sprintf("%x %d", sum, len(body))
+	backend := startBackend(t, hashBackend)
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "原样重放", cfg: Config{}},
+		{name: "改写 Host", cfg: Config{RewriteHost: "backend.internal"}},
+		{name: "X-Forwarded-For", cfg: Config{XFF: true}},
+		{name: "StrictHTTP", cfg: Config{StrictHTTP: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.DestAddrs = []string{backend}
+			s := startServer(t, cfg)
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			br := bufio.NewReader(conn)
+
+			// 同一连接上依次发送 Content-Length 与 chunked 两种请求体,
+			// 第一次写入只带请求体的开头,停顿后再分块写完,让请求体远大于代理第一次读到的数据
+			for _, chunked := range []bool{false, true} {
+				var req bytes.Buffer
+				if chunked {
+					req.WriteString("POST /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n")
+				} else {
+					fmt.Fprintf(&req, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n", len(body))
+				}
+				head := req.Len()
+				if chunked {
+					for rest := body; len(rest) > 0; {
+						n := min(50000, len(rest))
+						fmt.Fprintf(&req, "%x\r\n%s\r\n", n, rest[:n])
+						rest = rest[n:]
+					}
+					req.WriteString("0\r\n\r\n")
+				} else {
+					req.Write(body)
+				}
+
+				data := req.Bytes()
+				if _, err := conn.Write(data[:head+100]); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(20 * time.Millisecond)
+				for rest := data[head+100:]; len(rest) > 0; {
+					n := min(64*1024, len(rest))
+					if _, err := conn.Write(rest[:n]); err != nil {
+						t.Fatal(err)
+					}
+					rest = rest[n:]
+				}
+
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatalf("chunked=%v: 读取响应失败: %v", chunked, err)
+				}
+				got, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(got) != want {
+					t.Errorf("chunked=%v: 后端收到 %s, 期望 %s", chunked, got, want)
+				}
+			}
+		})
+	}
+}
+
+// logBuffer 收集 Server 的日志,供测试检查某个 event 是否出现过
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// relayGoroutines 返回正在处理连接的 goroutine 数,不含 Accept 循环
+func relayGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	n := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, ".(*Server).handle") {
+			n++
+		}
+	}
+	return n
+}
+
+// waitFor 每 10ms 检查一次 cond,超过 timeout 仍不满足时返回 false
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestHalfCloseTimeout(t *testing.T) {
+	const halfClose = 200 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// silentBackend 为 true 时客户端发完请求后半关闭、后端一直不回复也不关闭;
+		// 为 false 时后端回复后半关闭、客户端一直不关闭
+		silentBackend bool
+		timeout       time.Duration
+	}{
+		{name: "后端不说话", silentBackend: true, timeout: halfClose},
+		{name: "客户端不说话", silentBackend: false, timeout: halfClose},
+		{name: "不限制时连接保持", silentBackend: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			backend := startBackend(t, func(conn net.Conn) {
+				if tt.silentBackend {
+					io.Copy(io.Discard, conn)
+				} else {
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+					conn.(*net.TCPConn).CloseWrite()
+				}
+				<-release
+			})
+			logs := &logBuffer{}
+			s := startServer(t, Config{
+				DestAddrs:        []string{backend},
+				HalfCloseTimeout: tt.timeout,
+				Logger:           slog.New(slog.NewTextHandler(logs, nil)),
+			})
+			// 前面测试留下的连接可能还在收尾,等它们全部退出后再开始计数
+			if !waitFor(5*time.Second, func() bool { return relayGoroutines() == 0 }) {
+				t.Fatalf("开始前仍有 %d 个处理连接的 goroutine", relayGoroutines())
+			}
+
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			if tt.silentBackend {
+				conn.(*net.TCPConn).CloseWrite()
+			}
+			if !waitFor(2*time.Second, func() bool { return s.ActiveConnections() == 1 && relayGoroutines() > 0 }) {
+				t.Fatal("连接没有建立")
+			}
+			start := time.Now()
+
+			if tt.timeout == 0 {
+				time.Sleep(3 * halfClose)
+				if s.ActiveConnections() != 1 {
+					t.Fatalf("未设置 HalfCloseTimeout 时连接被关闭")
+				}
+				return
+			}
+
+			if !waitFor(5*time.Second, func() bool { return s.ActiveConnections() == 0 && relayGoroutines() == 0 }) {
+				t.Fatalf("HalfCloseTimeout 后仍有 %d 个活跃连接、%d 个处理连接的 goroutine",
+					s.ActiveConnections(), relayGoroutines())
+			}
+			if elapsed := time.Since(start); elapsed < halfClose/2 {
+				t.Errorf("连接在 %v 后就被关闭,早于 HalfCloseTimeout %v", elapsed, halfClose)
+			}
+			if !strings.Contains(logs.String(), "event=half_close_timeout") {
+				t.Errorf("日志中没有 half_close_timeout 事件:\n%s", logs.String())
+			}
+
+			// 客户端这一侧也被关闭:读完已转发的数据后读到 EOF
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Errorf("客户端读取 err = %v, 期望读到 EOF", err)
+			}
+		})
+	}
+}
+
+// discardConn 是只写的 net.Conn,写入的数据直接丢弃
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// newCopyServer 返回只用来调用 copyStream 的 Server。NewServer 会绑定监听端口,但不接受连接,结束时关闭
+func newCopyServer(tb testing.TB) *Server {
+	tb.Helper()
+	s, err := NewServer(Config{ListenAddr: "127.0.0.1:0", DestAddrs: []string{"127.0.0.1:1"}, Logger: testLogger()})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(s.Shutdown)
+	return s
+}
+
+// copyUnpooled 是没有缓冲区池时的拷贝方式,每次拷贝新分配一个缓冲区
+func copyUnpooled(dst net.Conn, reader io.Reader, size int) (int64, error) {
+	return io.CopyBuffer(onlyWriter{dst}, onlyReader{reader}, make([]byte, size))
+}
+
+// BenchmarkCopyStream 对比池化缓冲区和每次新分配缓冲区,每次模拟一个连接转发 64KB。
+// reader 是包装过的 bytes.Reader,不会走 splice,两者都经过 io.CopyBuffer。
+// 池化后剩下的分配来自 onlyReader/onlyWriter 装箱,与缓冲区大小无关
+func BenchmarkCopyStream(b *testing.B) {
+	s := newCopyServer(b)
+	data := make([]byte, 64*1024)
+	var dst net.Conn = discardConn{}
+
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		r := bytes.NewReader(data)
+		for b.Loop() {
+			r.Reset(data)
+			s.copyStream(dst, dst, r)
+		}
+	})
+	b.Run("nopool", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		r := bytes.NewReader(data)
+		for b.Loop() {
+			r.Reset(data)
+			copyUnpooled(dst, r, s.cfg.BufferSize)
+		}
+	})
+}
+
+func TestCopyStreamReusesBuffer(t *testing.T) {
+	s := newCopyServer(t)
+	data := make([]byte, 64*1024)
+	var dst net.Conn = discardConn{}
+	r := bytes.NewReader(data)
+
+	perCopy := func(copyFn func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		const runs = 100
+		for range runs {
+			r.Reset(data)
+			copyFn()
+		}
+		runtime.ReadMemStats(&after)
+		return (after.TotalAlloc - before.TotalAlloc) / runs
+	}
+	s.copyStream(dst, dst, r) // 先放一个缓冲区进池
+	pooled := perCopy(func() { s.copyStream(dst, dst, r) })
+	unpooled := perCopy(func() { copyUnpooled(dst, r, s.cfg.BufferSize) })
+	// 不用池时每次至少分配一个 BufferSize 的缓冲区;用池时缓冲区被复用
+	// (-race 下 sync.Pool 会随机丢弃放回的对象,所以只要求明显低于一半)
+	if unpooled < uint64(s.cfg.BufferSize) {
+		t.Fatalf("不用池时每次拷贝分配 %d 字节, 期望至少 %d", unpooled, s.cfg.BufferSize)
+	}
+	if pooled > uint64(s.cfg.BufferSize)/2 {
+		t.Errorf("用池时每次拷贝分配 %d 字节, 不用池时 %d 字节", pooled, unpooled)
+	}
+}
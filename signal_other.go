@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyMaintenanceSignal 在 Windows 上什么也不做:没有 SIGUSR1,维护模式只能通过管理接口切换
+func notifyMaintenanceSignal(c chan<- os.Signal) {}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyMaintenanceSignal 把 SIGUSR1 转发到 c,用于切换维护模式
+func notifyMaintenanceSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
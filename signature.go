@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/badafans/SecureTCPRelay/clienthello"
+)
+
+// maxSignatureEnd 是签名匹配最多需要读取的首包字节数,防止配置过大的偏移让连接一直等待数据
+const maxSignatureEnd = 1024
+
+// SignatureRoute 按首包在 Offset 处的字节是否等于 Match 选择后端,用于在同一端口上分流 SSH 等非 TLS/HTTP 协议
+type SignatureRoute struct {
+	Offset int
+	Match  []byte
+	Addr   string
+	Spec   string // 原始配置,用于日志
+}
+
+// parseSignatureRoutes 解析 "偏移:匹配=后端" 形式的签名路由表,多个用逗号分隔。
+// 匹配以 hex: 开头时按十六进制解析,否则按原样的字节串,如 "0:SSH-=127.0.0.1:22"、"0:hex:0d0a0d0a=127.0.0.1:9000"
+func parseSignatureRoutes(spec string) ([]SignatureRoute, error) {
+	var routes []SignatureRoute
+	if spec == "" {
+		return routes, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("签名路由格式错误: %q", item)
+		}
+		sig, addr := item[:i], item[i+1:]
+		offset, match, ok := strings.Cut(sig, ":")
+		if !ok || match == "" || addr == "" {
+			return nil, fmt.Errorf("签名路由格式错误: %q", item)
+		}
+
+		route := SignatureRoute{Addr: addr, Spec: sig}
+		var err error
+		if route.Offset, err = strconv.Atoi(offset); err != nil || route.Offset < 0 {
+			return nil, fmt.Errorf("签名路由 %q: 无效的偏移 %q", item, offset)
+		}
+		if h, isHex := strings.CutPrefix(match, "hex:"); isHex {
+			if route.Match, err = hex.DecodeString(h); err != nil || len(route.Match) == 0 {
+				return nil, fmt.Errorf("签名路由 %q: 无效的十六进制 %q", item, h)
+			}
+		} else {
+			route.Match = []byte(match)
+		}
+		if route.Offset+len(route.Match) > maxSignatureEnd {
+			return nil, fmt.Errorf("签名路由 %q: 偏移加匹配长度不能超过 %d 字节", item, maxSignatureEnd)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// matchSignature 按顺序查找第一个匹配首包的签名路由。data 不够长时,只有已到达的部分与签名一致才继续读取,
+// 避免为了一个明显不匹配的签名等待客户端发送更多数据。返回值 data 包含补读的字节
+func matchSignature(conn net.Conn, data []byte, routes []SignatureRoute) (*SignatureRoute, []byte, error) {
+	for i := range routes {
+		route := &routes[i]
+		end := route.Offset + len(route.Match)
+		if len(data) < end {
+			if route.Offset < len(data) && !bytes.HasPrefix(route.Match, data[route.Offset:]) {
+				continue
+			}
+			var err error
+			if data, err = clienthello.ReadAtLeast(conn, data, end); err != nil {
+				return nil, nil, err
+			}
+		}
+		if bytes.Equal(data[route.Offset:end], route.Match) {
+			return route, data, nil
+		}
+	}
+	return nil, data, nil
+}
+
+// handleSignature 把命中签名路由的连接原样转发到路由指定的后端,不做域名过滤
+func (s *Server) handleSignature(sess *session, route *SignatureRoute, initialData []byte) {
+	s.endHandshake(sess)
+	sess.logger.Info("允许访问: 首包命中签名路由", "event", "allow", "signature", route.Spec)
+
+	forwardConn, forwardAddr, err := s.dialBackends(sess, []string{route.Addr})
+	if err != nil {
+		return
+	}
+	sess.logger.Info("转发签名路由数据", "event", "forward", "dst", forwardAddr)
+	s.relayTo(sess, forwardConn, forwardAddr, true, nil, initialData)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/badafans/SecureTCPRelay/clienthello"
+)
+
+// Config.Protocol 的取值
+const (
+	protocolAuto    = "auto"    // 按首字节区分 TLS 与 HTTP
+	protocolSMTP    = "smtp"    // SMTP STARTTLS:明文阶段由中继应答,STARTTLS 之后按 ClientHello 的 SNI 过滤
+	protocolSOCKS5  = "socks5"  // SOCKS5 代理:按 CONNECT 请求的目标过滤,连接客户端指定的目标而不是固定后端
+	protocolConnect = "connect" // 同 auto,另外把 HTTP CONNECT 请求当作正向代理处理,连接请求中的目标
+)
+
+const (
+	smtpMaxLineLength = 512 // RFC 5321 4.5.3.1.4 规定的命令行长度上限,含 CRLF
+	smtpMaxCommands   = 20  // STARTTLS 之前最多接受的命令数,防止客户端在明文阶段无限交互
+)
+
+var errSMTPProtocol = errors.New("SMTP 协议错误")
+
+// handleSMTP 在明文阶段代替后端应答 EHLO/HELO、NOOP、RSET、QUIT 和 STARTTLS,其余命令一律要求先 STARTTLS。
+// 客户端发起 STARTTLS 后读取 ClientHello 交给 handleHTTPS 做 SNI 过滤与路由,
+// 连上后端后由 smtpStartTLS 用客户端的 EHLO 与后端重新完成明文阶段,再转发 ClientHello。
+// pending 是 PROXY 头之后已经读到的数据
+func (s *Server) handleSMTP(sess *session, backends []string, pending []byte) {
+	conn := sess.conn
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	reader := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(pending), conn), smtpMaxLineLength)
+	fmt.Fprintf(conn, "220 %s ESMTP\r\n", hostname)
+
+	for i := 0; ; i++ {
+		if i >= smtpMaxCommands {
+			fmt.Fprintf(conn, "421 4.7.0 Too many commands\r\n")
+			sess.logger.Warn("SMTP 明文阶段命令过多，关闭连接", "event", "smtp_error", "commands", i)
+			sess.closeReason = "smtp_error"
+			return
+		}
+
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			fmt.Fprintf(conn, "500 5.5.2 Line too long\r\n")
+			sess.logger.Warn("SMTP 命令行过长，关闭连接", "event", "smtp_error")
+			sess.closeReason = "smtp_error"
+			return
+		}
+		if err != nil {
+			s.logHandshakeError(sess, "读取 SMTP 命令时发生错误", err)
+			return
+		}
+
+		command := strings.TrimRight(string(line), "\r\n")
+		verb, arg, _ := strings.Cut(command, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			if arg == "" {
+				fmt.Fprintf(conn, "501 5.5.4 Syntax: %s hostname\r\n", strings.ToUpper(verb))
+				continue
+			}
+			// 与后端协商 STARTTLS 必须用 EHLO,HELO 的客户端也统一转换
+			sess.smtpHelo = "EHLO " + arg
+			if strings.EqualFold(verb, "EHLO") {
+				fmt.Fprintf(conn, "250-%s\r\n250 STARTTLS\r\n", hostname)
+			} else {
+				fmt.Fprintf(conn, "250 %s\r\n", hostname)
+			}
+		case "NOOP", "RSET":
+			fmt.Fprintf(conn, "250 2.0.0 OK\r\n")
+		case "QUIT":
+			fmt.Fprintf(conn, "221 2.0.0 Bye\r\n")
+			sess.closeReason = "smtp_quit"
+			return
+		case "STARTTLS":
+			if sess.smtpHelo == "" {
+				fmt.Fprintf(conn, "503 5.5.1 EHLO first\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "220 2.0.0 Ready to start TLS\r\n")
+			sess.logger.Debug("客户端发起 STARTTLS", "event", "smtp_starttls", "helo", sess.smtpHelo)
+
+			// bufio 中可能已经缓存了 ClientHello 的开头,接上后继续读够记录头
+			buffered, _ := reader.Peek(reader.Buffered())
+			initialData, err := clienthello.ReadAtLeast(conn, append([]byte(nil), buffered...), 5)
+			if err != nil {
+				s.logHandshakeError(sess, "读取 ClientHello 时发生错误", err)
+				return
+			}
+			if initialData[0] != 0x16 {
+				sess.logger.Warn("拒绝访问: ClientHello 畸形", "event", "reject", "reason", rejectMalformedHello, "error", "STARTTLS 之后不是 TLS 握手记录")
+				s.reject(sess, rejectMalformedHello)
+				return
+			}
+			s.handleHTTPS(sess, backends, initialData)
+			return
+		default:
+			fmt.Fprintf(conn, "530 5.7.0 Must issue a STARTTLS command first\r\n")
+		}
+	}
+}
+
+// smtpStartTLS 与后端完成 SMTP 明文阶段:读取问候、发送客户端的 EHLO、发送 STARTTLS,
+// 成功后后端进入等待 ClientHello 的状态。整个过程受 timeout 限制
+func smtpStartTLS(conn net.Conn, helo string, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	reader := bufio.NewReader(conn)
+	if err := expectSMTPReply(reader, "220"); err != nil {
+		return fmt.Errorf("问候: %w", err)
+	}
+	if _, err := fmt.Fprintf(conn, "%s\r\n", helo); err != nil {
+		return err
+	}
+	if err := expectSMTPReply(reader, "250"); err != nil {
+		return fmt.Errorf("EHLO: %w", err)
+	}
+	if _, err := io.WriteString(conn, "STARTTLS\r\n"); err != nil {
+		return err
+	}
+	if err := expectSMTPReply(reader, "220"); err != nil {
+		return fmt.Errorf("STARTTLS: %w", err)
+	}
+	// 后端在收到 ClientHello 之前不应再发送数据,否则被 reader 缓存的字节会丢失
+	if reader.Buffered() > 0 {
+		return fmt.Errorf("%w: STARTTLS 应答之后收到多余数据", errSMTPProtocol)
+	}
+	return nil
+}
+
+// expectSMTPReply 读取一条(可能多行的)SMTP 应答,检查应答码是否为 code
+func expectSMTPReply(reader *bufio.Reader, code string) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 3 || line[:3] != code {
+			return fmt.Errorf("%w: 期望 %s,收到 %q", errSMTPProtocol, code, line)
+		}
+		// "250-" 表示后面还有行,"250 " 或只有应答码表示最后一行
+		if len(line) == 3 || line[3] == ' ' {
+			return nil
+		}
+	}
+}
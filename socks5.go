@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 协议常量 (RFC 1928、RFC 1929)
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded          = 0x00
+	socksReplyGeneralFailure     = 0x01
+	socksReplyNotAllowed         = 0x02
+	socksReplyHostUnreachable    = 0x04
+	socksReplyConnectionRefused  = 0x05
+	socksReplyCommandUnsupported = 0x07
+	socksReplyAddrUnsupported    = 0x08
+)
+
+// parseSOCKSUsers 解析 "user:pass,user2:pass2" 形式的用户列表
+func parseSOCKSUsers(spec string) (map[string]string, error) {
+	users := make(map[string]string)
+	for _, item := range splitList(spec) {
+		user, pass, ok := strings.Cut(item, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("SOCKS5 用户格式错误: %q,应为 用户名:密码", item)
+		}
+		if len(user) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("SOCKS5 用户 %q: 用户名和密码不能超过 255 字节", user)
+		}
+		users[user] = pass
+	}
+	return users, nil
+}
+
+// handleSOCKS5 完成 SOCKS5 握手(方法协商、可选的用户名密码认证、CONNECT 请求),
+// 目标域名通过白名单与黑名单后再连接目标并转发。pending 是 PROXY 头之后已经读到的数据
+func (s *Server) handleSOCKS5(sess *session, pending []byte) {
+	conn := sess.conn
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(pending), conn))
+
+	if !s.socksAuthenticate(sess, reader) {
+		return
+	}
+
+	host, port, reply, err := readSOCKSRequest(reader)
+	if err != nil {
+		if reply != 0 {
+			writeSOCKSReply(conn, reply, nil)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			s.logHandshakeError(sess, "读取 SOCKS5 请求时发生错误", err)
+			return
+		}
+		sess.logger.Warn("SOCKS5 请求非法", "event", "socks_error", "error", err)
+		sess.closeReason = "socks_error"
+		return
+	}
+	sess.host = host
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	// 目标地址按域名白名单、黑名单过滤,IP 字面量只有白名单为 * 或显式列出时才放行
+	rules := s.rules.Load()
+	if !rules.domains.contains(host) {
+		sess.logger.Warn("拒绝访问: SOCKS5 目标不在允许的域名列表中", "event", "reject", "reason", rejectDomain, "target", target)
+		s.reject(sess, rejectDomain)
+		writeSOCKSReply(conn, socksReplyNotAllowed, nil)
+		return
+	}
+	if rules.denied.contains(host) {
+		sess.logger.Warn("拒绝访问: SOCKS5 目标命中域名黑名单", "event", "reject", "reason", rejectDeniedDomain, "target", target)
+		s.reject(sess, rejectDeniedDomain)
+		writeSOCKSReply(conn, socksReplyNotAllowed, nil)
+		return
+	}
+	s.endHandshake(sess)
+	sess.logger = sess.logger.With("host", host)
+	sess.logger.Info("允许访问: SOCKS5 目标在允许的域名列表中", "event", "allow", "target", target)
+
+	forwardConn, err := s.dialTarget(sess, target)
+	if err != nil {
+		writeSOCKSReply(conn, socksDialReply(err), nil)
+		return
+	}
+	sess.logger.Info("转发 SOCKS5 数据", "event", "forward", "dst", target)
+
+	// 客户端可能在收到应答前就发送了数据,已被 reader 缓存的部分先发给目标
+	buffered, _ := reader.Peek(reader.Buffered())
+	s.relayTo(sess, forwardConn, target, false, func(forwardConn net.Conn) (net.Conn, bool) {
+		if err := writeSOCKSReply(conn, socksReplySucceeded, forwardConn.LocalAddr()); err != nil {
+			sess.logger.Warn("向客户端发送 SOCKS5 应答时出错", "event", "write_error", "error", err)
+			sess.closeReason = "write_error"
+			return nil, false
+		}
+		return forwardConn, true
+	}, buffered)
+}
+
+// socksAuthenticate 完成方法协商;配置了用户时要求用户名密码认证,否则只接受无认证
+func (s *Server) socksAuthenticate(sess *session, reader *bufio.Reader) bool {
+	conn := sess.conn
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		s.logHandshakeError(sess, "读取 SOCKS5 握手时发生错误", err)
+		return false
+	}
+	if header[0] != socksVersion {
+		sess.logger.Warn("SOCKS5 握手非法", "event", "socks_error", "error", fmt.Sprintf("不支持的版本 %d", header[0]))
+		sess.closeReason = "socks_error"
+		return false
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		s.logHandshakeError(sess, "读取 SOCKS5 握手时发生错误", err)
+		return false
+	}
+
+	want := byte(socksMethodNoAuth)
+	if len(s.cfg.SOCKSUsers) > 0 {
+		want = socksMethodUserPass
+	}
+	if !bytes.Contains(methods, []byte{want}) {
+		conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		sess.logger.Warn("拒绝访问: SOCKS5 客户端不支持所需的认证方式", "event", "reject", "reason", rejectSOCKSAuth, "methods", fmt.Sprintf("%x", methods))
+		s.reject(sess, rejectSOCKSAuth)
+		return false
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		sess.closeReason = "write_error"
+		return false
+	}
+	if want == socksMethodNoAuth {
+		return true
+	}
+
+	// RFC 1929: VER(1) ULEN UNAME PLEN PASSWD
+	user, pass, err := readSOCKSUserPass(reader)
+	if err != nil {
+		s.logHandshakeError(sess, "读取 SOCKS5 认证信息时发生错误", err)
+		return false
+	}
+	expected, ok := s.cfg.SOCKSUsers[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		sess.logger.Warn("拒绝访问: SOCKS5 用户名或密码错误", "event", "reject", "reason", rejectSOCKSAuth, "user", user)
+		s.reject(sess, rejectSOCKSAuth)
+		return false
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		sess.closeReason = "write_error"
+		return false
+	}
+	sess.logger = sess.logger.With("socks_user", user)
+	return true
+}
+
+func readSOCKSUserPass(reader *bufio.Reader) (string, string, error) {
+	readField := func() (string, error) {
+		n, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(reader, buf)
+		return string(buf), err
+	}
+
+	if _, err := reader.ReadByte(); err != nil { // 子协商版本,固定为 1
+		return "", "", err
+	}
+	user, err := readField()
+	if err != nil {
+		return "", "", err
+	}
+	pass, err := readField()
+	return user, pass, err
+}
+
+// readSOCKSRequest 读取 CONNECT 请求,返回目标主机(域名已规范化)和端口。
+// 请求不合法时 reply 为应回复给客户端的错误码
+func readSOCKSRequest(reader *bufio.Reader) (host string, port int, reply byte, err error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", 0, 0, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, socksReplyGeneralFailure, fmt.Errorf("不支持的版本 %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		return "", 0, socksReplyCommandUnsupported, fmt.Errorf("不支持的命令 %d,只支持 CONNECT", header[1])
+	}
+
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", 0, 0, err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		n, err := reader.ReadByte()
+		if err != nil {
+			return "", 0, 0, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", 0, 0, err
+		}
+		if n == 0 {
+			return "", 0, socksReplyAddrUnsupported, errors.New("目标域名为空")
+		}
+		host = normalizeDomain(string(name))
+	default:
+		return "", 0, socksReplyAddrUnsupported, fmt.Errorf("不支持的地址类型 %d", header[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		return "", 0, 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(portBytes)), 0, nil
+}
+
+// writeSOCKSReply 发送 CONNECT 应答,bound 为空时绑定地址填 0.0.0.0:0
+func writeSOCKSReply(w io.Writer, reply byte, bound net.Addr) error {
+	msg := []byte{socksVersion, reply, 0x00}
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = append(msg, socksAddrIPv4)
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, socksAddrIPv6)
+		msg = append(msg, ip.To16()...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+	_, err := w.Write(msg)
+	return err
+}
+
+// socksDialReply 把拨号错误映射为 SOCKS5 应答码
+func socksDialReply(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case os.IsTimeout(err), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return socksReplyHostUnreachable
+	default:
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return socksReplyHostUnreachable
+		}
+		return socksReplyGeneralFailure
+	}
+}
+
+// socksUpstream 是出站使用的上游 SOCKS5 代理,user 为空时不认证
+type socksUpstream struct {
+	addr string
+	user string
+	pass string
+}
+
+// parseSOCKSUpstream 解析 "[socks5://][用户名:密码@]host:port" 形式的上游代理地址
+func parseSOCKSUpstream(spec string) (*socksUpstream, error) {
+	rest, _ := strings.CutPrefix(spec, "socks5://")
+	u := &socksUpstream{addr: rest}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		u.addr = rest[i+1:]
+		user, pass, ok := strings.Cut(rest[:i], ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("上游 SOCKS5 认证格式错误,应为 用户名:密码@host:port")
+		}
+		if len(user) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("上游 SOCKS5 用户名和密码不能超过 255 字节")
+		}
+		u.user, u.pass = user, pass
+	}
+	if _, _, err := net.SplitHostPort(u.addr); err != nil {
+		return nil, fmt.Errorf("无效的上游 SOCKS5 地址 %q: %w", u.addr, err)
+	}
+	return u, nil
+}
+
+// dial 连接上游代理并发送 CONNECT,成功后返回的连接直接通往 target。
+// target 中的主机名原样交给上游解析,整个握手受 timeout 限制。local 不为空时连接上游使用该出口 IP
+func (u *socksUpstream) dial(ctx context.Context, target string, timeout time.Duration, local net.IP) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的端口 %q", portStr)
+	}
+
+	conn, err := dialTCP(ctx, u.addr, timeout, local)
+	if err != nil {
+		return nil, fmt.Errorf("连接上游 SOCKS5 %s: %w", u.addr, err)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := u.handshake(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("上游 SOCKS5 %s: %w", u.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (u *socksUpstream) handshake(conn net.Conn, host string, port uint16) error {
+	method := byte(socksMethodNoAuth)
+	if u.user != "" {
+		method = socksMethodUserPass
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return fmt.Errorf("不接受认证方式 %d", method)
+	}
+
+	if method == socksMethodUserPass {
+		msg := []byte{0x01, byte(len(u.user))}
+		msg = append(msg, u.user...)
+		msg = append(msg, byte(len(u.pass)))
+		msg = append(msg, u.pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("用户名或密码错误")
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("域名过长: %s", host)
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// 应答: VER REP RSV ATYP BND.ADDR BND.PORT,绑定地址用不到,读完丢弃
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socksReplySucceeded {
+		return fmt.Errorf("CONNECT 失败,应答码 %d", header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case socksAddrIPv4:
+		addrLen = net.IPv4len
+	case socksAddrIPv6:
+		addrLen = net.IPv6len
+	case socksAddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		addrLen = int(n[0])
+	default:
+		return fmt.Errorf("应答中不支持的地址类型 %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket 是单个 statsd 数据报的长度上限,留出余量避免在常见 MTU 下分片
+const statsdMaxPacket = 1432
+
+// statsdReporter 按 statsd 协议把指标通过 UDP 推送到 addr:计数器按周期推送增量(|c),
+// 活跃连接数和后端状态推送当前值(|g),连接时长在每条连接结束时推送(|ms)。
+// 与 /metrics 读取同一套计数器,两者可以同时开启。UDP 发送失败只记 Debug 日志,不影响转发
+type statsdReporter struct {
+	conn   net.Conn
+	prefix string
+	logger *slog.Logger
+	last   map[string]uint64 // 上一周期推送时各计数器的累计值,只在 run 中访问
+}
+
+func newStatsdReporter(addr, prefix string, logger *slog.Logger) (*statsdReporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = strings.TrimSuffix(prefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+	return &statsdReporter{conn: conn, prefix: prefix, logger: logger, last: make(map[string]uint64)}, nil
+}
+
+// timing 推送一次耗时采样,r 为空时什么也不做
+func (r *statsdReporter) timing(name string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.send([]string{fmt.Sprintf("%s%s:%d|ms", r.prefix, name, d.Milliseconds())})
+}
+
+// run 每隔 interval 推送一次 servers 的指标,随进程一直运行
+func (r *statsdReporter) run(servers []*Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.send(r.collect(servers))
+	}
+}
+
+// collect 汇总当前指标并生成 statsd 行,计数器换算成与上一周期的差值
+func (r *statsdReporter) collect(servers []*Server) []string {
+	m := servers[0].metrics
+
+	var active int32
+	for _, s := range servers {
+		active += s.ActiveConnections()
+	}
+	lines := []string{fmt.Sprintf("%sconnections.active:%d|g", r.prefix, active)}
+
+	counters := map[string]uint64{
+		"connections.accepted":   m.accepted.Load(),
+		"dial_failures":          m.dialFailures.Load(),
+		"bytes.client_to_server": m.bytesClientToServer.Load(),
+		"bytes.server_to_client": m.bytesServerToClient.Load(),
+		"webhook.dropped":        m.webhookDropped.Load(),
+		"webhook.failures":       m.webhookFailures.Load(),
+		"otel.dropped_spans":     m.otelDropped.Load(),
+		"otel.failed_spans":      m.otelFailures.Load(),
+	}
+	m.mu.Lock()
+	for reason, n := range m.rejected {
+		counters["connections.rejected."+string(reason)] = n
+	}
+	m.mu.Unlock()
+	for name, total := range counters {
+		// 没有变化的计数器不推送,statsd 会在本周期把它当作 0
+		if delta := total - r.last[name]; delta > 0 {
+			lines = append(lines, fmt.Sprintf("%s%s:%d|c", r.prefix, name, delta))
+		}
+		r.last[name] = total
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range servers {
+		if s.health == nil {
+			continue
+		}
+		for _, addr := range s.health.addrs() {
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			up := 0
+			if s.health.isUp(addr) {
+				up = 1
+			}
+			lines = append(lines, fmt.Sprintf("%sbackend.%s.up:%d|g", r.prefix, statsdName(addr), up))
+		}
+	}
+	return lines
+}
+
+// send 把多行指标用换行拼成尽量少的数据报发出
+func (r *statsdReporter) send(lines []string) {
+	var packet bytes.Buffer
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := r.conn.Write(packet.Bytes()); err != nil {
+			r.logger.Debug("推送 statsd 指标失败", "event", "statsd_error", "error", err)
+		}
+		packet.Reset()
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+}
+
+// statsdName 把后端地址等任意字符串转成可以作为 statsd 指标名一段的形式,
+// 点号是 graphite 的层级分隔符,冒号是 statsd 的值分隔符,都要替换掉
+func statsdName(s string) string {
+	return strings.Map(func(c rune) rune {
+		switch c {
+		case '.', ':', '/', '|', '@', ' ', '[', ']':
+			return '_'
+		}
+		return c
+	}, s)
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdNotifier 按 sd_notify 协议通过 NOTIFY_SOCKET 向 systemd 报告服务状态。
+// 不是由 systemd 以 Type=notify 启动(没有 NOTIFY_SOCKET)时 newSystemdNotifier 返回 nil,所有方法什么也不做
+type systemdNotifier struct {
+	conn   *net.UnixConn
+	logger *slog.Logger
+}
+
+func newSystemdNotifier(logger *slog.Logger) *systemdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		logger.Warn("未设置 NOTIFY_SOCKET，忽略 -systemd", "event", "systemd")
+		return nil
+	}
+	// 以 @ 开头的是抽象命名空间的 socket,net 包会自动换成开头的 \0
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		logger.Error("无法连接 systemd 通知 socket", "event", "systemd", "socket", socket, "error", err)
+		return nil
+	}
+	return &systemdNotifier{conn: conn, logger: logger}
+}
+
+// notify 发送一条状态,如 READY=1、STOPPING=1
+func (n *systemdNotifier) notify(state string) {
+	if n == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		n.logger.Debug("向 systemd 发送通知失败", "event", "systemd", "state", state, "error", err)
+	}
+}
+
+// runWatchdog 在 systemd 开启看门狗(WatchdogSec=,体现为 WATCHDOG_USEC)时每隔一半超时发送一次 WATCHDOG=1,
+// 随进程一直运行;没有开启看门狗或 WATCHDOG_PID 指向别的进程时直接返回
+func (n *systemdNotifier) runWatchdog() {
+	if n == nil {
+		return
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	n.logger.Info("已开启 systemd 看门狗", "event", "systemd", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.notify("WATCHDOG=1")
+	}
+}
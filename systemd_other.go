@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "log/slog"
+
+// systemdNotifier 只在 Linux 上可用,其他系统上 -systemd 被忽略
+type systemdNotifier struct{}
+
+func newSystemdNotifier(logger *slog.Logger) *systemdNotifier {
+	logger.Warn("非 Linux 系统不支持 systemd 通知，忽略 -systemd", "event", "systemd")
+	return nil
+}
+
+func (n *systemdNotifier) notify(state string) {}
+
+func (n *systemdNotifier) runWatchdog() {}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/badafans/SecureTCPRelay/clienthello"
+)
+
+// handleTLSTerminate 用本地证书与客户端完成 TLS 握手,按握手结果中的 SNI 过滤后,
+// 把解密后的明文交给 handleHTTP,按 Host 白名单转发到非 TLS 后端。initialData 是已读到的 ClientHello 开头
+func (s *Server) handleTLSTerminate(sess *session, backends []string, initialData []byte) {
+	raw := sess.conn
+
+	// 按 SNI 选证书时先自己解析 ClientHello,没有匹配的证书就回 unrecognized_name,
+	// 而不是让 crypto/tls 在 GetCertificate 出错时回 internal_error
+	if s.cfg.TLSCerts != nil {
+		clientHello, fullHello, err := clienthello.Read(raw, initialData)
+		if errors.Is(err, clienthello.ErrMalformed) {
+			sess.logger.Warn("拒绝访问: ClientHello 畸形", "event", "reject", "reason", rejectMalformedHello, "error", err)
+			logExtensionError(sess.logger, err)
+			s.reject(sess, rejectMalformedHello)
+			writeTLSAlert(raw, tlsAlertDecodeError)
+			return
+		}
+		if err != nil {
+			s.logHandshakeError(sess, "读取 ClientHello 时发生错误", err)
+			return
+		}
+		if s.cfg.TLSCerts.lookup(clientHello.ServerName) == nil {
+			sess.host = clientHello.ServerName
+			sess.logger.Warn("拒绝访问: 没有与 SNI 匹配的证书", "event", "reject", "reason", rejectNoCert, "sni", clientHello.ServerName)
+			s.reject(sess, rejectNoCert)
+			writeTLSAlert(raw, tlsAlertUnrecognizedName)
+			return
+		}
+		initialData = fullHello
+	}
+	tlsConn := tls.Server(&replayConn{Conn: raw, r: io.MultiReader(bytes.NewReader(initialData), raw)}, s.cfg.TLSConfig)
+	if err := tlsConn.HandshakeContext(sess.ctx); err != nil {
+		var recordErr tls.RecordHeaderError
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			s.logHandshakeError(sess, "TLS 握手时发生错误", err)
+			return
+		}
+		if errors.As(err, &recordErr) {
+			sess.logger.Warn("拒绝访问: ClientHello 畸形", "event", "reject", "reason", rejectMalformedHello, "error", err)
+			s.reject(sess, rejectMalformedHello)
+			return
+		}
+		sess.logger.Warn("TLS 握手失败", "event", "tls_error", "error", err)
+		sess.closeReason = "tls_error"
+		return
+	}
+
+	state := tlsConn.ConnectionState()
+	sni := state.ServerName
+	sess.host = sni
+	sess.tls = true
+	sess.logger = sess.logger.With("sni", sni, "tls_version", tls.VersionName(state.Version))
+	sess.logger.Debug("TLS 握手完成", "event", "tls_terminate", "alpn", state.NegotiatedProtocol)
+
+	// SNI 过滤与透传模式一致:先白名单再黑名单,不带 SNI 时只有 AllowNoSNI 或白名单为 * 才放行,RequireSNI 时一律拒绝
+	rules := s.rules.Load()
+	switch {
+	case sni == "" && (s.cfg.RequireSNI || (!s.cfg.AllowNoSNI && !rules.domains.all)):
+		sess.logger.Warn("拒绝访问: ClientHello 不含 SNI", "event", "reject", "reason", rejectNoSNI)
+		s.reject(sess, rejectNoSNI)
+		tlsConn.Close()
+		return
+	case sni != "" && !rules.domains.contains(sni):
+		sess.logger.Warn("拒绝访问: SNI 不在允许的域名列表中", "event", "reject", "reason", rejectSNI)
+		s.reject(sess, rejectSNI)
+		tlsConn.Close()
+		return
+	case sni != "" && rules.denied.contains(sni):
+		sess.logger.Warn("拒绝访问: SNI 命中域名黑名单", "event", "reject", "reason", rejectDeniedDomain)
+		s.reject(sess, rejectDeniedDomain)
+		tlsConn.Close()
+		return
+	}
+
+	// 之后的读写、半关闭和超时都经过 TLS 连接,handleHTTP 看到的就是明文请求
+	sess.conn = tlsConn
+	s.handleHTTP(sess, backends, nil)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML 解析 TOML 的常用子集:key = value、[table] 与 [[table]] 表数组、
+// 四种字符串、整数、浮点数、布尔值、可以跨行的数组和行内表,以及 # 注释。
+// 返回与 parseYAML 相同形状的结果,标量一律转成字符串,由调用方按字段类型转换
+func parseTOML(data []byte) (any, error) {
+	p := &tomlParser{data: string(data)}
+	root := make(map[string]any)
+	cur := root
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return root, nil
+		}
+
+		if p.peek() == '[' {
+			array := strings.HasPrefix(p.data[p.pos:], "[[")
+			if array {
+				p.pos += 2
+			} else {
+				p.pos++
+			}
+			p.skipSpace()
+			key, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			closing := "]"
+			if array {
+				closing = "]]"
+			}
+			if !strings.HasPrefix(p.data[p.pos:], closing) {
+				return nil, p.errorf("表头缺少 %s", closing)
+			}
+			p.pos += len(closing)
+
+			cur = make(map[string]any)
+			if array {
+				list, ok := root[key].([]any)
+				if _, exists := root[key]; exists && !ok {
+					return nil, p.errorf("重复的键 %s", key)
+				}
+				root[key] = append(list, cur)
+			} else {
+				if _, dup := root[key]; dup {
+					return nil, p.errorf("重复的键 %s", key)
+				}
+				root[key] = cur
+			}
+		} else {
+			key, value, err := p.parseKeyValue()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := cur[key]; dup {
+				return nil, p.errorf("重复的键 %s", key)
+			}
+			cur[key] = value
+		}
+
+		p.skipSpace()
+		p.skipComment()
+		if !p.eof() && p.peek() != '\n' && !strings.HasPrefix(p.data[p.pos:], "\r\n") {
+			return nil, p.errorf("行尾有多余的内容")
+		}
+	}
+}
+
+type tomlParser struct {
+	data string
+	pos  int
+}
+
+func (p *tomlParser) eof() bool  { return p.pos >= len(p.data) }
+func (p *tomlParser) peek() byte { return p.data[p.pos] }
+
+// errorf 生成带当前行号的错误
+func (p *tomlParser) errorf(format string, args ...any) error {
+	line := strings.Count(p.data[:min(p.pos, len(p.data))], "\n") + 1
+	return fmt.Errorf("第 %d 行: %s", line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace 跳过同一行内的空格和 tab
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if !p.eof() && p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// skipBlank 跳过空白、换行和注释,用于行与行之间以及数组内部
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// parseKey 解析裸键或带引号的键,不支持点分隔的多级键
+func (p *tomlParser) parseKey() (string, error) {
+	if p.eof() {
+		return "", p.errorf("缺少键名")
+	}
+	var key string
+	switch p.peek() {
+	case '"':
+		s, err := p.parseBasicString()
+		if err != nil {
+			return "", err
+		}
+		key = s
+	case '\'':
+		s, err := p.parseLiteralString()
+		if err != nil {
+			return "", err
+		}
+		key = s
+	default:
+		start := p.pos
+		for !p.eof() && isTOMLBareKeyChar(p.peek()) {
+			p.pos++
+		}
+		if p.pos == start {
+			return "", p.errorf("缺少键名")
+		}
+		key = p.data[start:p.pos]
+	}
+	p.skipSpace()
+	if !p.eof() && p.peek() == '.' {
+		return "", p.errorf("不支持点分隔的键 %s", key)
+	}
+	return key, nil
+}
+
+func isTOMLBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+func (p *tomlParser) parseKeyValue() (string, any, error) {
+	key, err := p.parseKey()
+	if err != nil {
+		return "", nil, err
+	}
+	p.skipSpace()
+	if p.eof() || p.peek() != '=' {
+		return "", nil, p.errorf("应为 key = value 格式")
+	}
+	p.pos++
+	p.skipSpace()
+	value, err := p.parseValue()
+	if err != nil {
+		return "", nil, err
+	}
+	return key, value, nil
+}
+
+func (p *tomlParser) parseValue() (any, error) {
+	if p.eof() {
+		return nil, p.errorf("缺少值")
+	}
+	rest := p.data[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, `"""`):
+		return p.parseMultilineString(`"""`)
+	case strings.HasPrefix(rest, "'''"):
+		return p.parseMultilineString("'''")
+	case rest[0] == '"':
+		return p.parseBasicString()
+	case rest[0] == '\'':
+		return p.parseLiteralString()
+	case rest[0] == '[':
+		return p.parseArray()
+	case rest[0] == '{':
+		return p.parseInlineTable()
+	}
+
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", rune(p.peek())) {
+		p.pos++
+	}
+	token := p.data[start:p.pos]
+	switch token {
+	case "true", "false":
+		return token, nil
+	}
+	if n, ok, err := p.parseInteger(token); ok {
+		if err != nil {
+			p.pos = start
+			return nil, err
+		}
+		return strconv.FormatInt(n, 10), nil
+	}
+	if _, err := strconv.ParseFloat(token, 64); err == nil {
+		return strings.ReplaceAll(token, "_", ""), nil
+	}
+	p.pos = start
+	return nil, p.errorf("无效的值 %q,字符串需要加引号", token)
+}
+
+// parseInteger 按 TOML 的规则解析整数:十进制可以带符号但不允许前导零,0x、0o、0b 前缀分别表示十六、八、二进制且不能带符号,
+// 下划线只能出现在两个数字之间。token 不是整数的形式(例如浮点数)时 ok 为 false;
+// 带前导零的十进制数在这里就报错,不会再被当作浮点数接受
+func (p *tomlParser) parseInteger(token string) (n int64, ok bool, err error) {
+	base, digits, sign := 10, token, ""
+	if len(token) > 1 && token[0] == '0' {
+		switch token[1] {
+		case 'x':
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		}
+	}
+	if base != 10 {
+		digits = token[2:]
+	} else {
+		if token != "" && (token[0] == '+' || token[0] == '-') {
+			sign, digits = token[:1], token[1:]
+		}
+		if digits == "" || digits[0] < '0' || digits[0] > '9' {
+			return 0, false, nil
+		}
+		if len(digits) > 1 && digits[0] == '0' && (digits[1] >= '0' && digits[1] <= '9' || digits[1] == '_') {
+			return 0, true, p.errorf("无效的数字 %s,不允许前导零", token)
+		}
+		if strings.ContainsAny(digits, ".eE") {
+			return 0, false, nil
+		}
+	}
+
+	if digits == "" || digits[0] == '_' || digits[len(digits)-1] == '_' || strings.Contains(digits, "__") {
+		return 0, true, p.errorf("无效的整数 %s", token)
+	}
+	n, err = strconv.ParseInt(sign+strings.ReplaceAll(digits, "_", ""), base, 64)
+	if err != nil {
+		return 0, true, p.errorf("无效的整数 %s", token)
+	}
+	return n, true, nil
+}
+
+// parseBasicString 解析单行的双引号字符串
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("字符串缺少结束的引号")
+		}
+		c := p.peek()
+		if c == '"' {
+			p.pos++
+			return b.String(), nil
+		}
+		if c == '\\' {
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+			continue
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+}
+
+// parseLiteralString 解析单行的单引号字符串,内容不做转义
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.pos++
+	end := strings.IndexAny(p.data[p.pos:], "'\n")
+	if end < 0 || p.data[p.pos+end] != '\'' {
+		return "", p.errorf("字符串缺少结束的引号")
+	}
+	s := p.data[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// parseMultilineString 解析由 delim(三个双引号或三个单引号)包围的多行字符串,紧跟开头引号的换行会被去掉
+func (p *tomlParser) parseMultilineString(delim string) (string, error) {
+	p.pos += len(delim)
+	if strings.HasPrefix(p.data[p.pos:], "\r\n") {
+		p.pos += 2
+	} else if !p.eof() && p.peek() == '\n' {
+		p.pos++
+	}
+
+	if delim == "'''" {
+		end := strings.Index(p.data[p.pos:], delim)
+		if end < 0 {
+			return "", p.errorf("多行字符串缺少结束的 %s", delim)
+		}
+		s := p.data[p.pos : p.pos+end]
+		p.pos += end + len(delim)
+		return s, nil
+	}
+
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("多行字符串缺少结束的 %s", delim)
+		}
+		if strings.HasPrefix(p.data[p.pos:], delim) {
+			p.pos += len(delim)
+			return b.String(), nil
+		}
+		if p.peek() == '\\' {
+			// 行尾的反斜杠连同后面的空白和换行一起去掉
+			rest := strings.TrimLeft(p.data[p.pos+1:], " \t")
+			if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+				p.pos = len(p.data) - len(strings.TrimLeft(rest, " \t\r\n"))
+				continue
+			}
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+			continue
+		}
+		b.WriteByte(p.peek())
+		p.pos++
+	}
+}
+
+// parseEscape 解析当前位置的反斜杠转义并写入 b
+func (p *tomlParser) parseEscape(b *strings.Builder) error {
+	if p.pos+1 >= len(p.data) {
+		return p.errorf("字符串缺少结束的引号")
+	}
+	c := p.data[p.pos+1]
+	p.pos += 2
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"':
+		b.WriteByte('"')
+	case '\\':
+		b.WriteByte('\\')
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.data) {
+			return p.errorf("无效的转义 \\%c", c)
+		}
+		n, err := strconv.ParseUint(p.data[p.pos:p.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(n)) {
+			return p.errorf("无效的转义 \\%c%s", c, p.data[p.pos:p.pos+size])
+		}
+		b.WriteRune(rune(n))
+		p.pos += size
+	default:
+		return p.errorf("无效的转义 \\%c", c)
+	}
+	return nil
+}
+
+// parseArray 解析数组,元素之间可以换行和写注释,允许末尾多一个逗号
+func (p *tomlParser) parseArray() ([]any, error) {
+	p.pos++
+	list := []any{}
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil, p.errorf("数组缺少 ]")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return list, nil
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		p.skipBlank()
+		if !p.eof() && p.peek() == ',' {
+			p.pos++
+			continue
+		}
+		if p.eof() || p.peek() != ']' {
+			return nil, p.errorf("数组元素之间缺少逗号")
+		}
+	}
+}
+
+// parseInlineTable 解析写在一行内的 {key = value, ...}
+func (p *tomlParser) parseInlineTable() (map[string]any, error) {
+	p.pos++
+	m := make(map[string]any)
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil, p.errorf("行内表缺少 }")
+		}
+		if p.peek() == '}' && len(m) == 0 {
+			p.pos++
+			return m, nil
+		}
+		key, value, err := p.parseKeyValue()
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("重复的键 %s", key)
+		}
+		m[key] = value
+		p.skipSpace()
+		if !p.eof() && p.peek() == ',' {
+			p.pos++
+			continue
+		}
+		if p.eof() || p.peek() != '}' {
+			return nil, p.errorf("行内表缺少 }")
+		}
+		p.pos++
+		return m, nil
+	}
+}
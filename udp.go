@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxUDPPacket          = 64 * 1024 // 单个 UDP 数据报的最大长度
+	defaultUDPIdleTimeout = time.Minute
+)
+
+// udpRelay 在与 TCP 相同的地址上收 UDP 包,按客户端地址维护会话,每个会话对应一个连到后端的 UDP socket。
+// 只做 CIDR 白名单和封禁判断,不解析 SNI;会话在两个方向都超过 idle 没有数据后关闭
+type udpRelay struct {
+	server  *Server
+	conn    *net.UDPConn
+	backend string
+	idle    time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+type udpSession struct {
+	client     *net.UDPAddr
+	backend    net.Conn
+	start      time.Time
+	lastActive atomic.Int64 // UnixNano
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+}
+
+// newUDPRelay 在 addr 上监听 UDP。reusePort 为 true 时同样设置 SO_REUSEPORT,
+// 让滚动替换时新进程可以在旧进程退出前绑定同一端口
+func newUDPRelay(s *Server, addr, backend string, idle time.Duration, reusePort bool) (*udpRelay, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpRelay{
+		server:   s,
+		conn:     pc.(*net.UDPConn),
+		backend:  backend,
+		idle:     idle,
+		sessions: make(map[string]*udpSession),
+	}, nil
+}
+
+// serve 读取客户端数据报并转发给对应会话的后端,直到 close 关闭监听 socket
+func (u *udpRelay) serve() {
+	s := u.server
+	s.logger.Info("正在监听并转发 UDP", "event", "listen", "src", u.conn.LocalAddr().String(), "dst_udp", u.backend)
+
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, client, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Error("接收 UDP 数据报时发生错误", "event", "accept_error", "error", err)
+			continue
+		}
+
+		sess, err := u.session(client)
+		if err != nil {
+			continue
+		}
+		sess.lastActive.Store(time.Now().UnixNano())
+		if _, err := sess.backend.Write(buf[:n]); err != nil {
+			s.logger.Debug("向 UDP 后端发送数据报时出错", "event", "write_error", "client", client.String(), "error", err)
+			continue
+		}
+		sess.bytesIn.Add(int64(n))
+		s.metrics.bytesClientToServer.Add(uint64(n))
+	}
+}
+
+// session 返回 client 的会话,不存在时检查白名单与封禁后新建。UDP 没有连接,
+// 被拒绝的来源每个数据报都会走到这里,所以拒绝只记 Debug 日志,避免日志被刷屏
+func (u *udpRelay) session(client *net.UDPAddr) (*udpSession, error) {
+	key := client.String()
+	u.mu.Lock()
+	sess := u.sessions[key]
+	u.mu.Unlock()
+	if sess != nil {
+		return sess, nil
+	}
+
+	s := u.server
+	clientIP, _ := remoteIP(client)
+	if s.cfg.AllowHours != nil && !s.cfg.AllowHours.contains(time.Now()) {
+		s.logger.Debug("拒绝 UDP: 不在允许访问的时间段内", "event", "reject", "reason", rejectAllowHours, "client_ip", clientIP)
+		s.metrics.reject(rejectAllowHours)
+		return nil, errors.New(string(rejectAllowHours))
+	}
+	if s.cfg.Maintenance.enabled() {
+		s.logger.Debug("拒绝 UDP: 维护模式", "event", "reject", "reason", rejectMaintenance, "client_ip", clientIP)
+		s.metrics.reject(rejectMaintenance)
+		return nil, errors.New(string(rejectMaintenance))
+	}
+	if s.banned(clientIP) {
+		s.logger.Debug("拒绝 UDP: 源 IP 处于封禁期", "event", "reject", "reason", rejectBanned, "client_ip", clientIP)
+		s.metrics.reject(rejectBanned)
+		return nil, errors.New(string(rejectBanned))
+	}
+	if reason := s.rules.Load().checkIP(client.IP); reason != "" {
+		s.logger.Debug("拒绝 UDP: "+cidrRejectMessages[reason], "event", "reject", "reason", reason, "client_ip", clientIP)
+		s.metrics.reject(reason)
+		return nil, errors.New(string(reason))
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if sess := u.sessions[key]; sess != nil {
+		return sess, nil
+	}
+	if s.cfg.MaxConns > 0 && len(u.sessions) >= s.cfg.MaxConns {
+		s.logger.Warn("达到最大 UDP 会话数，丢弃数据报", "event", "reject", "reason", rejectMaxConns, "client_ip", clientIP, "max_conns", s.cfg.MaxConns)
+		s.metrics.reject(rejectMaxConns)
+		return nil, errors.New(string(rejectMaxConns))
+	}
+
+	dialer := net.Dialer{Timeout: s.cfg.DialTimeout}
+	if s.cfg.BindIP != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: s.cfg.BindIP}
+	}
+	backend, err := dialer.Dial("udp", u.backend)
+	if err != nil {
+		s.metrics.dialFailures.Add(1)
+		s.logger.Error("无法连接到 UDP 转发目标", "event", "dial_error", "client_ip", clientIP, "dst", u.backend, "error", err)
+		return nil, err
+	}
+	sess = &udpSession{client: client, backend: backend, start: time.Now()}
+	sess.lastActive.Store(sess.start.UnixNano())
+	u.sessions[key] = sess
+	s.metrics.accepted.Add(1)
+	s.logger.Info("新 UDP 会话建立", "event", "udp_open", "client", key, "dst", u.backend, "sessions", len(u.sessions))
+
+	go u.reply(key, sess)
+	return sess, nil
+}
+
+// reply 把后端的回包发回客户端;读超时时检查会话是否已空闲超过 idle,是则关闭会话
+func (u *udpRelay) reply(key string, sess *udpSession) {
+	s := u.server
+	defer func() {
+		u.mu.Lock()
+		if u.sessions[key] == sess {
+			delete(u.sessions, key)
+		}
+		u.mu.Unlock()
+		sess.backend.Close()
+		s.logger.Info("UDP 会话关闭", "event", "udp_close", "client", key,
+			"bytes_in", sess.bytesIn.Load(), "bytes_out", sess.bytesOut.Load(), "duration", time.Since(sess.start).Round(time.Millisecond))
+	}()
+
+	buf := make([]byte, maxUDPPacket)
+	for {
+		deadline := time.Unix(0, sess.lastActive.Load()).Add(u.idle)
+		if !time.Now().Before(deadline) {
+			return
+		}
+		sess.backend.SetReadDeadline(deadline)
+		n, err := sess.backend.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue // 期间可能有客户端数据刷新了 lastActive,回到循环开头重新判断
+		}
+		if err != nil {
+			// 后端端口不可达时会收到 ICMP 导致的 ECONNREFUSED,会话直接结束
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Debug("读取 UDP 后端回包时出错", "event", "read_error", "client", key, "error", err)
+			}
+			return
+		}
+		sess.lastActive.Store(time.Now().UnixNano())
+		if _, err := u.conn.WriteToUDP(buf[:n], sess.client); err != nil {
+			s.logger.Debug("向 UDP 客户端发送数据报时出错", "event", "write_error", "client", key, "error", err)
+			continue
+		}
+		sess.bytesOut.Add(int64(n))
+		s.metrics.bytesServerToClient.Add(uint64(n))
+	}
+}
+
+// close 关闭监听 socket 和全部会话
+func (u *udpRelay) close() {
+	u.conn.Close()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, sess := range u.sessions {
+		sess.backend.Close()
+	}
+}
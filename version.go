@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// 构建信息,发布时通过 -ldflags 注入,例如
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+// buildInfo 返回版本号、commit 和构建时间。未通过 -ldflags 注入时,
+// 从 go build 自动嵌入的 VCS 信息中读取 commit 和提交时间,都没有时为 unknown
+func buildInfo() (ver, rev, built string) {
+	ver, rev, built = version, commit, buildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+				if len(rev) > 12 {
+					rev = rev[:12]
+				}
+			case s.Key == "vcs.time" && built == "":
+				built = s.Value
+			}
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return ver, rev, built
+}
+
+// versionString 返回 -version 输出的一行版本信息
+func versionString() string {
+	ver, rev, built := buildInfo()
+	return fmt.Sprintf("SecureTCPRelay %s (commit %s, built %s, %s %s/%s)", ver, rev, built, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
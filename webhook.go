@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// webhookQueueSize 是等待发送的事件数上限,队列满时直接丢弃新事件
+const webhookQueueSize = 1024
+
+// webhookEvent 是 POST 给 webhook 的 JSON 内容
+type webhookEvent struct {
+	Event       string    `json:"event"` // open 或 close
+	Time        time.Time `json:"time"`
+	Listener    string    `json:"listener"`
+	ConnID      uint64    `json:"conn_id"`
+	ClientIP    string    `json:"client_ip"`
+	Host        string    `json:"host,omitempty"` // TLS 连接为 SNI,非TLS 连接为 Host 头
+	Dst         string    `json:"dst,omitempty"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	DurationMS  int64     `json:"duration_ms"`
+	CloseReason string    `json:"close_reason,omitempty"`
+}
+
+// webhookNotifier 在后台 goroutine 中把连接事件逐个 POST 到 url。
+// notify 从不阻塞:队列满或发送失败的事件直接丢弃并计数,不影响转发主路径
+type webhookNotifier struct {
+	url     string
+	client  *http.Client
+	queue   chan webhookEvent
+	logger  *slog.Logger
+	metrics *metrics
+}
+
+// newWebhookNotifier 创建 notifier 并启动发送 goroutine,它随进程一直运行
+func newWebhookNotifier(url string, timeout time.Duration, logger *slog.Logger, m *metrics) *webhookNotifier {
+	w := &webhookNotifier{
+		url:     url,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan webhookEvent, webhookQueueSize),
+		logger:  logger,
+		metrics: m,
+	}
+	go w.run()
+	return w
+}
+
+func (w *webhookNotifier) notify(ev webhookEvent) {
+	select {
+	case w.queue <- ev:
+	default:
+		w.metrics.webhookDropped.Add(1)
+	}
+}
+
+func (w *webhookNotifier) run() {
+	for ev := range w.queue {
+		if err := w.send(ev); err != nil {
+			w.metrics.webhookFailures.Add(1)
+			w.logger.Debug("发送 webhook 失败，丢弃事件", "event", "webhook_error", "conn_id", ev.ConnID, "error", err)
+		}
+	}
+}
+
+func (w *webhookNotifier) send(ev webhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook 返回 %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// connJob 是投递给 worker 的一个已接受、已占好连接数名额的连接
+type connJob struct {
+	conn   net.Conn
+	ipSlot *int32 // 按源 IP 的并发计数,连接结束时减一,未开启时为 nil
+}
+
+// runWorkers 启动 cfg.Workers 个 worker,每个 worker 依次处理队列中的连接,一次处理一个,直到 Server 排空结束。
+// 排空超时后才被取走的连接,其 context 派生自已取消的根 context,会立即关闭
+func (s *Server) runWorkers() {
+	for i := 0; i < s.cfg.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-s.jobs:
+					s.serveJob(job)
+				case <-s.done:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) serveJob(job connJob) {
+	s.handleConnection(job.conn)
+	if job.ipSlot != nil {
+		atomic.AddInt32(job.ipSlot, -1)
+	}
+}
+
+// closeQueued 关闭队列中还没有被 worker 取走的连接,在排空结束后调用
+func (s *Server) closeQueued() {
+	for {
+		select {
+		case job := <-s.jobs:
+			atomic.AddInt32(&s.activeConnections, -1)
+			if job.ipSlot != nil {
+				atomic.AddInt32(job.ipSlot, -1)
+			}
+			job.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// dispatch 交出一个连接:未开启 worker pool 时为它新起一个 goroutine,否则放进队列,队列满时返回 false
+func (s *Server) dispatch(job connJob) bool {
+	if s.jobs == nil {
+		go s.serveJob(job)
+		return true
+	}
+	select {
+	case s.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
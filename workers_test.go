@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+// BenchmarkWorkers 对比 worker pool 与每个连接一个 goroutine:并发的短连接各转发一个小请求后关闭
+func BenchmarkWorkers(b *testing.B) {
+	resp := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"
+	backend := startBackend(b, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+			io.WriteString(conn, resp)
+		}
+	})
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+
+	for _, bm := range []struct {
+		name    string
+		workers int
+	}{
+		{"goroutine", 0},
+		{"pool", 4 * runtime.GOMAXPROCS(0)},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			s := startServer(b, Config{
+				DestAddrs: []string{backend},
+				Workers:   bm.workers,
+				// 队列足够大,benchmark 只比较调度开销,不触发 workers_busy
+				WorkerQueue: 1024,
+			})
+			addr := s.Addr().String()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					conn.Write(req)
+					if n, err := io.Copy(io.Discard, conn); err != nil || n != int64(len(resp)) {
+						b.Errorf("读到 %d 字节的响应, err = %v", n, err)
+					}
+					conn.Close()
+				}
+			})
+			b.StopTimer()
+			if n := rejectCount(s, rejectWorkersBusy); n > 0 {
+				b.Errorf("%d 个连接因 worker 队列已满被拒绝", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine 是去掉缩进后的一行 YAML,raw 保留原始内容供块标量使用
+type yamlLine struct {
+	num    int // 行号,从 1 开始,用于错误信息
+	indent int
+	text   string
+	raw    string
+}
+
+// parseYAML 解析 YAML 的常用子集:缩进表示的映射与列表、行内列表 [a, b]、
+// 单双引号字符串、| 块标量和 # 注释。标量一律以字符串返回,由调用方按字段类型转换
+func parseYAML(data []byte) (any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, " \r")
+		trimmed := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("第 %d 行: 缩进不能使用 tab", i+1)
+		}
+		text := stripYAMLComment(trimmed)
+		if text == "" || text == "---" {
+			// 空行保留给块标量,其余场景跳过
+			lines = append(lines, yamlLine{num: i + 1, indent: -1, raw: raw})
+			continue
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: len(raw) - len(trimmed), text: text, raw: raw})
+	}
+
+	p := &yamlParser{lines: lines}
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return map[string]any{}, nil
+	}
+	v, err := p.parseNode(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("第 %d 行: 缩进不正确", p.lines[p.pos].num)
+	}
+	return v, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && p.lines[p.pos].indent < 0 {
+		p.pos++
+	}
+}
+
+// parseNode 解析从当前行开始、缩进为 indent 的映射或列表
+func (p *yamlParser) parseNode(indent int) (any, error) {
+	if isYAMLListItem(p.lines[p.pos].text) {
+		return p.parseList(indent)
+	}
+	return p.parseMap(indent)
+}
+
+func (p *yamlParser) parseList(indent int) ([]any, error) {
+	var list []any
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := &p.lines[p.pos]
+		if line.indent < indent || !isYAMLListItem(line.text) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("第 %d 行: 缩进不正确", line.num)
+		}
+
+		content := strings.TrimLeft(line.text[1:], " ")
+		if content == "" {
+			// "-" 独占一行,元素在下面更深的缩进里
+			p.pos++
+			v, err := p.parseChild(indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+		if _, _, ok := splitYAMLKey(content); ok {
+			// "- key: value" 开始一个映射,把该行改写成映射的第一行
+			line.indent += len(line.text) - len(content)
+			line.text = content
+			v, err := p.parseMap(line.indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+		v, err := parseYAMLScalar(content)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行: %w", line.num, err)
+		}
+		list = append(list, v)
+		p.pos++
+	}
+	return list, nil
+}
+
+func (p *yamlParser) parseMap(indent int) (map[string]any, error) {
+	m := make(map[string]any)
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("第 %d 行: 缩进不正确", line.num)
+		}
+		if isYAMLListItem(line.text) {
+			break
+		}
+
+		key, value, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("第 %d 行: 应为 key: value 格式", line.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("第 %d 行: 重复的键 %s", line.num, key)
+		}
+		p.pos++
+
+		switch {
+		case value == "|" || value == "|-":
+			m[key] = p.parseBlock(indent, value == "|-")
+		case value == "":
+			// 值在下一行:更深缩进的子节点,或同一缩进下的列表
+			p.skipBlank()
+			if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLListItem(p.lines[p.pos].text) {
+				v, err := p.parseList(indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				continue
+			}
+			v, err := p.parseChild(indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		default:
+			v, err := parseYAMLScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("第 %d 行: %w", line.num, err)
+			}
+			m[key] = v
+		}
+	}
+	return m, nil
+}
+
+// parseChild 解析缩进比 parent 更深的子节点,没有子节点时返回空字符串
+func (p *yamlParser) parseChild(parent int) (any, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent <= parent {
+		return "", nil
+	}
+	return p.parseNode(p.lines[p.pos].indent)
+}
+
+// parseBlock 读取 | 块标量:缩进比 parent 更深的所有原始行,保留换行
+func (p *yamlParser) parseBlock(parent int, strip bool) string {
+	var b strings.Builder
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		raw := line.raw
+		leading := len(raw) - len(strings.TrimLeft(raw, " "))
+		if strings.TrimSpace(raw) != "" && leading <= parent {
+			break
+		}
+		if blockIndent < 0 && strings.TrimSpace(raw) != "" {
+			blockIndent = leading
+		}
+		if blockIndent >= 0 && len(raw) >= blockIndent {
+			raw = raw[blockIndent:]
+		} else {
+			raw = ""
+		}
+		b.WriteString(raw)
+		b.WriteByte('\n')
+	}
+
+	s := strings.TrimRight(b.String(), "\n")
+	if !strip && s != "" {
+		s += "\n"
+	}
+	return s
+}
+
+func isYAMLListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey 拆分 "key: value",键可以带引号
+func splitYAMLKey(text string) (key, value string, ok bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+			return "", "", false
+		}
+		return text[1 : end+1], strings.TrimSpace(text[end+3:]), true
+	}
+	if text[0] == '[' {
+		return "", "", false
+	}
+
+	if i := strings.Index(text, ": "); i > 0 {
+		return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:]), true
+	}
+	if strings.HasSuffix(text, ":") {
+		return strings.TrimSpace(text[:len(text)-1]), "", true
+	}
+	return "", "", false
+}
+
+// parseYAMLScalar 解析行内的值:[a, b] 列表、引号字符串或普通字符串
+func parseYAMLScalar(s string) (any, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("行内列表缺少 ]: %s", s)
+		}
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		list := []any{}
+		if inner == "" {
+			return list, nil
+		}
+		for _, item := range splitYAMLFlow(inner) {
+			v, err := parseYAMLScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	}
+	return unquoteYAML(s)
+}
+
+// splitYAMLFlow 按逗号拆分行内列表,忽略引号内的逗号
+func splitYAMLFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+func unquoteYAML(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("无效的双引号字符串: %s", s)
+		}
+		return v, nil
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	if s == "~" || s == "null" {
+		return "", nil
+	}
+	return s, nil
+}
+
+// stripYAMLComment 去掉不在引号内、且位于行首或空白之后的 # 注释
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || s[i-1] == ' ' || s[i-1] == '[' || s[i-1] == ',' || s[i-1] == ':' || s[i-1] == '-' {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || s[i-1] == ' ' {
+				return strings.TrimRight(s[:i], " ")
+			}
+		}
+	}
+	return s
+}